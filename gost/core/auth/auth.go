@@ -1,12 +1,20 @@
 package auth
 
-import "context"
+import (
+	"context"
+	"net/url"
+)
 
 // Authenticator is an interface for user authentication.
 type Authenticator interface {
 	Authenticate(ctx context.Context, user, password string) bool
 }
 
+// Credentials provides the credentials for an upstream server, they may change over time.
+type Credentials interface {
+	Userinfo() *url.Userinfo
+}
+
 type authenticatorGroup struct {
 	authers []Authenticator
 }
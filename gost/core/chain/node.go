@@ -1,6 +1,8 @@
 package chain
 
 import (
+	"time"
+
 	"proxy_forwarder/gost/core/auth"
 	"proxy_forwarder/gost/core/bypass"
 	"proxy_forwarder/gost/core/hosts"
@@ -19,6 +21,18 @@ type TLSNodeSettings struct {
 	Secure     bool
 }
 
+// HappyEyeballsNodeSettings configures dialing all addresses of a node hostname (RFC 8305).
+type HappyEyeballsNodeSettings struct {
+	// address family tried first, "ip6" or "ip4"
+	Prefer string
+	// how long to wait for the addresses of the preferred family if the other answered first
+	ResolutionDelay time.Duration
+	// delay before the next address is tried while the previous attempts are still running
+	AttemptDelay time.Duration
+	// how long a failed address is tried last
+	FailTimeout time.Duration
+}
+
 type NodeOptions struct {
 	Transport  *Transport
 	Bypass     bypass.Bypass
@@ -30,6 +44,9 @@ type NodeOptions struct {
 	HTTP       *HTTPNodeSettings
 	TLS        *TLSNodeSettings
 	Auther     auth.Authenticator
+	Pool       ConnPool
+	// HappyEyeballs is nil if only the first address is dialed
+	HappyEyeballs *HappyEyeballsNodeSettings
 }
 
 type NodeOption func(*NodeOptions)
@@ -94,6 +111,18 @@ func AutherNodeOption(auther auth.Authenticator) NodeOption {
 	}
 }
 
+func PoolNodeOption(pool ConnPool) NodeOption {
+	return func(o *NodeOptions) {
+		o.Pool = pool
+	}
+}
+
+func HappyEyeballsNodeOption(settings *HappyEyeballsNodeSettings) NodeOption {
+	return func(o *NodeOptions) {
+		o.HappyEyeballs = settings
+	}
+}
+
 type Node struct {
 	Name    string
 	Addr    string
@@ -0,0 +1,13 @@
+package chain
+
+import (
+	"context"
+	"net"
+)
+
+// ConnPool keeps idle connections to a node, which are reused for plain HTTP requests.
+type ConnPool interface {
+	// Get returns an idle connection for key or one created by dial.
+	// The connection goes back to the pool by its Release() method, Close closes it.
+	Get(ctx context.Context, key string, dial func(ctx context.Context) (net.Conn, error)) (net.Conn, error)
+}
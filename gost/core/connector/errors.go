@@ -0,0 +1,19 @@
+package connector
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// ProxyError is returned by a connector when the upstream proxy refused to establish the connection.
+type ProxyError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *ProxyError) Error() string {
+	if e.StatusCode == http.StatusForbidden {
+		return "upstream proxy denied the connection"
+	}
+	return fmt.Sprintf("upstream proxy connection failed with code %s", e.Status)
+}
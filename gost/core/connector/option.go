@@ -5,14 +5,16 @@ import (
 	"net/url"
 	"time"
 
+	"proxy_forwarder/gost/core/auth"
 	"proxy_forwarder/gost/core/common/net/dialer"
 	"proxy_forwarder/gost/core/logger"
 )
 
 type Options struct {
-	Auth      *url.Userinfo
-	TLSConfig *tls.Config
-	Logger    logger.Logger
+	Auth        *url.Userinfo
+	Credentials auth.Credentials
+	TLSConfig   *tls.Config
+	Logger      logger.Logger
 }
 
 type Option func(opts *Options)
@@ -23,6 +25,13 @@ func AuthOption(auth *url.Userinfo) Option {
 	}
 }
 
+// CredentialsOption sets credentials that are looked up for each connection, they take precedence over Auth.
+func CredentialsOption(credentials auth.Credentials) Option {
+	return func(opts *Options) {
+		opts.Credentials = credentials
+	}
+}
+
 func TLSConfigOption(tlsConfig *tls.Config) Option {
 	return func(opts *Options) {
 		opts.TLSConfig = tlsConfig
@@ -0,0 +1,68 @@
+package sniffer
+
+import "context"
+
+// Protocol classes reported by the built-in sniffers.
+const (
+	ProtocolTLS           = "tls"
+	ProtocolHTTP          = "http"
+	ProtocolHTTP2         = "h2c"
+	ProtocolSSH           = "ssh"
+	ProtocolSOCKS         = "socks"
+	ProtocolProxyProtocol = "proxy-protocol"
+)
+
+// Confidence describes how sure a sniffer is about its result.
+type Confidence int
+
+const (
+	ConfidenceNone Confidence = iota
+	ConfidenceLow
+	ConfidenceMedium
+	ConfidenceHigh
+)
+
+func (c Confidence) String() string {
+	switch c {
+	case ConfidenceLow:
+		return "low"
+	case ConfidenceMedium:
+		return "medium"
+	case ConfidenceHigh:
+		return "high"
+	default:
+		return "none"
+	}
+}
+
+// Result is the outcome of sniffing the first bytes of a flow.
+type Result struct {
+	Protocol   string
+	Host       string
+	Confidence Confidence
+}
+
+// Sniffer detects the application protocol from the bytes peeked from a client connection.
+type Sniffer interface {
+	// Sniff returns nil if the data does not look like the sniffer's protocol.
+	Sniff(ctx context.Context, b []byte) *Result
+}
+
+type resultKey struct{}
+
+var (
+	sniffResultKey = &resultKey{}
+)
+
+// ContextWithResult stores the sniffing result in the flow context.
+func ContextWithResult(ctx context.Context, res *Result) context.Context {
+	return context.WithValue(ctx, sniffResultKey, res)
+}
+
+// ResultFromContext returns the sniffing result of the flow, or nil if the flow was not sniffed.
+func ResultFromContext(ctx context.Context) *Result {
+	if v, _ := ctx.Value(sniffResultKey).(*Result); v != nil {
+		return v
+	}
+	return nil
+}
@@ -18,6 +18,11 @@ import (
 	"proxy_forwarder/gost/x/registry"
 )
 
+const (
+	// credential files are re-read this often, so rotated passwords are used
+	defaultCredentialsReload = 10 * time.Second
+)
+
 var (
 	ErrInvalidCmd  = errors.New("invalid cmd")
 	ErrInvalidNode = errors.New("invalid node")
@@ -72,10 +77,16 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 		mc := nodeConfig.Connector.Metadata
 		md := mdx.NewMetadata(mc)
 
+		healthCheck, err := parseHealthCheck(mc)
+		if err != nil {
+			return nil, err
+		}
+
 		hopConfig := &config.HopConfig{
-			Name:     fmt.Sprintf("%shop-%d", namePrefix, i),
-			Selector: parseSelector(mc),
-			Nodes:    nodes,
+			Name:        fmt.Sprintf("%shop-%d", namePrefix, i),
+			Selector:    parseSelector(mc),
+			HealthCheck: healthCheck,
+			Nodes:       nodes,
 		}
 
 		if v := mdutil.GetString(md, "bypass"); v != "" {
@@ -213,6 +224,25 @@ func buildConfigFromCmd(services, nodes stringList) (*config.Config, error) {
 			cfg.Bypasses = append(cfg.Bypasses, bypassCfg)
 			delete(mh, "bypass")
 		}
+		if v := mdutil.GetString(md, "deny.fingerprints"); v != "" {
+			// the fingerprints are matched exactly by the 'ja3:' and 'ja4:' entries of a bypass
+			bypassCfg := &config.BypassConfig{
+				Name: fmt.Sprintf("%sbypass-%d", namePrefix, len(cfg.Bypasses)),
+			}
+			for _, s := range strings.Split(v, ",") {
+				if s = strings.TrimSpace(s); s == "" {
+					continue
+				}
+				k, fp, _ := strings.Cut(s, "=")
+				if k = strings.ToLower(k); (k != "ja3" && k != "ja4") || fp == "" {
+					return nil, fmt.Errorf("invalid TLS fingerprint %s, must be ja3=<md5> or ja4=<fingerprint>", s)
+				}
+				bypassCfg.Matchers = append(bypassCfg.Matchers, k+":"+fp)
+			}
+			service.Bypasses = append(service.Bypasses, bypassCfg.Name)
+			cfg.Bypasses = append(cfg.Bypasses, bypassCfg)
+			delete(mh, "deny.fingerprints")
+		}
 		if v := mdutil.GetString(md, "resolver"); v != "" {
 			resolverCfg := &config.ResolverConfig{
 				Name: fmt.Sprintf("%sresolver-%d", namePrefix, len(cfg.Resolvers)),
@@ -480,6 +510,29 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 	}
 	delete(m, "auth")
 
+	// credentials loaded at runtime, kept out of the command line
+	authEnv := mdutil.GetString(md, "auth.env")
+	authCredential := mdutil.GetString(md, "auth.credential")
+	authFile := mdutil.GetString(md, "auth.file")
+	if authEnv != "" || authCredential != "" || authFile != "" {
+		if auth == nil {
+			auth = &config.AuthConfig{}
+		}
+		auth.Env = authEnv
+		auth.Credential = authCredential
+		if authFile != "" {
+			auth.File = &config.FileLoader{Path: authFile}
+		}
+		auth.Reload = mdutil.GetDuration(md, "auth.reload")
+		if auth.Reload <= 0 {
+			auth.Reload = defaultCredentialsReload
+		}
+	}
+	delete(m, "auth.env")
+	delete(m, "auth.credential")
+	delete(m, "auth.file")
+	delete(m, "auth.reload")
+
 	tlsConfig := &config.TLSConfig{
 		CertFile:   mdutil.GetString(md, "certFile", "cert"),
 		KeyFile:    mdutil.GetString(md, "keyFile", "key"),
@@ -487,10 +540,25 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 		Secure:     mdutil.GetBool(md, "secure"),
 		ServerName: mdutil.GetString(md, "serverName"),
 	}
+	serverName := tlsConfig.ServerName
 	if tlsConfig.ServerName == "" {
 		tlsConfig.ServerName = url.Hostname()
 	}
 
+	tlsOptions := &config.TLSOptions{
+		MinVersion:   mdutil.GetString(md, "minVersion"),
+		SessionCache: mdutil.GetBool(md, "sessionCache"),
+	}
+	for _, pin := range strings.Split(mdutil.GetString(md, "pin"), ",") {
+		if pin != "" {
+			// '+' of unescaped base64 pins is decoded as space
+			tlsOptions.Pins = append(tlsOptions.Pins, strings.ReplaceAll(pin, " ", "+"))
+		}
+	}
+	if tlsOptions.MinVersion != "" || tlsOptions.SessionCache || len(tlsOptions.Pins) > 0 {
+		tlsConfig.Options = tlsOptions
+	}
+
 	delete(m, "certFile")
 	delete(m, "cert")
 	delete(m, "keyFile")
@@ -499,8 +567,12 @@ func buildNodeConfig(url *url.URL) (*config.NodeConfig, error) {
 	delete(m, "ca")
 	delete(m, "secure")
 	delete(m, "serverName")
+	delete(m, "minVersion")
+	delete(m, "sessionCache")
+	delete(m, "pin")
 
-	if !tlsConfig.Secure && tlsConfig.CertFile == "" && tlsConfig.CAFile == "" {
+	if !tlsConfig.Secure && tlsConfig.CertFile == "" && tlsConfig.CAFile == "" &&
+		serverName == "" && tlsConfig.Options == nil {
 		tlsConfig = nil
 	}
 
@@ -593,3 +665,46 @@ func parseSelector(m map[string]any) *config.SelectorConfig {
 		FailTimeout: failTimeout,
 	}
 }
+
+// parseHealthCheck returns the active checks of the nodes, enabled by healthCheck=true
+// or any healthCheck.* option.
+func parseHealthCheck(m map[string]any) (*config.HealthCheckConfig, error) {
+	md := mdx.NewMetadata(m)
+	keys := []string{
+		"healthCheck.interval", "healthCheck.timeout", "healthCheck.jitter", "healthCheck.target",
+		"healthCheck.status", "healthCheck.fall", "healthCheck.rise",
+	}
+	enabled := mdutil.GetBool(md, "healthCheck")
+	for _, k := range keys {
+		enabled = enabled || md.IsExists(k)
+	}
+	if !enabled {
+		delete(m, "healthCheck")
+		return nil, nil
+	}
+
+	hc := &config.HealthCheckConfig{
+		Interval: mdutil.GetDuration(md, "healthCheck.interval"),
+		Timeout:  mdutil.GetDuration(md, "healthCheck.timeout"),
+		Jitter:   mdutil.GetDuration(md, "healthCheck.jitter"),
+		Target:   mdutil.GetString(md, "healthCheck.target"),
+		Fall:     mdutil.GetInt(md, "healthCheck.fall"),
+		Rise:     mdutil.GetInt(md, "healthCheck.rise"),
+	}
+	for _, s := range strings.Split(mdutil.GetString(md, "healthCheck.status"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		code, err := strconv.Atoi(s)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid healthCheck.status: %s", s)
+		}
+		hc.Status = append(hc.Status, code)
+	}
+
+	delete(m, "healthCheck")
+	for _, k := range keys {
+		delete(m, k)
+	}
+	return hc, nil
+}
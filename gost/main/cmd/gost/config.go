@@ -9,6 +9,7 @@ import (
 	"proxy_forwarder/gost/core/service"
 	"proxy_forwarder/gost/x/config"
 	"proxy_forwarder/gost/x/config/parsing"
+	"proxy_forwarder/gost/x/fakeip"
 	xlogger "proxy_forwarder/gost/x/logger"
 	metrics "proxy_forwarder/gost/x/metrics/service"
 	"proxy_forwarder/gost/x/registry"
@@ -168,5 +169,6 @@ func buildMetricsService(cfg *config.MetricsConfig) (service.Service, error) {
 	return metrics.NewService(
 		cfg.Addr,
 		metrics.PathOption(cfg.Path),
+		metrics.HandlerOption("/fakeip", fakeip.Handler()),
 	)
 }
@@ -9,8 +9,10 @@ and the data processing layer corresponds to the connector, the handler and the
 import (
 	// Register connectors
 	_ "proxy_forwarder/gost/x/connector/http"
+	_ "proxy_forwarder/gost/x/connector/socks/v5"
 
 	// Register dialers
+	_ "proxy_forwarder/gost/x/dialer/http2"
 	_ "proxy_forwarder/gost/x/dialer/tcp"
 	_ "proxy_forwarder/gost/x/dialer/tls"
 
@@ -19,10 +21,14 @@ import (
 
 	// Register handlers
 	_ "proxy_forwarder/gost/x/handler/auto"
+	_ "proxy_forwarder/gost/x/handler/redirect/dns"
 	_ "proxy_forwarder/gost/x/handler/redirect/tcp"
 	_ "proxy_forwarder/gost/x/handler/redirect/udp"
 
 	// Register listeners
 	_ "proxy_forwarder/gost/x/listener/redirect/tcp"
 	_ "proxy_forwarder/gost/x/listener/redirect/udp"
+
+	// Register sniffers
+	_ "proxy_forwarder/gost/x/sniffer"
 )
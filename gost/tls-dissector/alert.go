@@ -0,0 +1,34 @@
+package dissector
+
+import "crypto/tls"
+
+// alert level
+const (
+	AlertLevelWarning = 1
+	AlertLevelFatal   = 2
+)
+
+// alert description
+const (
+	AlertCloseNotify            = 0
+	AlertHandshakeFailure       = 40
+	AlertBadCertificate         = 42
+	AlertUnsupportedCertificate = 43
+	AlertCertificateRevoked     = 44
+	AlertCertificateExpired     = 45
+	AlertCertificateUnknown     = 46
+	AlertUnknownCA              = 48
+	AlertAccessDenied           = 49
+	AlertInternalError          = 80
+	AlertUnrecognizedName       = 112
+	AlertNoApplicationProtocol  = 120
+)
+
+// NewAlertRecord returns a plaintext alert record, as sent before the handshake has completed.
+func NewAlertRecord(level, description uint8) *Record {
+	return &Record{
+		Type:    EncryptedAlert,
+		Version: tls.VersionTLS12,
+		Opaque:  []byte{level, description},
+	}
+}
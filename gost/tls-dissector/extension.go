@@ -16,12 +16,23 @@ const (
 	ExtSupportedGroups      uint16 = 0x0a
 	ExtECPointFormats       uint16 = 0x0b
 	ExtSignatureAlgorithms  uint16 = 0x0d
+	ExtALPN                 uint16 = 0x10
 	ExtEncryptThenMac       uint16 = 0x16
 	ExtExtendedMasterSecret uint16 = 0x17
 	ExtSessionTicket        uint16 = 0x23
+	ExtSupportedVersions    uint16 = 0x2b
+	ExtPSKKeyExchangeModes  uint16 = 0x2d
+	ExtKeyShare             uint16 = 0x33
+	ExtEncryptedClientHello uint16 = 0xfe0d
 	ExtRenegotiationInfo    uint16 = 0xff01
 )
 
+// IsGREASE reports whether v is one of the reserved GREASE values of RFC 8701,
+// which clients send in place of cipher suites, extensions, groups and versions.
+func IsGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
 var (
 	ErrShortBuffer  = errors.New("short buffer")
 	ErrTypeMismatch = errors.New("type mismatch")
@@ -43,15 +54,29 @@ func NewExtension(t uint16, data []byte) (ext Extension, err error) {
 		ext = new(ECPointFormatsExtension)
 	case ExtSignatureAlgorithms:
 		ext = new(SignatureAlgorithmsExtension)
+	case ExtALPN:
+		ext = new(ALPNExtension)
 	case ExtEncryptThenMac:
 		ext = new(EncryptThenMacExtension)
 	case ExtExtendedMasterSecret:
 		ext = new(ExtendedMasterSecretExtension)
 	case ExtSessionTicket:
 		ext = new(SessionTicketExtension)
+	case ExtSupportedVersions:
+		ext = new(SupportedVersionsExtension)
+	case ExtPSKKeyExchangeModes:
+		ext = new(PSKKeyExchangeModesExtension)
+	case ExtKeyShare:
+		ext = new(KeyShareExtension)
+	case ExtEncryptedClientHello:
+		ext = new(EncryptedClientHelloExtension)
 	case ExtRenegotiationInfo:
 		ext = new(RenegotiationInfoExtension)
 	default:
+		if IsGREASE(t) {
+			ext = &GREASEExtension{Value: t}
+			break
+		}
 		ext = &unknownExtension{
 			types: t,
 		}
@@ -256,6 +281,50 @@ func (ext *SignatureAlgorithmsExtension) Decode(b []byte) error {
 	return nil
 }
 
+type ALPNExtension struct {
+	Protocols []string
+}
+
+func (ext *ALPNExtension) Type() uint16 {
+	return ExtALPN
+}
+
+func (ext *ALPNExtension) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	n := 0
+	for _, proto := range ext.Protocols {
+		n += 1 + len(proto)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(n))
+	for _, proto := range ext.Protocols {
+		buf.WriteByte(uint8(len(proto)))
+		buf.WriteString(proto)
+	}
+	return buf.Bytes(), nil
+}
+
+func (ext *ALPNExtension) Decode(b []byte) error {
+	if len(b) < 2 {
+		return ErrShortBuffer
+	}
+
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b[2:]) < n {
+		return ErrShortBuffer
+	}
+
+	b = b[2 : 2+n]
+	for len(b) > 0 {
+		l := int(b[0])
+		if len(b[1:]) < l {
+			return ErrShortBuffer
+		}
+		ext.Protocols = append(ext.Protocols, string(b[1:1+l]))
+		b = b[1+l:]
+	}
+	return nil
+}
+
 type EncryptThenMacExtension struct {
 	Data []byte
 }
@@ -321,3 +390,183 @@ func (ext *RenegotiationInfoExtension) Decode(b []byte) error {
 
 	return nil
 }
+
+type SupportedVersionsExtension struct {
+	// Versions offered by the client, or the single version selected by the server.
+	Versions []uint16
+}
+
+func (ext *SupportedVersionsExtension) Type() uint16 {
+	return ExtSupportedVersions
+}
+
+func (ext *SupportedVersionsExtension) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(uint8(len(ext.Versions) * 2))
+	for _, v := range ext.Versions {
+		binary.Write(buf, binary.BigEndian, v)
+	}
+	return buf.Bytes(), nil
+}
+
+func (ext *SupportedVersionsExtension) Decode(b []byte) error {
+	// ServerHello: selected_version
+	if len(b) == 2 {
+		ext.Versions = []uint16{binary.BigEndian.Uint16(b)}
+		return nil
+	}
+
+	if len(b) < 1 {
+		return ErrShortBuffer
+	}
+	n := int(b[0])
+	if len(b[1:]) < n {
+		return ErrShortBuffer
+	}
+	for i := 0; i+1 < n; i += 2 {
+		ext.Versions = append(ext.Versions, binary.BigEndian.Uint16(b[1+i:]))
+	}
+	return nil
+}
+
+type PSKKeyExchangeModesExtension struct {
+	Modes []uint8
+}
+
+func (ext *PSKKeyExchangeModesExtension) Type() uint16 {
+	return ExtPSKKeyExchangeModes
+}
+
+func (ext *PSKKeyExchangeModesExtension) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(uint8(len(ext.Modes)))
+	buf.Write(ext.Modes)
+	return buf.Bytes(), nil
+}
+
+func (ext *PSKKeyExchangeModesExtension) Decode(b []byte) error {
+	if len(b) < 1 {
+		return ErrShortBuffer
+	}
+
+	n := int(b[0])
+	if len(b[1:]) < n {
+		return ErrShortBuffer
+	}
+	ext.Modes = make([]uint8, n)
+	copy(ext.Modes, b[1:])
+	return nil
+}
+
+type KeyShareEntry struct {
+	Group uint16
+	Key   []byte
+}
+
+type KeyShareExtension struct {
+	// Key shares offered by the client, or the single share of the server.
+	// A HelloRetryRequest only contains the selected group without a key.
+	Entries []KeyShareEntry
+}
+
+func (ext *KeyShareExtension) Type() uint16 {
+	return ExtKeyShare
+}
+
+func (ext *KeyShareExtension) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	n := 0
+	for _, entry := range ext.Entries {
+		n += 4 + len(entry.Key)
+	}
+	binary.Write(buf, binary.BigEndian, uint16(n))
+	for _, entry := range ext.Entries {
+		binary.Write(buf, binary.BigEndian, entry.Group)
+		binary.Write(buf, binary.BigEndian, uint16(len(entry.Key)))
+		buf.Write(entry.Key)
+	}
+	return buf.Bytes(), nil
+}
+
+func (ext *KeyShareExtension) Decode(b []byte) error {
+	if len(b) < 2 {
+		return ErrShortBuffer
+	}
+
+	// HelloRetryRequest: selected_group
+	if len(b) == 2 {
+		ext.Entries = []KeyShareEntry{{Group: binary.BigEndian.Uint16(b)}}
+		return nil
+	}
+
+	// ClientHello: client_shares, otherwise ServerHello: server_share
+	if n := int(binary.BigEndian.Uint16(b)); n == len(b)-2 {
+		b = b[2:]
+	}
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return ErrShortBuffer
+		}
+		entry := KeyShareEntry{
+			Group: binary.BigEndian.Uint16(b),
+		}
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if len(b[4:]) < n {
+			return ErrShortBuffer
+		}
+		entry.Key = make([]byte, n)
+		copy(entry.Key, b[4:])
+		ext.Entries = append(ext.Entries, entry)
+		b = b[4+n:]
+	}
+	return nil
+}
+
+// EncryptedClientHelloExtension is the encrypted_client_hello extension of
+// draft-ietf-tls-esni. Only the outer ClientHello is visible, the payload stays opaque.
+type EncryptedClientHelloExtension struct {
+	// 0: outer, 1: inner
+	ClientHelloType uint8
+	Data            []byte
+}
+
+func (ext *EncryptedClientHelloExtension) Type() uint16 {
+	return ExtEncryptedClientHello
+}
+
+func (ext *EncryptedClientHelloExtension) Encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(ext.ClientHelloType)
+	buf.Write(ext.Data)
+	return buf.Bytes(), nil
+}
+
+func (ext *EncryptedClientHelloExtension) Decode(b []byte) error {
+	if len(b) < 1 {
+		return ErrShortBuffer
+	}
+
+	ext.ClientHelloType = b[0]
+	ext.Data = make([]byte, len(b)-1)
+	copy(ext.Data, b[1:])
+	return nil
+}
+
+type GREASEExtension struct {
+	Value uint16
+	Data  []byte
+}
+
+func (ext *GREASEExtension) Type() uint16 {
+	return ext.Value
+}
+
+func (ext *GREASEExtension) Encode() ([]byte, error) {
+	return ext.Data, nil
+}
+
+func (ext *GREASEExtension) Decode(b []byte) error {
+	ext.Data = make([]byte, len(b))
+	copy(ext.Data, b)
+	return nil
+}
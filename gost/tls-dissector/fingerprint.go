@@ -0,0 +1,148 @@
+package dissector
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// JA3 returns the JA3 fingerprint string of the ClientHello and its MD5 hash.
+// See https://github.com/salesforce/ja3
+func JA3(m *ClientHelloMsg) (fingerprint string, hash string) {
+	var ciphers, exts, groups, formats []string
+	for _, c := range m.CipherSuites {
+		if !IsGREASE(c) {
+			ciphers = append(ciphers, strconv.Itoa(int(c)))
+		}
+	}
+	for _, ext := range m.Extensions {
+		if IsGREASE(ext.Type()) {
+			continue
+		}
+		exts = append(exts, strconv.Itoa(int(ext.Type())))
+
+		switch e := ext.(type) {
+		case *SupportedGroupsExtension:
+			for _, g := range e.Groups {
+				if !IsGREASE(g) {
+					groups = append(groups, strconv.Itoa(int(g)))
+				}
+			}
+		case *ECPointFormatsExtension:
+			for _, f := range e.Formats {
+				formats = append(formats, strconv.Itoa(int(f)))
+			}
+		}
+	}
+
+	fingerprint = strings.Join([]string{
+		strconv.Itoa(int(m.Version)),
+		strings.Join(ciphers, "-"),
+		strings.Join(exts, "-"),
+		strings.Join(groups, "-"),
+		strings.Join(formats, "-"),
+	}, ",")
+	sum := md5.Sum([]byte(fingerprint))
+	hash = hex.EncodeToString(sum[:])
+	return
+}
+
+// JA4 returns the JA4 fingerprint of a ClientHello received over TCP.
+// See https://github.com/FoxIO-LLC/ja4
+func JA4(m *ClientHelloMsg) string {
+	version := m.Version
+	sni := "i"
+	alpn := "00"
+	var ciphers, exts, algs []string
+	for _, c := range m.CipherSuites {
+		if !IsGREASE(c) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", c))
+		}
+	}
+
+	nexts := 0
+	for _, ext := range m.Extensions {
+		if IsGREASE(ext.Type()) {
+			continue
+		}
+		nexts++
+
+		switch e := ext.(type) {
+		case *ServerNameExtension:
+			sni = "d"
+			continue
+		case *ALPNExtension:
+			if len(e.Protocols) > 0 && e.Protocols[0] != "" {
+				p := e.Protocols[0]
+				alpn = string(p[0]) + string(p[len(p)-1])
+			}
+			continue
+		case *SupportedVersionsExtension:
+			var max uint16
+			for _, v := range e.Versions {
+				if !IsGREASE(v) && v > max {
+					max = v
+				}
+			}
+			if max > 0 {
+				version = Version(max)
+			}
+		case *SignatureAlgorithmsExtension:
+			for _, alg := range e.Algorithms {
+				if !IsGREASE(alg) {
+					algs = append(algs, fmt.Sprintf("%04x", alg))
+				}
+			}
+		}
+		exts = append(exts, fmt.Sprintf("%04x", ext.Type()))
+	}
+
+	sort.Strings(ciphers)
+	sort.Strings(exts)
+
+	extsPart := strings.Join(exts, ",")
+	if len(algs) > 0 {
+		extsPart += "_" + strings.Join(algs, ",")
+	}
+
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s",
+		ja4Version(version), sni, min(len(ciphers), 99), min(nexts, 99), alpn,
+		ja4Hash(ciphers, strings.Join(ciphers, ",")), ja4Hash(exts, extsPart))
+}
+
+func ja4Version(v Version) string {
+	switch v {
+	case tls.VersionTLS13:
+		return "13"
+	case tls.VersionTLS12:
+		return "12"
+	case tls.VersionTLS11:
+		return "11"
+	case tls.VersionTLS10:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+func ja4Hash(list []string, s string) string {
+	if len(list) == 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
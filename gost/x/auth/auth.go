@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"io"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +19,8 @@ import (
 
 type options struct {
 	auths       map[string]string
+	userinfo    *url.Userinfo
+	env         string
 	fileLoader  loader.Loader
 	redisLoader loader.Loader
 	httpLoader  loader.Loader
@@ -34,6 +37,20 @@ func AuthsOption(auths map[string]string) Option {
 	}
 }
 
+// UserinfoOption sets the static credentials, the loaded ones replace them.
+func UserinfoOption(userinfo *url.Userinfo) Option {
+	return func(opts *options) {
+		opts.userinfo = userinfo
+	}
+}
+
+// EnvOption sets the name of the environment variable to load the credentials from.
+func EnvOption(env string) Option {
+	return func(opts *options) {
+		opts.env = env
+	}
+}
+
 func ReloadPeriodOption(period time.Duration) Option {
 	return func(opts *options) {
 		opts.period = period
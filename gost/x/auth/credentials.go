@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/auth"
+	xlogger "proxy_forwarder/gost/x/logger"
+)
+
+var (
+	errEmptyCredentials   = errors.New("credentials are empty")
+	errInvalidCredentials = errors.New("credentials are not in the form 'user:password'")
+)
+
+// credentials holds the credentials for an upstream server, they are re-read periodically
+// so rotated passwords are used without a restart.
+type credentials struct {
+	userinfo   *url.Userinfo
+	mu         sync.RWMutex
+	cancelFunc context.CancelFunc
+	options    options
+}
+
+// NewCredentials creates Credentials loaded from the environment or a file.
+// The value is either 'user:password' or only the password of the static user.
+func NewCredentials(opts ...Option) auth.Credentials {
+	var options options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.logger == nil {
+		options.logger = xlogger.Nop()
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	c := &credentials{
+		userinfo:   options.userinfo,
+		cancelFunc: cancel,
+		options:    options,
+	}
+
+	if err := c.reload(ctx); err != nil {
+		options.logger.Warnf("reload: %v", err)
+	}
+	if c.options.period > 0 && c.options.fileLoader != nil {
+		go c.periodReload(ctx)
+	}
+
+	return c
+}
+
+func (c *credentials) Userinfo() *url.Userinfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.userinfo
+}
+
+func (c *credentials) periodReload(ctx context.Context) error {
+	period := c.options.period
+	if period < time.Second {
+		period = time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.reload(ctx); err != nil {
+				c.options.logger.Warnf("reload: %v", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *credentials) reload(ctx context.Context) error {
+	userinfo := c.options.userinfo
+
+	if c.options.env != "" {
+		if v, ok := os.LookupEnv(c.options.env); ok {
+			var err error
+			if userinfo, err = c.parseUserinfo(v); err != nil {
+				return fmt.Errorf("$%s: %w", c.options.env, err)
+			}
+		}
+	}
+
+	if c.options.fileLoader != nil {
+		r, err := c.options.fileLoader.Load(ctx)
+		if err != nil {
+			// keep the last credentials while the file is replaced
+			return err
+		}
+		v, err := readFirstLine(r)
+		if err != nil {
+			return err
+		}
+		// an empty or truncated file is kept as well, rotation tools may
+		// truncate the file before writing the new credentials
+		if userinfo, err = c.parseUserinfo(v); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.userinfo.String() != userinfo.String() {
+		if c.userinfo != nil {
+			c.options.logger.Infof("credentials of user %s changed", userinfo.Username())
+		}
+		c.userinfo = userinfo
+	}
+	return nil
+}
+
+// parseUserinfo parses 'user:password', or only the password if the user is configured.
+func (c *credentials) parseUserinfo(v string) (*url.Userinfo, error) {
+	if v == "" {
+		return nil, errEmptyCredentials
+	}
+	if c.options.userinfo != nil && c.options.userinfo.Username() != "" {
+		return url.UserPassword(c.options.userinfo.Username(), v), nil
+	}
+	user, password, ok := strings.Cut(v, ":")
+	if !ok || user == "" || password == "" {
+		return nil, errInvalidCredentials
+	}
+	return url.UserPassword(user, password), nil
+}
+
+func readFirstLine(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return line, nil
+	}
+	return "", scanner.Err()
+}
+
+func (c *credentials) Close() error {
+	c.cancelFunc()
+	if c.options.fileLoader != nil {
+		c.options.fileLoader.Close()
+	}
+	return nil
+}
@@ -78,11 +78,17 @@ func LoggerOption(logger logger.Logger) Option {
 	}
 }
 
+// Label patterns match properties of a flow instead of its destination, e.g. 'proto:ssh'
+// matches the flows sniffed as SSH and 'ja3:<md5>' the TLS clients with this fingerprint.
+// They are matched exactly.
+var labelKinds = []string{"proto", "ja3", "ja4"}
+
 type bypass struct {
 	ipMatcher       matcher.Matcher
 	cidrMatcher     matcher.Matcher
 	domainMatcher   matcher.Matcher
 	wildcardMatcher matcher.Matcher
+	labels          map[string]map[string]struct{}
 	cancelFunc      context.CancelFunc
 	options         options
 	mu              sync.RWMutex
@@ -145,7 +151,15 @@ func (bp *bypass) reload(ctx context.Context) error {
 	var inets []*net.IPNet
 	var domains []string
 	var wildcards []string
+	labels := make(map[string]map[string]struct{})
 	for _, pattern := range patterns {
+		if kind, value := parseLabel(pattern); kind != "" {
+			if labels[kind] == nil {
+				labels[kind] = make(map[string]struct{})
+			}
+			labels[kind][value] = struct{}{}
+			continue
+		}
 		if ip := net.ParseIP(pattern); ip != nil {
 			ips = append(ips, ip)
 			continue
@@ -168,6 +182,7 @@ func (bp *bypass) reload(ctx context.Context) error {
 	bp.cidrMatcher = matcher.CIDRMatcher(inets)
 	bp.domainMatcher = matcher.DomainMatcher(domains)
 	bp.wildcardMatcher = matcher.WildcardMatcher(wildcards)
+	bp.labels = labels
 
 	return nil
 }
@@ -246,6 +261,10 @@ func (bp *bypass) Contains(ctx context.Context, addr string) bool {
 		return false
 	}
 
+	if kind, value := parseLabel(addr); kind != "" {
+		return bp.containsLabel(kind, value)
+	}
+
 	// try to strip the port
 	if host, _, _ := net.SplitHostPort(addr); host != "" {
 		addr = host
@@ -261,6 +280,35 @@ func (bp *bypass) Contains(ctx context.Context, addr string) bool {
 	return b
 }
 
+// containsLabel matches a label of a flow. Flows are only checked against the kinds
+// of labels the bypass has patterns for, so a whitelist of hosts does not block them.
+func (bp *bypass) containsLabel(kind, value string) bool {
+	bp.mu.RLock()
+	values, ok := bp.labels[kind]
+	_, matched := values[value]
+	bp.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	b := !bp.options.whitelist && matched ||
+		bp.options.whitelist && !matched
+	if b {
+		bp.options.logger.Debugf("bypass: %s:%s", kind, value)
+	}
+	return b
+}
+
+// parseLabel splits a label pattern into its kind and value, kind is empty for other patterns.
+func parseLabel(s string) (kind, value string) {
+	for _, k := range labelKinds {
+		if strings.HasPrefix(s, k+":") {
+			return k, strings.ToLower(s[len(k)+1:])
+		}
+	}
+	return "", ""
+}
+
 func (bp *bypass) parseLine(s string) string {
 	if n := strings.IndexByte(s, '#'); n >= 0 {
 		s = s[:n]
@@ -78,6 +78,17 @@ func (c *Chain) Name() string {
 	return c.name
 }
 
+// Nodes returns the nodes of all hops of the chain.
+func (c *Chain) Nodes() (nodes []*chain.Node) {
+	if c == nil {
+		return
+	}
+	for _, hop := range c.hops {
+		nodes = append(nodes, hop.Nodes()...)
+	}
+	return
+}
+
 func (c *Chain) Route(ctx context.Context, network, address string) chain.Route {
 	if c == nil || len(c.hops) == 0 {
 		return nil
@@ -123,6 +134,19 @@ func (p *chainGroup) Route(ctx context.Context, network, address string) chain.R
 	return nil
 }
 
+// Nodes returns the nodes of all chains of the group.
+func (p *chainGroup) Nodes() (nodes []*chain.Node) {
+	if p == nil {
+		return
+	}
+	for _, c := range p.chains {
+		if v, ok := c.(interface{ Nodes() []*chain.Node }); ok {
+			nodes = append(nodes, v.Nodes()...)
+		}
+	}
+	return
+}
+
 func (p *chainGroup) next(ctx context.Context) chain.Chainer {
 	if p == nil || len(p.chains) == 0 {
 		return nil
@@ -0,0 +1,305 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/chain"
+	"proxy_forwarder/gost/core/resolver"
+	"proxy_forwarder/log"
+)
+
+const (
+	defaultResolutionDelay = 50 * time.Millisecond
+	defaultAttemptDelay    = 250 * time.Millisecond
+	defaultFailTimeout     = 30 * time.Second
+
+	failedAddrsPruneInterval = time.Minute
+)
+
+// addresses of the nodes whose dial failed recently
+var failedAddrs = &failedAddrSet{}
+
+// failedAddrSet maps the addresses to the time they are tried last until.
+// The expired entries are removed from time to time, not only when they are looked up.
+type failedAddrSet struct {
+	mu     sync.Mutex
+	addrs  map[string]time.Time
+	pruned time.Time
+}
+
+func (s *failedAddrSet) add(addr string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.addrs == nil {
+		s.addrs = make(map[string]time.Time)
+	}
+	s.addrs[addr] = until
+
+	now := time.Now()
+	if now.Sub(s.pruned) < failedAddrsPruneInterval {
+		return
+	}
+	s.pruned = now
+	for k, v := range s.addrs {
+		if now.After(v) {
+			delete(s.addrs, k)
+		}
+	}
+}
+
+func (s *failedAddrSet) remove(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.addrs, addr)
+}
+
+func (s *failedAddrSet) contains(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.addrs[addr]
+	if ok && time.Now().After(until) {
+		delete(s.addrs, addr)
+		return false
+	}
+	return ok
+}
+
+// dialNode dials the node. Hostnames are resolved for both address families and the
+// addresses are tried in turns, each attempt getting a head start before the next (RFC 8305).
+func dialNode(ctx context.Context, node *chain.Node) (net.Conn, error) {
+	tr := node.Options().Transport
+	settings := node.Options().HappyEyeballs
+
+	host, port, err := net.SplitHostPort(node.Addr)
+	if settings == nil || err != nil || host == "" || net.ParseIP(host) != nil ||
+		// the node is reached by another chain, it resolves the address
+		(tr.Options().Route != nil && len(tr.Options().Route.Nodes()) > 0) {
+		addr, err := chain.Resolve(ctx, "ip", node.Addr, node.Options().Resolver, node.Options().HostMapper)
+		if err != nil {
+			return nil, err
+		}
+		return tr.Dial(ctx, addr)
+	}
+
+	h := &happyEyeballs{
+		node:            node,
+		host:            host,
+		port:            port,
+		prefer:          "ip6",
+		resolutionDelay: settings.ResolutionDelay,
+		attemptDelay:    settings.AttemptDelay,
+		failTimeout:     settings.FailTimeout,
+		last:            1,
+	}
+	if settings.Prefer == "ip4" {
+		h.prefer = "ip4"
+	}
+	if h.resolutionDelay <= 0 {
+		h.resolutionDelay = defaultResolutionDelay
+	}
+	if h.attemptDelay <= 0 {
+		h.attemptDelay = defaultAttemptDelay
+	}
+	if h.failTimeout <= 0 {
+		h.failTimeout = defaultFailTimeout
+	}
+	return h.dial(ctx)
+}
+
+type lookupResult struct {
+	network string
+	ips     []net.IP
+	err     error
+}
+
+type dialResult struct {
+	addr string
+	conn net.Conn
+	err  error
+}
+
+type happyEyeballs struct {
+	node            *chain.Node
+	host            string
+	port            string
+	prefer          string
+	resolutionDelay time.Duration
+	attemptDelay    time.Duration
+	failTimeout     time.Duration
+	// addresses not tried yet, of the preferred and the other family
+	addrs [2][]string
+	// family of the last attempt
+	last int
+}
+
+func (h *happyEyeballs) dial(ctx context.Context) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the attempts finishing after the first connection close theirs
+	done := make(chan struct{})
+	defer close(done)
+
+	lookups := make(chan lookupResult, 2)
+	for _, network := range []string{"ip6", "ip4"} {
+		go func(network string) {
+			ips, err := h.lookup(ctx, network)
+			lookups <- lookupResult{network: network, ips: ips, err: err}
+		}(network)
+	}
+
+	dials := make(chan dialResult)
+	var attemptC <-chan time.Time
+	// addresses of the running attempts
+	running := make(map[string]bool)
+	start := func() {
+		addr := h.next()
+		if addr == "" {
+			attemptC = nil
+			return
+		}
+		running[addr] = true
+		attemptC = time.After(h.attemptDelay)
+		go func() {
+			conn, err := h.node.Options().Transport.Dial(ctx, addr)
+			select {
+			case dials <- dialResult{addr: addr, conn: conn, err: err}:
+			case <-done:
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	var (
+		resolutionC <-chan time.Time
+		resolved    bool
+		pending     = 2
+		lookupErr   error
+		dialErr     error
+	)
+	for {
+		select {
+		case res := <-lookups:
+			pending--
+			if res.err != nil {
+				lookupErr = res.err
+			}
+			n := h.add(res.network, res.ips)
+			if resolved {
+				if len(running) == 0 {
+					// the addresses answered first are used up
+					start()
+				} else if attemptC == nil {
+					attemptC = time.After(h.attemptDelay)
+				}
+				break
+			}
+			// the attempts start with the preferred family, which is waited for shortly
+			if (res.network == h.prefer && n > 0) || pending == 0 {
+				resolved = true
+				start()
+			} else if n > 0 {
+				resolutionC = time.After(h.resolutionDelay)
+			}
+		case <-resolutionC:
+			resolutionC = nil
+			if !resolved {
+				resolved = true
+				start()
+			}
+		case <-attemptC:
+			start()
+		case res := <-dials:
+			delete(running, res.addr)
+			if res.err == nil {
+				// the attempts still running are only slower, they are not marked as failed
+				failedAddrs.remove(res.addr)
+				return res.conn, nil
+			}
+			log.Debug("chain", fmt.Sprintf("dial %s (%s) failed: %v", res.addr, h.node.Addr, res.err))
+			failedAddrs.add(res.addr, time.Now().Add(h.failTimeout))
+			dialErr = res.err
+			// the next address does not wait for the attempt delay
+			start()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if resolved && len(running) == 0 && pending == 0 && len(h.addrs[0])+len(h.addrs[1]) == 0 {
+			break
+		}
+	}
+
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	if lookupErr != nil {
+		return nil, lookupErr
+	}
+	return nil, fmt.Errorf("resolver: domain %s does not exist", h.host)
+}
+
+func (h *happyEyeballs) lookup(ctx context.Context, network string) ([]net.IP, error) {
+	if hosts := h.node.Options().HostMapper; hosts != nil {
+		if ips, _ := hosts.Lookup(ctx, network, h.host); len(ips) > 0 {
+			log.Debug("resolve", fmt.Sprintf("hit host mapper: %s -> %s", h.host, ips))
+			return ips, nil
+		}
+	}
+	if r := h.node.Options().Resolver; r != nil {
+		ips, err := r.Resolve(ctx, network, h.host)
+		if !errors.Is(err, resolver.ErrInvalid) {
+			return ips, err
+		}
+	}
+	return net.DefaultResolver.LookupIP(ctx, network, h.host)
+}
+
+// add queues the addresses, the ones which failed recently go last.
+// It returns the number of the others.
+func (h *happyEyeballs) add(network string, ips []net.IP) int {
+	i := 0
+	if network != h.prefer {
+		i = 1
+	}
+	var failed []string
+	n := 0
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), h.port)
+		if failedAddrs.contains(addr) {
+			failed = append(failed, addr)
+		} else {
+			h.addrs[i] = append(h.addrs[i], addr)
+			n++
+		}
+	}
+	h.addrs[i] = append(h.addrs[i], failed...)
+	return n
+}
+
+// next returns the next address to try, alternating the families.
+// Recently failed addresses are only tried if no other is left.
+func (h *happyEyeballs) next() string {
+	order := []int{1 - h.last, h.last}
+	for _, skipFailed := range []bool{true, false} {
+		for _, i := range order {
+			for j, addr := range h.addrs[i] {
+				if skipFailed && failedAddrs.contains(addr) {
+					continue
+				}
+				h.addrs[i] = append(h.addrs[i][:j], h.addrs[i][j+1:]...)
+				h.last = i
+				return addr
+			}
+		}
+	}
+	return ""
+}
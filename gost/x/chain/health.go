@@ -0,0 +1,308 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/chain"
+	"proxy_forwarder/gost/core/connector"
+	"proxy_forwarder/gost/core/metrics"
+	xmetrics "proxy_forwarder/gost/x/metrics"
+	"proxy_forwarder/log"
+)
+
+const (
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 5 * time.Second
+	defaultHealthCheckFall     = 2
+	defaultHealthCheckRise     = 2
+)
+
+// states of a node
+const (
+	healthUnknown = iota
+	healthUp
+	healthDown
+)
+
+type healthCheckOptions struct {
+	name     string
+	interval time.Duration
+	timeout  time.Duration
+	jitter   time.Duration
+	target   string
+	status   []int
+	fall     int
+	rise     int
+	maxFails int
+}
+
+type HealthCheckOption func(*healthCheckOptions)
+
+// NameHealthCheckOption sets the name of the hop, used in the logs and metrics.
+func NameHealthCheckOption(name string) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.name = name
+	}
+}
+
+func IntervalHealthCheckOption(d time.Duration) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.interval = d
+	}
+}
+
+func TimeoutHealthCheckOption(d time.Duration) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.timeout = d
+	}
+}
+
+// JitterHealthCheckOption sets the maximum random delay added to the interval,
+// so the nodes are not all checked at the same time.
+func JitterHealthCheckOption(d time.Duration) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.jitter = d
+	}
+}
+
+// TargetHealthCheckOption sets the address the probes CONNECT to through the node.
+// Only the connection to the node is checked if it is empty.
+func TargetHealthCheckOption(target string) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.target = target
+	}
+}
+
+// StatusHealthCheckOption sets the accepted status codes of the CONNECT reply.
+func StatusHealthCheckOption(codes ...int) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.status = codes
+	}
+}
+
+// FallHealthCheckOption sets the number of consecutive failed probes marking the node as down.
+func FallHealthCheckOption(n int) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.fall = n
+	}
+}
+
+// RiseHealthCheckOption sets the number of consecutive successful probes bringing the node up.
+func RiseHealthCheckOption(n int) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.rise = n
+	}
+}
+
+// MaxFailsHealthCheckOption sets the fail count at which the node selector skips a node.
+func MaxFailsHealthCheckOption(n int) HealthCheckOption {
+	return func(o *healthCheckOptions) {
+		o.maxFails = n
+	}
+}
+
+// HealthChecker probes the nodes of a hop periodically. The results are recorded by the
+// markers of the nodes, so the node selector skips the nodes which are down before a
+// client connection fails, and uses recovered nodes again without waiting for the fail timeout.
+type HealthChecker struct {
+	options healthCheckOptions
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func NewHealthChecker(opts ...HealthCheckOption) *HealthChecker {
+	var options healthCheckOptions
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&options)
+		}
+	}
+	if options.interval <= 0 {
+		options.interval = defaultHealthCheckInterval
+	}
+	if options.timeout <= 0 {
+		options.timeout = defaultHealthCheckTimeout
+	}
+	if options.jitter <= 0 {
+		options.jitter = options.interval / 10
+	}
+	if len(options.status) == 0 {
+		options.status = []int{http.StatusOK}
+	}
+	if options.fall <= 0 {
+		options.fall = defaultHealthCheckFall
+	}
+	if options.rise <= 0 {
+		options.rise = defaultHealthCheckRise
+	}
+	if options.maxFails <= 0 {
+		options.maxFails = 1
+	}
+
+	return &HealthChecker{
+		options: options,
+	}
+}
+
+// Start checks the nodes until the checker is closed.
+func (hc *HealthChecker) Start(nodes []*chain.Node) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hc.cancel = cancel
+
+	for _, node := range nodes {
+		if node == nil {
+			continue
+		}
+		hc.wg.Add(1)
+		go hc.run(ctx, node)
+	}
+}
+
+func (hc *HealthChecker) Close() error {
+	if hc.cancel != nil {
+		hc.cancel()
+	}
+	hc.wg.Wait()
+	return nil
+}
+
+func (hc *HealthChecker) run(ctx context.Context, node *chain.Node) {
+	defer hc.wg.Done()
+
+	// the state is unknown and the gauge not set until fall or rise is reached
+	state := healthUnknown
+	var fails, oks int
+
+	// the first probes are spread over the jitter as well
+	timer := time.NewTimer(hc.jitter())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return
+		}
+
+		err := hc.probe(ctx, node)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			fails = 0
+			oks++
+			if oks >= hc.options.rise && state != healthUp {
+				if state == healthDown {
+					log.Info("chain", fmt.Sprintf("node %s (%s) of %s is up", node.Name, node.Addr, hc.options.name))
+					// the fails recorded while it was down are outdated
+					if marker := node.Marker(); marker != nil {
+						marker.Reset()
+					}
+				}
+				state = healthUp
+			}
+		} else {
+			oks = 0
+			fails++
+			log.Debug("chain", fmt.Sprintf("health check of node %s (%s) failed: %v", node.Name, node.Addr, err))
+			if fails >= hc.options.fall {
+				if state != healthDown {
+					log.Warn("chain", fmt.Sprintf("node %s (%s) of %s is down: %v", node.Name, node.Addr, hc.options.name, err))
+				}
+				state = healthDown
+				hc.markDown(node)
+			}
+		}
+		if state != healthUnknown {
+			hc.report(node, state == healthUp)
+		}
+
+		timer.Reset(hc.options.interval + hc.jitter())
+	}
+}
+
+// probe connects to the node and opens a connection to the target through it.
+func (hc *HealthChecker) probe(ctx context.Context, node *chain.Node) error {
+	ctx, cancel := context.WithTimeout(ctx, hc.options.timeout)
+	defer cancel()
+
+	conn, err := dialNode(ctx, node)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// not all dialers and connectors follow the context
+	conn.SetDeadline(time.Now().Add(hc.options.timeout))
+
+	cc, err := node.Options().Transport.Handshake(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+
+	if hc.options.target == "" {
+		// a stream of a multiplexed connection is only reserved, without network I/O
+		if p, ok := cc.(interface{ Ping(context.Context) error }); ok {
+			return p.Ping(ctx)
+		}
+		return nil
+	}
+
+	status := http.StatusOK
+	c, err := node.Options().Transport.Connect(ctx, cc, "tcp", hc.options.target)
+	if err == nil {
+		c.Close()
+	} else {
+		var pe *connector.ProxyError
+		if !errors.As(err, &pe) {
+			return err
+		}
+		status = pe.StatusCode
+	}
+	for _, code := range hc.options.status {
+		if code == status {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("unexpected status %d of CONNECT %s", status, hc.options.target)
+}
+
+// markDown records a failed probe, the node selector skips the node from maxFails on.
+func (hc *HealthChecker) markDown(node *chain.Node) {
+	marker := node.Marker()
+	if marker == nil {
+		return
+	}
+	// refreshes the fail time, the node stays skipped while it is down
+	marker.Mark()
+	for marker.Count() < int64(hc.options.maxFails) {
+		marker.Mark()
+	}
+}
+
+func (hc *HealthChecker) report(node *chain.Node, up bool) {
+	v := xmetrics.GetGauge(xmetrics.MetricNodeHealthyGauge,
+		metrics.Labels{"hop": hc.options.name, "node": node.Name})
+	if v == nil {
+		return
+	}
+	if up {
+		v.Set(1)
+	} else {
+		v.Set(0)
+	}
+}
+
+func (hc *HealthChecker) jitter() time.Duration {
+	return time.Duration(rand.Int63n(int64(hc.options.jitter) + 1))
+}
@@ -12,9 +12,10 @@ import (
 )
 
 type HopOptions struct {
-	bypass   bypass.Bypass
-	selector selector.Selector[*chain.Node]
-	logger   logger.Logger
+	bypass        bypass.Bypass
+	selector      selector.Selector[*chain.Node]
+	logger        logger.Logger
+	healthChecker *HealthChecker
 }
 
 type HopOption func(*HopOptions)
@@ -37,6 +38,13 @@ func LoggerHopOption(logger logger.Logger) HopOption {
 	}
 }
 
+// HealthCheckerHopOption checks the nodes of the hop actively, the checker is closed with the hop.
+func HealthCheckerHopOption(hc *HealthChecker) HopOption {
+	return func(opts *HopOptions) {
+		opts.healthChecker = hc
+	}
+}
+
 type chainHop struct {
 	nodes   []*chain.Node
 	options HopOptions
@@ -54,10 +62,21 @@ func NewChainHop(nodes []*chain.Node, opts ...HopOption) chain.Hop {
 		nodes:   nodes,
 		options: options,
 	}
+	if options.healthChecker != nil {
+		options.healthChecker.Start(nodes)
+	}
 
 	return hop
 }
 
+// Close stops the health checks of the nodes.
+func (p *chainHop) Close() error {
+	if p.options.healthChecker != nil {
+		return p.options.healthChecker.Close()
+	}
+	return nil
+}
+
 func (p *chainHop) Nodes() []*chain.Node {
 	return p.nodes
 }
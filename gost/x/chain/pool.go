@@ -0,0 +1,226 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/chain"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+)
+
+const (
+	defaultPoolMaxIdle     = 32
+	defaultPoolIdleTimeout = 90 * time.Second
+)
+
+type connPoolOptions struct {
+	maxIdle     int
+	idleTimeout time.Duration
+	maxConns    int
+}
+
+type ConnPoolOption func(*connPoolOptions)
+
+// MaxIdleConnPoolOption limits the idle connections kept for the node.
+func MaxIdleConnPoolOption(n int) ConnPoolOption {
+	return func(o *connPoolOptions) {
+		o.maxIdle = n
+	}
+}
+
+// IdleTimeoutConnPoolOption sets how long idle connections are kept.
+func IdleTimeoutConnPoolOption(d time.Duration) ConnPoolOption {
+	return func(o *connPoolOptions) {
+		o.idleTimeout = d
+	}
+}
+
+// MaxConnsConnPoolOption limits the open connections of the pool, idle or in use.
+// New requests wait for a free connection if the limit is reached.
+func MaxConnsConnPoolOption(n int) ConnPoolOption {
+	return func(o *connPoolOptions) {
+		o.maxConns = n
+	}
+}
+
+type connPool struct {
+	options connPoolOptions
+	mu      sync.Mutex
+	idle    map[string][]*pooledConn
+	nIdle   int
+	// slots of the open connections, nil if unlimited
+	sem chan struct{}
+}
+
+func NewConnPool(opts ...ConnPoolOption) chain.ConnPool {
+	var options connPoolOptions
+	for _, opt := range opts {
+		if opt != nil {
+			opt(&options)
+		}
+	}
+	if options.maxIdle <= 0 {
+		options.maxIdle = defaultPoolMaxIdle
+	}
+	if options.idleTimeout <= 0 {
+		options.idleTimeout = defaultPoolIdleTimeout
+	}
+
+	p := &connPool{
+		options: options,
+		idle:    make(map[string][]*pooledConn),
+	}
+	if options.maxConns > 0 {
+		p.sem = make(chan struct{}, options.maxConns)
+	}
+	return p
+}
+
+func (p *connPool) Get(ctx context.Context, key string, dial func(ctx context.Context) (net.Conn, error)) (net.Conn, error) {
+	for !xctx.IsFreshConn(ctx) {
+		c := p.popIdle(key)
+		if c == nil {
+			break
+		}
+		if c.alive() {
+			c.reused = true
+			return c, nil
+		}
+		c.Close()
+	}
+
+	if p.sem != nil {
+		select {
+		case p.sem <- struct{}{}:
+		default:
+			// an idle connection of another client gives way
+			if c := p.popIdle(""); c != nil {
+				c.Close()
+			}
+			select {
+			case p.sem <- struct{}{}:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	conn, err := dial(ctx)
+	if err != nil {
+		if p.sem != nil {
+			<-p.sem
+		}
+		return nil, err
+	}
+	return &pooledConn{
+		Conn: conn,
+		pool: p,
+		key:  key,
+	}, nil
+}
+
+// popIdle returns the most recently used idle connection of key, of any key if key is empty.
+func (p *connPool) popIdle(key string) *pooledConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key == "" {
+		for k := range p.idle {
+			key = k
+			break
+		}
+	}
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	c := conns[len(conns)-1]
+	p.remove(c)
+	c.timer.Stop()
+	return c
+}
+
+func (p *connPool) put(c *pooledConn) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.nIdle >= p.options.maxIdle {
+		return c.Close()
+	}
+	p.idle[c.key] = append(p.idle[c.key], c)
+	p.nIdle++
+	c.timer = time.AfterFunc(p.options.idleTimeout, func() {
+		p.mu.Lock()
+		ok := p.remove(c)
+		p.mu.Unlock()
+		if ok {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+// remove drops c from the idle connections, the lock must be held.
+func (p *connPool) remove(c *pooledConn) bool {
+	conns := p.idle[c.key]
+	for i := range conns {
+		if conns[i] != c {
+			continue
+		}
+		conns = append(conns[:i], conns[i+1:]...)
+		if len(conns) == 0 {
+			delete(p.idle, c.key)
+		} else {
+			p.idle[c.key] = conns
+		}
+		p.nIdle--
+		return true
+	}
+	return false
+}
+
+type pooledConn struct {
+	net.Conn
+	pool      *connPool
+	key       string
+	timer     *time.Timer
+	closeOnce sync.Once
+	// taken from the idle connections, the proxy may have closed it meanwhile
+	reused bool
+}
+
+// Release returns the connection to the pool, see xnet.Release.
+func (c *pooledConn) Release() error {
+	return c.pool.put(c)
+}
+
+// Reused reports whether the connection was idle in the pool, see xnet.Reused.
+func (c *pooledConn) Reused() bool {
+	return c.reused
+}
+
+func (c *pooledConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		if c.pool.sem != nil {
+			<-c.pool.sem
+		}
+	})
+	return
+}
+
+// alive reports whether the proxy kept the idle connection open, it must not have sent anything.
+// The proxy may still close it before the next request arrives, callers retry on a new connection.
+func (c *pooledConn) alive() bool {
+	// a deadline in the past fails without reading, the closed connection would not be noticed
+	c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	_, err := c.Conn.Read(b[:])
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
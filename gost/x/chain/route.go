@@ -3,6 +3,7 @@ package chain
 import (
 	"context"
 	"net"
+	"strings"
 	"time"
 
 	"proxy_forwarder/gost/core/chain"
@@ -10,6 +11,8 @@ import (
 	"proxy_forwarder/gost/core/logger"
 	"proxy_forwarder/gost/core/metrics"
 	"proxy_forwarder/gost/core/selector"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/identity"
 	xmetrics "proxy_forwarder/gost/x/metrics"
 )
 
@@ -58,12 +61,23 @@ func (r *route) Dial(ctx context.Context, network, address string, opts ...chain
 			opt(&options)
 		}
 	}
-	conn, err := r.connect(ctx, options.Logger)
+	node := r.getNode(len(r.Nodes()) - 1)
+
+	var conn net.Conn
+	var err error
+	if pool := node.Options().Pool; pool != nil && xctx.IsPlainHTTP(ctx) {
+		// the requests are sent over the connection to the proxy itself, it can be reused
+		conn, err = pool.Get(ctx, r.poolKey(ctx), func(ctx context.Context) (net.Conn, error) {
+			return r.connect(ctx, options.Logger)
+		})
+	} else {
+		conn, err = r.connect(ctx, options.Logger)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	cc, err := r.getNode(len(r.Nodes())-1).Options().Transport.Connect(ctx, conn, network, address)
+	cc, err := node.Options().Transport.Connect(ctx, conn, network, address)
 	if err != nil {
 		if conn != nil {
 			conn.Close()
@@ -73,6 +87,25 @@ func (r *route) Dial(ctx context.Context, network, address string, opts ...chain
 	return cc, nil
 }
 
+// poolKey separates the pooled connections of the clients, as the proxy may tie the
+// client address (PROXY protocol) or the credentials (NTLM) to a connection.
+func (r *route) poolKey(ctx context.Context) string {
+	var b strings.Builder
+	for _, node := range r.nodes {
+		b.WriteString(node.Addr)
+		b.WriteByte('>')
+	}
+	if src := xctx.SrcAddrFromContext(ctx); src != nil {
+		host, _, _ := net.SplitHostPort(src.String())
+		b.WriteString(host)
+	}
+	if id := identity.FromContext(ctx); id != nil {
+		b.WriteByte('|')
+		b.WriteString(id.Name)
+	}
+	return b.String()
+}
+
 func (r *route) Bind(ctx context.Context, network, address string, opts ...chain.BindOption) (net.Listener, error) {
 	if len(r.Nodes()) == 0 {
 		return chain.DefaultRoute.Bind(ctx, network, address, opts...)
@@ -137,17 +170,9 @@ func (r *route) connect(ctx context.Context, logger logger.Logger) (conn net.Con
 		}
 	}()
 
-	addr, err := chain.Resolve(ctx, network, node.Addr, node.Options().Resolver, node.Options().HostMapper)
 	marker := node.Marker()
-	if err != nil {
-		if marker != nil {
-			marker.Mark()
-		}
-		return
-	}
-
 	start := time.Now()
-	cc, err := node.Options().Transport.Dial(ctx, addr)
+	cc, err := dialNode(ctx, node)
 	if err != nil {
 		if marker != nil {
 			marker.Mark()
@@ -181,6 +206,7 @@ func (r *route) connect(ctx context.Context, logger logger.Logger) (conn net.Con
 	preNode := node
 	for _, node := range r.nodes[1:] {
 		marker := node.Marker()
+		var addr string
 		addr, err = chain.Resolve(ctx, network, node.Addr, node.Options().Resolver, node.Options().HostMapper)
 		if err != nil {
 			cn.Close()
@@ -103,12 +103,23 @@ type TLSConfig struct {
 	Secure     bool   `yaml:",omitempty" json:"secure,omitempty"`
 	ServerName string `yaml:"serverName,omitempty" json:"serverName,omitempty"`
 
+	Options *TLSOptions `yaml:",omitempty" json:"options,omitempty"`
+
 	// for auto-generated default certificate.
 	Validity     time.Duration `yaml:",omitempty" json:"validity,omitempty"`
 	CommonName   string        `yaml:"commonName,omitempty" json:"commonName,omitempty"`
 	Organization string        `yaml:",omitempty" json:"organization,omitempty"`
 }
 
+type TLSOptions struct {
+	// MinVersion is the minimum TLS version (1.0, 1.1, 1.2 or 1.3).
+	MinVersion string `yaml:"minVersion,omitempty" json:"minVersion,omitempty"`
+	// Pins are the base64 SHA-256 hashes of the SubjectPublicKeyInfo of accepted certificates.
+	Pins []string `yaml:",omitempty" json:"pins,omitempty"`
+	// SessionCache enables TLS session resumption.
+	SessionCache bool `yaml:"sessionCache,omitempty" json:"sessionCache,omitempty"`
+}
+
 type PluginConfig struct {
 	Addr  string     `json:"addr"`
 	TLS   *TLSConfig `yaml:",omitempty" json:"tls,omitempty"`
@@ -128,6 +139,33 @@ type AutherConfig struct {
 type AuthConfig struct {
 	Username string `json:"username"`
 	Password string `yaml:",omitempty" json:"password,omitempty"`
+	// Env is the environment variable holding 'user:password' or the password.
+	Env string `yaml:",omitempty" json:"env,omitempty"`
+	// Credential is the name of a systemd credential ($CREDENTIALS_DIRECTORY).
+	Credential string        `yaml:",omitempty" json:"credential,omitempty"`
+	File       *FileLoader   `yaml:",omitempty" json:"file,omitempty"`
+	Reload     time.Duration `yaml:",omitempty" json:"reload,omitempty"`
+}
+
+// MarshalJSON masks the password in config output.
+func (c AuthConfig) MarshalJSON() ([]byte, error) {
+	type authConfig AuthConfig
+	c.Password = maskSecret(c.Password)
+	return json.Marshal(authConfig(c))
+}
+
+// MarshalYAML masks the password in config output.
+func (c AuthConfig) MarshalYAML() (any, error) {
+	type authConfig AuthConfig
+	c.Password = maskSecret(c.Password)
+	return authConfig(c), nil
+}
+
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "******"
 }
 
 type SelectorConfig struct {
@@ -136,6 +174,21 @@ type SelectorConfig struct {
 	FailTimeout time.Duration `yaml:"failTimeout" json:"failTimeout"`
 }
 
+// HealthCheckConfig configures the active checks of the nodes of a hop.
+type HealthCheckConfig struct {
+	Interval time.Duration `json:"interval"`
+	Timeout  time.Duration `yaml:",omitempty" json:"timeout,omitempty"`
+	// random delay added to the interval
+	Jitter time.Duration `yaml:",omitempty" json:"jitter,omitempty"`
+	// CONNECT target of the probes, only the connection to the node is checked if empty
+	Target string `yaml:",omitempty" json:"target,omitempty"`
+	// accepted status codes of the CONNECT reply, 200 if empty
+	Status []int `yaml:",omitempty" json:"status,omitempty"`
+	// consecutive failed probes marking the node as down and successful ones bringing it up
+	Fall int `yaml:",omitempty" json:"fall,omitempty"`
+	Rise int `yaml:",omitempty" json:"rise,omitempty"`
+}
+
 type AdmissionConfig struct {
 	Name string `json:"name"`
 	// DEPRECATED by whitelist since beta.4
@@ -174,6 +227,20 @@ type RedisLoader struct {
 	Type     string `yaml:",omitempty" json:"type,omitempty"`
 }
 
+// MarshalJSON masks the password in config output.
+func (c RedisLoader) MarshalJSON() ([]byte, error) {
+	type redisLoader RedisLoader
+	c.Password = maskSecret(c.Password)
+	return json.Marshal(redisLoader(c))
+}
+
+// MarshalYAML masks the password in config output.
+func (c RedisLoader) MarshalYAML() (any, error) {
+	type redisLoader RedisLoader
+	c.Password = maskSecret(c.Password)
+	return redisLoader(c), nil
+}
+
 type HTTPLoader struct {
 	URL     string        `yaml:"url" json:"url"`
 	Timeout time.Duration `yaml:",omitempty" json:"timeout,omitempty"`
@@ -369,15 +436,16 @@ type ChainGroupConfig struct {
 }
 
 type HopConfig struct {
-	Name      string          `json:"name"`
-	Interface string          `yaml:",omitempty" json:"interface,omitempty"`
-	SockOpts  *SockOptsConfig `yaml:"sockopts,omitempty" json:"sockopts,omitempty"`
-	Selector  *SelectorConfig `yaml:",omitempty" json:"selector,omitempty"`
-	Bypass    string          `yaml:",omitempty" json:"bypass,omitempty"`
-	Bypasses  []string        `yaml:",omitempty" json:"bypasses,omitempty"`
-	Resolver  string          `yaml:",omitempty" json:"resolver,omitempty"`
-	Hosts     string          `yaml:",omitempty" json:"hosts,omitempty"`
-	Nodes     []*NodeConfig   `yaml:",omitempty" json:"nodes,omitempty"`
+	Name        string             `json:"name"`
+	Interface   string             `yaml:",omitempty" json:"interface,omitempty"`
+	SockOpts    *SockOptsConfig    `yaml:"sockopts,omitempty" json:"sockopts,omitempty"`
+	Selector    *SelectorConfig    `yaml:",omitempty" json:"selector,omitempty"`
+	HealthCheck *HealthCheckConfig `yaml:"healthCheck,omitempty" json:"healthCheck,omitempty"`
+	Bypass      string             `yaml:",omitempty" json:"bypass,omitempty"`
+	Bypasses    []string           `yaml:",omitempty" json:"bypasses,omitempty"`
+	Resolver    string             `yaml:",omitempty" json:"resolver,omitempty"`
+	Hosts       string             `yaml:",omitempty" json:"hosts,omitempty"`
+	Nodes       []*NodeConfig      `yaml:",omitempty" json:"nodes,omitempty"`
 }
 
 type NodeConfig struct {
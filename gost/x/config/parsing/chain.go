@@ -19,6 +19,7 @@ import (
 	tls_util "proxy_forwarder/gost/x/internal/util/tls"
 	mdx "proxy_forwarder/gost/x/metadata"
 	"proxy_forwarder/gost/x/registry"
+	xs "proxy_forwarder/gost/x/selector"
 	"proxy_forwarder/log"
 )
 
@@ -101,6 +102,9 @@ func ParseHop(cfg *config.HopConfig) (chain.Hop, error) {
 		tlsConfig, err := tls_util.LoadClientConfig(
 			tlsCfg.CertFile, tlsCfg.KeyFile, tlsCfg.CAFile,
 			tlsCfg.Secure, tlsCfg.ServerName)
+		if err == nil {
+			err = tls_util.SetTLSOptions(tlsConfig, tlsCfg.Options)
+		}
 		if err != nil {
 			log.Error("chain", err)
 			return nil, err
@@ -115,6 +119,7 @@ func ParseHop(cfg *config.HopConfig) (chain.Hop, error) {
 		if rf := registry.ConnectorRegistry().Get(v.Connector.Type); rf != nil {
 			cr = rf(
 				connector.AuthOption(parseAuth(v.Connector.Auth)),
+				connector.CredentialsOption(parseCredentials(v.Connector.Auth)),
 				connector.TLSConfigOption(tlsConfig))
 		} else {
 			return nil, fmt.Errorf("unregistered connector: %s", v.Connector.Type)
@@ -138,15 +143,24 @@ func ParseHop(cfg *config.HopConfig) (chain.Hop, error) {
 		tlsConfig, err = tls_util.LoadClientConfig(
 			tlsCfg.CertFile, tlsCfg.KeyFile, tlsCfg.CAFile,
 			tlsCfg.Secure, tlsCfg.ServerName)
+		if err == nil {
+			err = tls_util.SetTLSOptions(tlsConfig, tlsCfg.Options)
+		}
 		if err != nil {
 			hopLogger.Error(err)
 			return nil, err
 		}
 
+		// the command line passes the options of a node to its dialer
+		dmd := mdx.NewMetadata(v.Dialer.Metadata)
+
 		var ppv int
 		if nm != nil {
 			ppv = mdutil.GetInt(nm, mdKeyProxyProtocol)
 		}
+		if ppv <= 0 {
+			ppv = mdutil.GetInt(dmd, mdKeyProxyProtocol)
+		}
 
 		var d dialer.Dialer
 		if rf := registry.DialerRegistry().Get(v.Dialer.Type); rf != nil {
@@ -213,6 +227,26 @@ func ParseHop(cfg *config.HopConfig) (chain.Hop, error) {
 			chain.HostNodeOption(host),
 			chain.ProtocolNodeOption(v.Protocol),
 		}
+		// multiplexed connections are shared by the streams, they are not pooled
+		if mux, ok := d.(dialer.Multiplexer); v.Connector.Type == "http" && !(ok && mux.Multiplex()) {
+			pmd := dmd
+			if nm != nil {
+				pmd = nm
+			}
+			if pool := parsePool(pmd); pool != nil {
+				opts = append(opts, chain.PoolNodeOption(pool))
+			}
+		}
+		hmd := dmd
+		if nm != nil {
+			hmd = nm
+		}
+		he, err := parseHappyEyeballs(hmd)
+		if err != nil {
+			hopLogger.Error(err)
+			return nil, err
+		}
+		opts = append(opts, chain.HappyEyeballsNodeOption(he))
 		if v.HTTP != nil {
 			opts = append(opts, chain.HTTPNodeOption(&chain.HTTPNodeSettings{
 				Host:   v.HTTP.Host,
@@ -246,9 +280,65 @@ func ParseHop(cfg *config.HopConfig) (chain.Hop, error) {
 	if sel == nil {
 		sel = defaultNodeSelector()
 	}
+	var hc *xchain.HealthChecker
+	if cfg.HealthCheck != nil {
+		maxFails := xs.DefaultMaxFails
+		if cfg.Selector != nil && cfg.Selector.MaxFails > 0 {
+			maxFails = cfg.Selector.MaxFails
+		}
+		hc = xchain.NewHealthChecker(
+			xchain.NameHealthCheckOption(cfg.Name),
+			xchain.IntervalHealthCheckOption(cfg.HealthCheck.Interval),
+			xchain.TimeoutHealthCheckOption(cfg.HealthCheck.Timeout),
+			xchain.JitterHealthCheckOption(cfg.HealthCheck.Jitter),
+			xchain.TargetHealthCheckOption(cfg.HealthCheck.Target),
+			xchain.StatusHealthCheckOption(cfg.HealthCheck.Status...),
+			xchain.FallHealthCheckOption(cfg.HealthCheck.Fall),
+			xchain.RiseHealthCheckOption(cfg.HealthCheck.Rise),
+			xchain.MaxFailsHealthCheckOption(maxFails),
+		)
+	}
+
 	return xchain.NewChainHop(nodes,
 		xchain.SelectorHopOption(sel),
 		xchain.BypassHopOption(bypass.BypassGroup(bypassList(cfg.Bypass, cfg.Bypasses...)...)),
 		xchain.LoggerHopOption(hopLogger),
+		xchain.HealthCheckerHopOption(hc),
 	), nil
 }
+
+// parsePool creates the pool of the connections for plain HTTP requests to an HTTP proxy,
+// it is disabled by pool=false.
+func parsePool(md metadata.Metadata) chain.ConnPool {
+	if md.IsExists(mdKeyPool) && !mdutil.GetBool(md, mdKeyPool) {
+		return nil
+	}
+	return xchain.NewConnPool(
+		xchain.MaxIdleConnPoolOption(mdutil.GetInt(md, mdKeyPoolMaxIdle)),
+		xchain.IdleTimeoutConnPoolOption(mdutil.GetDuration(md, mdKeyPoolIdleTimeout)),
+		xchain.MaxConnsConnPoolOption(mdutil.GetInt(md, mdKeyPoolMaxConns)),
+	)
+}
+
+// parseHappyEyeballs configures dialing all addresses of the node hostname,
+// it is disabled by happyEyeballs=false.
+func parseHappyEyeballs(md metadata.Metadata) (*chain.HappyEyeballsNodeSettings, error) {
+	if md.IsExists(mdKeyHappyEyeballs) && !mdutil.GetBool(md, mdKeyHappyEyeballs) {
+		return nil, nil
+	}
+
+	settings := &chain.HappyEyeballsNodeSettings{
+		ResolutionDelay: mdutil.GetDuration(md, mdKeyHappyEyeballsResolutionDelay),
+		AttemptDelay:    mdutil.GetDuration(md, mdKeyHappyEyeballsAttemptDelay),
+		FailTimeout:     mdutil.GetDuration(md, mdKeyHappyEyeballsFailTimeout),
+	}
+	switch prefer := strings.ToLower(mdutil.GetString(md, mdKeyHappyEyeballsPrefer)); prefer {
+	case "", "ipv6", "ip6", "6":
+		settings.Prefer = "ip6"
+	case "ipv4", "ip4", "4":
+		settings.Prefer = "ip4"
+	default:
+		return nil, fmt.Errorf("invalid %s: %s (expected ipv6 or ipv4)", mdKeyHappyEyeballsPrefer, prefer)
+	}
+	return settings, nil
+}
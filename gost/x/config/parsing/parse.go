@@ -5,6 +5,8 @@ import (
 	"crypto/tls"
 	"net"
 	"net/url"
+	"os"
+	"path/filepath"
 
 	"proxy_forwarder/gost/core/admission"
 	"proxy_forwarder/gost/core/auth"
@@ -48,6 +50,17 @@ const (
 	mdKeyPostUp        = "postUp"
 	mdKeyPostDown      = "postDown"
 	mdKeyIgnoreChain   = "ignoreChain"
+
+	mdKeyPool            = "pool"
+	mdKeyPoolMaxIdle     = "pool.maxIdle"
+	mdKeyPoolIdleTimeout = "pool.idleTimeout"
+	mdKeyPoolMaxConns    = "pool.maxConns"
+
+	mdKeyHappyEyeballs                = "happyEyeballs"
+	mdKeyHappyEyeballsPrefer          = "happyEyeballs.prefer"
+	mdKeyHappyEyeballsResolutionDelay = "happyEyeballs.resolutionDelay"
+	mdKeyHappyEyeballsAttemptDelay    = "happyEyeballs.attemptDelay"
+	mdKeyHappyEyeballsFailTimeout     = "happyEyeballs.failTimeout"
 )
 
 func ParseAuther(cfg *config.AutherConfig) auth.Authenticator {
@@ -125,6 +138,35 @@ func parseAuth(cfg *config.AuthConfig) *url.Userinfo {
 	return url.UserPassword(cfg.Username, cfg.Password)
 }
 
+// parseCredentials returns the credentials for an upstream server if they are loaded
+// from the environment or a file, nil for static credentials.
+func parseCredentials(cfg *config.AuthConfig) auth.Credentials {
+	if cfg == nil || (cfg.Env == "" && cfg.Credential == "" && cfg.File == nil) {
+		return nil
+	}
+
+	opts := []auth_impl.Option{
+		auth_impl.UserinfoOption(parseAuth(cfg)),
+		auth_impl.EnvOption(cfg.Env),
+		auth_impl.ReloadPeriodOption(cfg.Reload),
+		auth_impl.LoggerOption(logger.Default().WithFields(map[string]any{
+			"kind": "credentials",
+		})),
+	}
+
+	path := ""
+	if cfg.File != nil {
+		path = cfg.File.Path
+	}
+	if cfg.Credential != "" {
+		path = filepath.Join(os.Getenv("CREDENTIALS_DIRECTORY"), cfg.Credential)
+	}
+	if path != "" {
+		opts = append(opts, auth_impl.FileLoaderOption(loader.FileLoader(path)))
+	}
+	return auth_impl.NewCredentials(opts...)
+}
+
 func parseChainSelector(cfg *config.SelectorConfig) selector.Selector[chain.Chainer] {
 	if cfg == nil {
 		return nil
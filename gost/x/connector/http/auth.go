@@ -0,0 +1,456 @@
+package http
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"proxy_forwarder/gost/core/connector"
+	xnet "proxy_forwarder/gost/x/internal/net"
+	"proxy_forwarder/log"
+	"proxy_forwarder/meta"
+)
+
+const (
+	authSchemeBasic  = "basic"
+	authSchemeDigest = "digest"
+	authSchemeNTLM   = "ntlm"
+)
+
+// challenge is a parsed Proxy-Authenticate header.
+type challenge struct {
+	scheme string
+	token  string // NTLM message
+	params map[string]string
+}
+
+// parseChallenges parses the Proxy-Authenticate headers, one challenge per header.
+func parseChallenges(values []string) []*challenge {
+	var challenges []*challenge
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		scheme, rest, _ := strings.Cut(v, " ")
+		ch := &challenge{
+			scheme: strings.ToLower(scheme),
+			params: map[string]string{},
+		}
+		rest = strings.TrimSpace(rest)
+		if ch.scheme == authSchemeNTLM {
+			ch.token = rest
+		} else {
+			ch.params = parseAuthParams(rest)
+		}
+		challenges = append(challenges, ch)
+	}
+	return challenges
+}
+
+// parseAuthParams parses a comma-separated list of key=value pairs, values may be quoted.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " \t,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " \t")
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			value = b.String()
+			if i < len(rest) {
+				i++
+			}
+			rest = rest[i:]
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+		s = rest
+	}
+	return params
+}
+
+// digestAlgorithms lists the supported algorithms of RFC 7616, strongest first.
+var digestAlgorithms = []string{"SHA-512-256", "SHA-256", "MD5"}
+
+func digestHash(algorithm string) func() hash.Hash {
+	switch strings.TrimSuffix(strings.ToUpper(algorithm), "-SESS") {
+	case "", "MD5":
+		return md5.New
+	case "SHA-256":
+		return sha256.New
+	case "SHA-512-256":
+		return sha512.New512_256
+	}
+	return nil
+}
+
+// strength ranks the supported challenges, 0 if unsupported.
+// Digest is preferred over NTLM, Basic is the last resort.
+func (ch *challenge) strength() int {
+	switch ch.scheme {
+	case authSchemeBasic:
+		return 1
+	case authSchemeNTLM:
+		return 2
+	case authSchemeDigest:
+		if digestHash(ch.params["algorithm"]) == nil {
+			return 0
+		}
+		if qop := ch.params["qop"]; qop != "" && !hasToken(qop, "auth") {
+			return 0
+		}
+		alg := strings.TrimSuffix(strings.ToUpper(ch.params["algorithm"]), "-SESS")
+		for i, a := range digestAlgorithms {
+			if a == alg || (alg == "" && a == "MD5") {
+				return 3 + len(digestAlgorithms) - i
+			}
+		}
+	}
+	return 0
+}
+
+func hasToken(list, token string) bool {
+	for _, t := range strings.Split(list, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// streamChallenges returns the challenges that can be answered on an HTTP/2 stream,
+// NTLM authenticates a connection, which is shared by the streams.
+func streamChallenges(challenges []*challenge) []*challenge {
+	var v []*challenge
+	for _, ch := range challenges {
+		if ch.scheme != authSchemeNTLM {
+			v = append(v, ch)
+		}
+	}
+	return v
+}
+
+func strongestChallenge(challenges []*challenge) *challenge {
+	var best *challenge
+	for _, ch := range challenges {
+		if s := ch.strength(); s > 0 && (best == nil || s > best.strength()) {
+			best = ch
+		}
+	}
+	return best
+}
+
+// proxyAuth keeps the authentication state toward the proxy across connections.
+type proxyAuth struct {
+	userinfo func() *url.Userinfo
+
+	mu     sync.Mutex
+	scheme string // scheme the proxy asked for last
+	digest *challenge
+	nc     uint32
+}
+
+func newProxyAuth(userinfo func() *url.Userinfo) *proxyAuth {
+	return &proxyAuth{
+		userinfo: userinfo,
+	}
+}
+
+// credentials returns the current credentials, they are looked up for each request as they may be rotated.
+func (a *proxyAuth) credentials() (username, password string, ok bool) {
+	u := a.userinfo()
+	if u == nil {
+		return "", "", false
+	}
+	password, _ = u.Password()
+	return u.Username(), password, true
+}
+
+// preemptive returns the Authorization for the first request of a connection.
+// The Digest nonce of the last challenge is reused until the proxy marks it stale.
+func (a *proxyAuth) preemptive(method, uri string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, _, ok := a.credentials(); !ok {
+		return ""
+	}
+
+	switch a.scheme {
+	case authSchemeDigest:
+		return a.digestAuthorization(method, uri)
+	case authSchemeNTLM:
+		return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate())
+	}
+	return a.basicAuthorization()
+}
+
+func (a *proxyAuth) basicAuthorization() string {
+	username, password, _ := a.credentials()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// digestAuthorization answers the cached challenge (RFC 7616), the caller holds the lock.
+func (a *proxyAuth) digestAuthorization(method, uri string) string {
+	ch := a.digest
+	if ch == nil {
+		return ""
+	}
+	h := digestHasher(ch.params["algorithm"])
+
+	username, password, _ := a.credentials()
+	realm, nonce := ch.params["realm"], ch.params["nonce"]
+	cnonce := newCnonce()
+	a.nc++
+	nc := fmt.Sprintf("%08x", a.nc)
+	response := digestResponse(ch, username, password, method, uri, nc, cnonce)
+
+	userhash := strings.EqualFold(ch.params["userhash"], "true")
+	if userhash {
+		username = h(username + ":" + realm)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q`,
+		username, realm, nonce, uri, response)
+	if alg := ch.params["algorithm"]; alg != "" {
+		fmt.Fprintf(&b, ", algorithm=%s", alg)
+	}
+	if opaque, ok := ch.params["opaque"]; ok {
+		fmt.Fprintf(&b, ", opaque=%q", opaque)
+	}
+	if ch.params["qop"] != "" {
+		fmt.Fprintf(&b, `, qop=auth, nc=%s, cnonce=%q`, nc, cnonce)
+	}
+	if userhash {
+		b.WriteString(", userhash=true")
+	}
+	return b.String()
+}
+
+// digestResponse computes the response value of RFC 7616 section 3.4.1, with qop=auth
+// if the challenge offers a qop.
+func digestResponse(ch *challenge, username, password, method, uri, nc, cnonce string) string {
+	h := digestHasher(ch.params["algorithm"])
+	realm, nonce := ch.params["realm"], ch.params["nonce"]
+
+	ha1 := h(username + ":" + realm + ":" + password)
+	if strings.HasSuffix(strings.ToUpper(ch.params["algorithm"]), "-SESS") {
+		ha1 = h(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := h(method + ":" + uri)
+
+	if ch.params["qop"] != "" {
+		return h(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+	}
+	return h(ha1 + ":" + nonce + ":" + ha2)
+}
+
+// digestHasher returns the hex encoded hash function of a supported algorithm.
+func digestHasher(algorithm string) func(string) string {
+	newHash := digestHash(algorithm)
+	return func(s string) string {
+		hh := newHash()
+		io.WriteString(hh, s)
+		return hex.EncodeToString(hh.Sum(nil))
+	}
+}
+
+func newCnonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// answer returns the Authorization for a 407 response, errAuthRejected if the proxy refused the last answer.
+func (a *proxyAuth) answer(ch *challenge, method, uri string, sent string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	username, password, ok := a.credentials()
+	if !ok {
+		return "", errAuthRejected
+	}
+
+	a.scheme = ch.scheme
+
+	switch ch.scheme {
+	case authSchemeDigest:
+		stale := strings.EqualFold(ch.params["stale"], "true")
+		if strings.HasPrefix(sent, "Digest ") && !stale && a.digest != nil &&
+			a.digest.params["nonce"] == ch.params["nonce"] {
+			return "", errAuthRejected
+		}
+		a.digest = ch
+		a.nc = 0
+		return a.digestAuthorization(method, uri), nil
+
+	case authSchemeNTLM:
+		if ch.token == "" {
+			if strings.HasPrefix(sent, "NTLM ") {
+				return "", errAuthRejected
+			}
+			return "NTLM " + base64.StdEncoding.EncodeToString(ntlmNegotiate()), nil
+		}
+		msg, err := base64.StdEncoding.DecodeString(ch.token)
+		if err != nil {
+			return "", err
+		}
+		auth, err := ntlmAuthenticate(msg, username, password)
+		if err != nil {
+			return "", err
+		}
+		return "NTLM " + base64.StdEncoding.EncodeToString(auth), nil
+
+	case authSchemeBasic:
+		if strings.HasPrefix(sent, "Basic ") {
+			return "", errAuthRejected
+		}
+		return a.basicAuthorization(), nil
+	}
+	return "", errAuthRejected
+}
+
+var errAuthRejected = errors.New("credentials rejected by the proxy")
+
+// roundTrip sends req and answers the authentication challenges of the proxy on the same connection.
+// The returned response is the last one, its body is not read. auth may be nil.
+func (c *httpConnector) roundTrip(conn net.Conn, br *bufio.Reader, req *http.Request, auth *proxyAuth, logSrc, logDst string) (*http.Response, error) {
+	uri := req.URL.RequestURI()
+	if req.Method == http.MethodConnect {
+		uri = req.Host
+	}
+
+	var sent string
+	if auth != nil {
+		sent = auth.preemptive(req.Method, uri)
+	}
+
+	send := func(round int, authorization string) (*http.Response, error) {
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+
+		if meta.DEBUG {
+			dump, _ := httputil.DumpRequest(maskCredentials(req), false)
+			log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("Request: %s", string(dump)))
+		}
+
+		if err := req.Write(conn); err != nil {
+			return nil, err
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.DEBUG {
+			dump, _ := httputil.DumpResponse(resp, false)
+			log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("Response: %s", string(dump)))
+		}
+		return resp, nil
+	}
+	// the answer of a Digest challenge is also cached for the next connections
+	return xnet.AuthRoundTrip(sent, send, c.answerer(auth, req.Method, uri, nil, logSrc, logDst))
+}
+
+// answerer returns the function answering the challenges of the proxy to a request,
+// it answers none if auth is nil. filter selects the challenges that can be answered.
+func (c *httpConnector) answerer(auth *proxyAuth, method, uri string, filter func([]*challenge) []*challenge, logSrc, logDst string) func(resp *http.Response, sent string) string {
+	return func(resp *http.Response, sent string) string {
+		if auth == nil {
+			return ""
+		}
+		challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+		if filter != nil {
+			challenges = filter(challenges)
+		}
+		ch := strongestChallenge(challenges)
+		if ch == nil {
+			return ""
+		}
+		answer, err := auth.answer(ch, method, uri, sent)
+		if err != nil {
+			log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("%s authentication failed: %v", ch.scheme, err))
+			return ""
+		}
+		log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("answering %s challenge of the proxy", ch.scheme))
+		return answer
+	}
+}
+
+// plainAuth answers the challenges of the proxy to plain HTTP requests,
+// which are sent by the handler over the proxy connection.
+type plainAuth struct {
+	auth *proxyAuth
+	// the requests are streams of a shared HTTP/2 connection
+	stream bool
+}
+
+func (a *plainAuth) Authorization(method, uri string) string {
+	return a.auth.preemptive(method, uri)
+}
+
+func (a *plainAuth) Answer(resp *http.Response, method, uri, sent string) string {
+	challenges := parseChallenges(resp.Header.Values("Proxy-Authenticate"))
+	if a.stream {
+		challenges = streamChallenges(challenges)
+	}
+	ch := strongestChallenge(challenges)
+	if ch == nil {
+		return ""
+	}
+	answer, err := a.auth.answer(ch, method, uri, sent)
+	if err != nil {
+		return ""
+	}
+	return answer
+}
+
+// maskCredentials returns a copy of req for logging, without the credentials.
+func maskCredentials(req *http.Request) *http.Request {
+	auth := req.Header.Get("Proxy-Authorization")
+	if auth == "" {
+		return req
+	}
+	r := *req
+	r.Header = req.Header.Clone()
+	scheme, _, _ := strings.Cut(auth, " ")
+	r.Header.Set("Proxy-Authorization", scheme+" ******")
+	return &r
+}
+
+// proxyError converts a failed response.
+func proxyError(resp *http.Response) error {
+	return &connector.ProxyError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+	}
+}
@@ -0,0 +1,336 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"proxy_forwarder/gost/core/connector"
+	xnet "proxy_forwarder/gost/x/internal/net"
+	xmd "proxy_forwarder/gost/x/metadata"
+)
+
+func TestParseAuthParams(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{``, map[string]string{}},
+		{`realm="proxy"`, map[string]string{"realm": "proxy"}},
+		{`Realm="a, b", NONCE=abc`, map[string]string{"realm": "a, b", "nonce": "abc"}},
+		{`realm="say \"hi\"",qop="auth,auth-int" , stale=true`,
+			map[string]string{"realm": `say "hi"`, "qop": "auth,auth-int", "stale": "true"}},
+		{`algorithm=SHA-256, opaque=""`, map[string]string{"algorithm": "SHA-256", "opaque": ""}},
+		{`realm="unterminated`, map[string]string{"realm": "unterminated"}},
+		{`token68==`, map[string]string{"token68": "="}},
+	}
+	for _, tt := range tests {
+		if got := parseAuthParams(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAuthParams(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestDigestResponse checks the examples of RFC 7616 section 3.9.1.
+func TestDigestResponse(t *testing.T) {
+	params := parseAuthParams(`realm="http-auth@example.org", qop="auth, auth-int", ` +
+		`nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", ` +
+		`opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`)
+	const cnonce = "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+
+	tests := []struct {
+		algorithm string
+		want      string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	}
+	for _, tt := range tests {
+		ch := &challenge{scheme: authSchemeDigest, params: map[string]string{"algorithm": tt.algorithm}}
+		for k, v := range params {
+			ch.params[k] = v
+		}
+		got := digestResponse(ch, "Mufasa", "Circle of Life", http.MethodGet, "/dir/index.html", "00000001", cnonce)
+		if got != tt.want {
+			t.Errorf("%s: response %s, want %s", tt.algorithm, got, tt.want)
+		}
+	}
+}
+
+// ntlmChallengeMessage returns a CHALLENGE_MESSAGE with the target info of MS-NLMP section 4.2.4.
+func ntlmChallengeMessage(serverChallenge []byte) []byte {
+	targetInfo := []byte{}
+	for _, av := range []struct {
+		id    uint16
+		value string
+	}{{2, "Domain"}, {1, "Server"}} {
+		v := utf16le(av.value)
+		targetInfo = binary.LittleEndian.AppendUint16(targetInfo, av.id)
+		targetInfo = binary.LittleEndian.AppendUint16(targetInfo, uint16(len(v)))
+		targetInfo = append(targetInfo, v...)
+	}
+	targetInfo = append(targetInfo, 0, 0, 0, 0)
+
+	b := make([]byte, 48)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 2)
+	binary.LittleEndian.PutUint32(b[20:], ntlmNegotiateUnicode|ntlmNegotiateNTLM|ntlmNegotiateTargetInfo)
+	copy(b[24:], serverChallenge)
+	binary.LittleEndian.PutUint16(b[40:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint16(b[42:], uint16(len(targetInfo)))
+	binary.LittleEndian.PutUint32(b[44:], 48)
+	return append(b, targetInfo...)
+}
+
+// ntlmField returns a field of an AUTHENTICATE_MESSAGE by its index.
+func ntlmField(msg []byte, i int) []byte {
+	pos := 12 + i*8
+	l := int(binary.LittleEndian.Uint16(msg[pos:]))
+	off := int(binary.LittleEndian.Uint32(msg[pos+4:]))
+	return msg[off : off+l]
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// TestNTLMAuthenticate checks the NTLMv2 values of MS-NLMP section 4.2.4 and verifies
+// the AUTHENTICATE_MESSAGE the way a proxy does.
+func TestNTLMAuthenticate(t *testing.T) {
+	serverChallenge := mustHex("0123456789abcdef")
+	key := mustHex("0c868a403bfd7a93a3001ef22ef02e3f")
+
+	if got := ntowfv2("User", "Password", "Domain"); !bytes.Equal(got, key) {
+		t.Fatalf("NTOWFv2 %x, want %x", got, key)
+	}
+
+	// NTProofStr of the example, with a zero timestamp and the client challenge 0xaa...
+	challengeMsg := ntlmChallengeMessage(serverChallenge)
+	temp := append(mustHex("0101000000000000 0000000000000000 aaaaaaaaaaaaaaaa 00000000"), challengeMsg[48:]...)
+	temp = append(temp, 0, 0, 0, 0)
+	if got, want := hmacMD5(key, serverChallenge, temp), mustHex("68cd0ab851e51c96aabc927bebef6a1c"); !bytes.Equal(got, want) {
+		t.Fatalf("NTProofStr %x, want %x", got, want)
+	}
+
+	msg, err := ntlmAuthenticate(challengeMsg, `Domain\User`, "Password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg[:8], ntlmSignature) || binary.LittleEndian.Uint32(msg[8:]) != 3 {
+		t.Fatalf("not an AUTHENTICATE_MESSAGE: %x", msg[:12])
+	}
+	if got := ntlmField(msg, 2); !bytes.Equal(got, utf16le("Domain")) {
+		t.Errorf("domain %x, want %x", got, utf16le("Domain"))
+	}
+	if got := ntlmField(msg, 3); !bytes.Equal(got, utf16le("User")) {
+		t.Errorf("user %x, want %x", got, utf16le("User"))
+	}
+
+	nt := ntlmField(msg, 1)
+	proof, blob := nt[:16], nt[16:]
+	if !bytes.Equal(proof, hmacMD5(key, serverChallenge, blob)) {
+		t.Errorf("NTProofStr does not match the client challenge")
+	}
+	if !bytes.Equal(blob[:8], []byte{1, 1, 0, 0, 0, 0, 0, 0}) || !bytes.Contains(blob, challengeMsg[48:]) {
+		t.Errorf("invalid NTLMv2 client challenge %x", blob)
+	}
+	clientChallenge := blob[16:24]
+	lm := ntlmField(msg, 0)
+	if want := append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...); !bytes.Equal(lm, want) {
+		t.Errorf("LMv2 response %x, want %x", lm, want)
+	}
+}
+
+// testProxy is an HTTP proxy that asks for credentials. challenge returns the
+// Proxy-Authenticate header for a request of the connection, empty if it is accepted.
+func testProxy(t *testing.T, challenge func(req *http.Request, conn map[string]string) string) net.Addr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				state := map[string]string{}
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					resp := &http.Response{
+						StatusCode: http.StatusOK,
+						ProtoMajor: 1,
+						ProtoMinor: 1,
+						Header:     http.Header{},
+					}
+					if v := challenge(req, state); v != "" {
+						resp.StatusCode = http.StatusProxyAuthRequired
+						resp.Header.Set("Proxy-Authenticate", v)
+						resp.Body = http.NoBody
+					}
+					if err := resp.Write(conn); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return ln.Addr()
+}
+
+func digestChallenge(username, password string) func(req *http.Request, conn map[string]string) string {
+	const header = `Digest realm="proxy", nonce="n0nce", qop="auth", algorithm=SHA-256`
+	ch := &challenge{scheme: authSchemeDigest, params: parseAuthParams(strings.TrimPrefix(header, "Digest "))}
+
+	return func(req *http.Request, conn map[string]string) string {
+		v := req.Header.Get("Proxy-Authorization")
+		if !strings.HasPrefix(v, "Digest ") {
+			return header
+		}
+		p := parseAuthParams(strings.TrimPrefix(v, "Digest "))
+		uri := req.RequestURI
+		if p["username"] != username || p["uri"] != uri ||
+			p["response"] != digestResponse(ch, username, password, req.Method, uri, p["nc"], p["cnonce"]) {
+			return header
+		}
+		return ""
+	}
+}
+
+func newTestConnector(t *testing.T, user *url.Userinfo) *httpConnector {
+	c := NewConnector(connector.AuthOption(user)).(*httpConnector)
+	if err := c.Init(xmd.NewMetadata(nil)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestConnectDigest(t *testing.T) {
+	addr := testProxy(t, digestChallenge("user", "secret"))
+	c := newTestConnector(t, url.UserPassword("user", "secret"))
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Connect(context.Background(), conn, "tcp", "example.com:443"); err != nil {
+			t.Fatalf("connect %d: %v", i, err)
+		}
+		conn.Close()
+	}
+	// the nonce of the first challenge is reused preemptively by the second connection
+	if c.auth.scheme != authSchemeDigest || c.auth.nc != 2 {
+		t.Errorf("Digest state scheme=%s nc=%d, want the cached challenge", c.auth.scheme, c.auth.nc)
+	}
+}
+
+func TestConnectNTLM(t *testing.T) {
+	serverChallenge := mustHex("0123456789abcdef")
+	key := ntowfv2("user", "secret", "DOMAIN")
+
+	addr := testProxy(t, func(req *http.Request, conn map[string]string) string {
+		v := req.Header.Get("Proxy-Authorization")
+		msg, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, "NTLM "))
+		switch {
+		case !strings.HasPrefix(v, "NTLM ") || len(msg) < 12:
+			return "NTLM"
+		case binary.LittleEndian.Uint32(msg[8:]) == 1:
+			conn["state"] = "challenged"
+			return "NTLM " + base64.StdEncoding.EncodeToString(ntlmChallengeMessage(serverChallenge))
+		case conn["state"] != "challenged":
+			t.Errorf("AUTHENTICATE_MESSAGE on a connection without challenge")
+			return "NTLM"
+		}
+		nt := ntlmField(msg, 1)
+		if !bytes.Equal(nt[:16], hmacMD5(key, serverChallenge, nt[16:])) {
+			t.Errorf("invalid NTLM answer")
+			return "NTLM"
+		}
+		return ""
+	})
+
+	c := newTestConnector(t, url.UserPassword(`DOMAIN\user`, "secret"))
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := c.Connect(context.Background(), conn, "tcp", "example.com:443"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectRejected(t *testing.T) {
+	addr := testProxy(t, digestChallenge("user", "secret"))
+	c := newTestConnector(t, url.UserPassword("user", "wrong"))
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the answer is not sent again after the proxy rejected it
+	_, err = c.Connect(context.Background(), conn, "tcp", "example.com:443")
+	perr, ok := err.(*connector.ProxyError)
+	if !ok || perr.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("error %v, want the 407 of the proxy", err)
+	}
+}
+
+// TestPlainHTTPAuth checks the authenticator of plain HTTP requests, which are sent by the handler.
+func TestPlainHTTPAuth(t *testing.T) {
+	c := newTestConnector(t, url.UserPassword("user", "secret"))
+	pc, _ := net.Pipe()
+	defer pc.Close()
+	conn, err := c.Connect(context.Background(), pc, "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := xnet.ProxyAuthenticatorFromConn(conn)
+	if auth == nil {
+		t.Fatal("no authenticator on the plain HTTP connection")
+	}
+
+	const uri = "http://example.com/index.html"
+	sent := auth.Authorization(http.MethodGet, uri)
+	if !strings.HasPrefix(sent, "Basic ") {
+		t.Errorf("first Authorization %q, want Basic", sent)
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusProxyAuthRequired,
+		Header:     http.Header{"Proxy-Authenticate": {`Digest realm="proxy", nonce="n0nce", qop="auth"`}},
+	}
+	answer := auth.Answer(resp, http.MethodGet, uri, sent)
+	p := parseAuthParams(strings.TrimPrefix(answer, "Digest "))
+	ch := &challenge{scheme: authSchemeDigest, params: map[string]string{"realm": "proxy", "nonce": "n0nce", "qop": "auth"}}
+	if p["uri"] != uri || p["response"] != digestResponse(ch, "user", "secret", http.MethodGet, uri, p["nc"], p["cnonce"]) {
+		t.Errorf("invalid Digest answer %q", answer)
+	}
+	if answer := auth.Answer(resp, http.MethodGet, uri, answer); answer != "" {
+		t.Errorf("the rejected answer is sent again: %q", answer)
+	}
+}
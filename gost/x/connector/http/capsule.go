@@ -0,0 +1,113 @@
+package http
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	// DATAGRAM capsule, RFC 9297 section 3.5
+	capsuleTypeDatagram = 0x00
+	// context ID of UDP payloads, RFC 9298 section 4
+	udpContextID = 0x00
+
+	maxCapsuleLen = 65535 + 16
+)
+
+var (
+	errCapsuleTooLarge = errors.New("capsule too large")
+)
+
+// appendVarint appends v as QUIC variable-length integer, RFC 9000 section 16.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// readVarint reads a QUIC variable-length integer and returns its value and encoded length.
+func readVarint(r io.ByteReader) (v uint64, n int, err error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return
+	}
+	n = 1 << (b >> 6)
+	v = uint64(b & 0x3f)
+	for i := 1; i < n; i++ {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return
+}
+
+// writeDatagramCapsule writes the UDP payload b as a DATAGRAM capsule.
+func writeDatagramCapsule(w io.Writer, b []byte) error {
+	buf := make([]byte, 0, len(b)+16)
+	buf = appendVarint(buf, capsuleTypeDatagram)
+	buf = appendVarint(buf, uint64(len(b)+1))
+	buf = appendVarint(buf, udpContextID)
+	buf = append(buf, b...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readDatagramCapsule reads the next UDP payload into b, skipping unknown capsules and contexts.
+// Payloads larger than b are truncated like datagrams read from a socket.
+func readDatagramCapsule(r *bufio.Reader, b []byte) (int, error) {
+	for {
+		typ, _, err := readVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		length, _, err := readVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		if length > maxCapsuleLen {
+			return 0, errCapsuleTooLarge
+		}
+
+		if typ != capsuleTypeDatagram || length == 0 {
+			if _, err := r.Discard(int(length)); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		contextID, nn, err := readVarint(r)
+		if err != nil {
+			return 0, err
+		}
+		if uint64(nn) > length {
+			return 0, errors.New("malformed datagram capsule")
+		}
+		payload := int(length) - nn
+		if contextID != udpContextID {
+			if _, err := r.Discard(payload); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if payload <= len(b) {
+			return io.ReadFull(r, b[:payload])
+		}
+		n, err := io.ReadFull(r, b)
+		if err != nil {
+			return n, err
+		}
+		_, err = r.Discard(payload - n)
+		return n, err
+	}
+}
@@ -3,20 +3,22 @@ package http
 import (
 	"bufio"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"net"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"proxy_forwarder/gost/core/connector"
 	md "proxy_forwarder/gost/core/metadata"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/identity"
+	"proxy_forwarder/gost/x/internal/loop"
+	xnet "proxy_forwarder/gost/x/internal/net"
 	"proxy_forwarder/gost/x/registry"
 	"proxy_forwarder/log"
-	"proxy_forwarder/meta"
 )
 
 func init() {
@@ -24,7 +26,10 @@ func init() {
 }
 
 type httpConnector struct {
-	md      metadata
+	md   metadata
+	auth *proxyAuth
+	// auths holds the authentication state per client identity, by name and username
+	auths   sync.Map
 	options connector.Options
 }
 
@@ -40,28 +45,65 @@ func NewConnector(opts ...connector.Option) connector.Connector {
 }
 
 func (c *httpConnector) Init(md md.Metadata) (err error) {
+	if c.options.Auth != nil || c.options.Credentials != nil {
+		c.auth = newProxyAuth(c.userinfo)
+	}
 	return c.parseMetadata(md)
 }
 
+func (c *httpConnector) userinfo() *url.Userinfo {
+	if c.options.Credentials != nil {
+		return c.options.Credentials.Userinfo()
+	}
+	return c.options.Auth
+}
+
 func (c *httpConnector) Connect(ctx context.Context, conn net.Conn, l4proto string, address string, opts ...connector.ConnectOption) (net.Conn, error) {
 	logSrc := strings.Split(conn.LocalAddr().String(), ":")[0]
 	logDst := conn.RemoteAddr().String() + " => " + address + "/" + l4proto
 
-	if strings.HasSuffix(address, ":80") {
-		// don't use HTTP-CONNECT tunnel if plain http is used
-		// todo: use https-check like used in handler-redirect-tcp
-		log.ConnDebug("connector", logSrc, logDst, "sending plain HTTP without HTTP-CONNECT tunnel")
+	s, isH2 := conn.(h2Session)
+
+	switch l4proto {
+	case "udp", "udp4", "udp6":
+		if isH2 {
+			log.ConnError("connector", logSrc, logDst, errH2UDPUnsupported)
+			return nil, errH2UDPUnsupported
+		}
+		cc, err := c.connectUDP(ctx, conn, address, logSrc, logDst)
+		if err != nil {
+			log.ConnError("connector", logSrc, logDst, err)
+			return nil, err
+		}
+		return cc, nil
+	}
 
-		var cOpts connector.ConnectOptions
-		for _, opt := range opts {
-			opt(&cOpts)
+	if xctx.IsPlainHTTP(ctx) || strings.HasSuffix(address, ":80") {
+		// don't use HTTP-CONNECT tunnel if plain http is used,
+		// the requests are sent in absolute-form over the proxy connection itself.
+		// the headers and credentials of the client identity are only sent to the proxy
+		header := c.forwardedHeader(ctx)
+		identity.FromContext(ctx).Apply(header)
+		var auth xnet.ProxyAuthenticator
+		if a := c.authFor(ctx); a != nil {
+			auth = &plainAuth{auth: a, stream: isH2}
+		}
+		if isH2 {
+			log.ConnDebug("connector", logSrc, logDst, "sending plain HTTP as HTTP/2 requests")
+			return xnet.NewProxyHeaderConn(newH2RequestConn(conn, s), header, auth), nil
 		}
+		log.ConnDebug("connector", logSrc, logDst, "sending plain HTTP without HTTP-CONNECT tunnel")
+		return xnet.NewProxyHeaderConn(conn, header, auth), nil
+	}
 
-		conn, err := cOpts.NetDialer.Dial(ctx, l4proto, conn.RemoteAddr().String())
+	if isH2 {
+		log.ConnDebug("connector", logSrc, logDst, "establishing HTTP/2 CONNECT stream")
+		cc, err := c.connectH2(ctx, conn, s, address, logSrc, logDst)
 		if err != nil {
+			log.ConnError("connector", logSrc, logDst, err)
 			return nil, err
 		}
-		return conn, nil
+		return cc, nil
 	}
 
 	log.ConnDebug("connector", logSrc, logDst, "establishing HTTP-CONNECT tunnel")
@@ -71,20 +113,11 @@ func (c *httpConnector) Connect(ctx context.Context, conn net.Conn, l4proto stri
 		Host:       address,
 		ProtoMajor: 1,
 		ProtoMinor: 1,
-		Header:     c.md.header,
+		Header:     c.header(ctx),
 	}
 
-	if req.Header == nil {
-		req.Header = http.Header{}
-	}
 	req.Header.Set("Proxy-Connection", "keep-alive")
-
-	if user := c.options.Auth; user != nil {
-		u := user.Username()
-		p, _ := user.Password()
-		req.Header.Set("Proxy-Authorization",
-			"Basic "+base64.StdEncoding.EncodeToString([]byte(u+":"+p)))
-	}
+	req.Header.Add("Via", loop.Via())
 
 	switch l4proto {
 	case "tcp", "tcp4", "tcp6":
@@ -99,22 +132,14 @@ func (c *httpConnector) Connect(ctx context.Context, conn net.Conn, l4proto stri
 		return nil, err
 	}
 
-	if meta.DEBUG {
-		dump, _ := httputil.DumpRequest(req, false)
-		log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("Request: %s", string(dump)))
-	}
-
 	if c.md.connectTimeout > 0 {
 		conn.SetDeadline(time.Now().Add(c.md.connectTimeout))
 		defer conn.SetDeadline(time.Time{})
 	}
 
 	// req = req.WithContext(ctx)
-	if err := req.Write(conn); err != nil {
-		return nil, err
-	}
-
-	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	br := bufio.NewReader(conn)
+	resp, err := c.roundTrip(conn, br, req, c.authFor(ctx), logSrc, logDst)
 	if err != nil {
 		return nil, err
 	}
@@ -123,17 +148,97 @@ func (c *httpConnector) Connect(ctx context.Context, conn net.Conn, l4proto stri
 	// in this case, close body will be blocked, so we leave it untouched.
 	// defer resp.Body.Close()
 
-	if meta.DEBUG {
-		dump, _ := httputil.DumpResponse(resp, false)
-		log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("Response: %s", string(dump)))
-	}
-
 	// if proxy 'tunnel' could not be established
-	if resp.StatusCode == 403 {
-		return nil, fmt.Errorf("upstream proxy denied the connection")
-	} else if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("upstream proxy connection failed with code %s", resp.Status)
+	if resp.StatusCode != http.StatusOK {
+		return nil, proxyError(resp)
 	}
 
+	if br.Buffered() > 0 {
+		return xnet.NewBufferReaderConn(conn, br), nil
+	}
 	return conn, nil
 }
+
+// header returns the headers of the requests to the proxy, including the ones of the client identity.
+func (c *httpConnector) header(ctx context.Context) http.Header {
+	header := c.md.header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	if id := identity.FromContext(ctx); id != nil {
+		for k, vs := range id.Header {
+			header[http.CanonicalHeaderKey(k)] = append([]string(nil), vs...)
+		}
+	}
+	for k, vs := range c.forwardedHeader(ctx) {
+		header[k] = vs
+	}
+	return header
+}
+
+// forwardedHeader returns the headers announcing the client and the original destination of the flow.
+func (c *httpConnector) forwardedHeader(ctx context.Context) http.Header {
+	header := http.Header{}
+
+	if src := xctx.SrcAddrFromContext(ctx); src != nil && (c.md.forwardedFor || c.md.forwarded) {
+		host, _, err := net.SplitHostPort(src.String())
+		if err != nil {
+			host = src.String()
+		}
+		if c.md.forwardedFor {
+			header.Set("X-Forwarded-For", host)
+		}
+		if c.md.forwarded {
+			// RFC 7239, IPv6 addresses are quoted and bracketed
+			if strings.Contains(host, ":") {
+				host = `"[` + host + `]"`
+			}
+			header.Set("Forwarded", "for="+host)
+		}
+	}
+
+	if dst := xctx.DstAddrFromContext(ctx); dst != nil && c.md.dstHeader != "" {
+		header.Set(c.md.dstHeader, dst.String())
+	}
+
+	return header
+}
+
+// authFor returns the authentication state for the credentials of the client identity,
+// or the one of the connector if the identity has no credentials.
+func (c *httpConnector) authFor(ctx context.Context) *proxyAuth {
+	id := identity.FromContext(ctx)
+	if id == nil || id.User == nil {
+		return c.auth
+	}
+
+	// the state is kept per identity, so Digest nonces are reused across flows.
+	// It is replaced when the password of the identity changes.
+	key := id.Name + "|" + id.User.Username()
+	if v, ok := c.auths.Load(key); ok && v.(*identityAuth).user.String() == id.User.String() {
+		return v.(*identityAuth).auth
+	}
+	user := id.User
+	a := &identityAuth{
+		user: user,
+		auth: newProxyAuth(func() *url.Userinfo { return user }),
+	}
+	c.auths.Store(key, a)
+	return a.auth
+}
+
+// identityAuth is the authentication state of a client identity for its credentials.
+type identityAuth struct {
+	user *url.Userinfo
+	auth *proxyAuth
+}
+
+// proxyAuthorization returns the value of the Proxy-Authorization header for requests
+// that can't answer challenges, empty if no credentials are configured.
+func (c *httpConnector) proxyAuthorization(ctx context.Context, method, uri string) string {
+	auth := c.authFor(ctx)
+	if auth == nil {
+		return ""
+	}
+	return auth.preemptive(method, uri)
+}
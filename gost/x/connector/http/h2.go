@@ -0,0 +1,378 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/x/internal/loop"
+	xnet "proxy_forwarder/gost/x/internal/net"
+	"proxy_forwarder/log"
+	"proxy_forwarder/meta"
+)
+
+var (
+	errH2UDPUnsupported = errors.New("CONNECT-UDP over a shared HTTP/2 connection is unsupported")
+)
+
+// h2Session is a reserved stream on an HTTP/2 connection to the proxy, created by the h2 dialer.
+// Closing it releases the stream slot.
+type h2Session interface {
+	RoundTrip(req *http.Request) (*http.Response, error)
+	// Deadline returns the deadline set on the reserved stream, it applies to opening the stream.
+	Deadline() time.Time
+}
+
+// connectH2 opens a CONNECT stream (RFC 9113 section 8.5) to address.
+// The flow control of the streams is independent, a stalled client only stalls its own stream.
+func (c *httpConnector) connectH2(ctx context.Context, conn net.Conn, s h2Session, address string, logSrc, logDst string) (net.Conn, error) {
+	auth := c.authFor(ctx)
+
+	var sent string
+	if auth != nil {
+		sent = auth.preemptive(http.MethodConnect, address)
+	}
+
+	// each round opens a new stream, the one of the previous round is closed
+	var pw *io.PipeWriter
+	var cancel context.CancelFunc
+	closeStream := func() {
+		if cancel != nil {
+			pw.Close()
+			cancel()
+		}
+	}
+	send := func(round int, authorization string) (*http.Response, error) {
+		closeStream()
+
+		// the stream lives until the connection is closed, ctx only applies
+		// until the response headers arrive
+		var sctx context.Context
+		sctx, cancel = context.WithCancel(context.Background())
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		req := &http.Request{
+			Method:     http.MethodConnect,
+			URL:        &url.URL{Host: address},
+			Host:       address,
+			ProtoMajor: 2,
+			Header:     c.header(ctx),
+			Body:       pr,
+		}
+		req.Header.Add("Via", loop.Via())
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		req = req.WithContext(sctx)
+
+		if meta.DEBUG {
+			dump, _ := httputil.DumpRequest(maskCredentials(req), false)
+			log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("Request: %s", string(dump)))
+		}
+
+		resp, err := c.openStream(ctx, s, req, cancel)
+		if err != nil {
+			return nil, err
+		}
+
+		if meta.DEBUG {
+			dump, _ := httputil.DumpResponse(resp, false)
+			log.ConnDebug("connector", logSrc, logDst, fmt.Sprintf("Response: %s", string(dump)))
+		}
+		return resp, nil
+	}
+
+	resp, err := xnet.AuthRoundTrip(sent, send,
+		c.answerer(auth, http.MethodConnect, address, streamChallenges, logSrc, logDst))
+	if err != nil {
+		closeStream()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		closeStream()
+		return nil, proxyError(resp)
+	}
+	return &h2Conn{
+		Conn:   conn,
+		r:      resp.Body,
+		w:      pw,
+		cancel: cancel,
+	}, nil
+}
+
+// openStream sends the CONNECT request of a stream. The stream is canceled by cancel
+// if ctx is done, the connect timeout or the deadline of the session expires before
+// the response headers arrive.
+func (c *httpConnector) openStream(ctx context.Context, s h2Session, req *http.Request, cancel context.CancelFunc) (*http.Response, error) {
+	timeout := c.md.connectTimeout
+	if d := s.Deadline(); !d.IsZero() && (timeout <= 0 || time.Until(d) < timeout) {
+		timeout = time.Until(d)
+		if timeout <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+	}
+
+	var mu sync.Mutex
+	var opened bool
+	var stopErr error
+	stop := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !opened {
+			stopErr = err
+			cancel()
+		}
+	}
+
+	var timer *time.Timer
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() { stop(os.ErrDeadlineExceeded) })
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	resp, err := s.RoundTrip(req)
+
+	mu.Lock()
+	opened = true
+	mu.Unlock()
+	close(done)
+	if timer != nil {
+		timer.Stop()
+	}
+
+	if stopErr != nil {
+		// canceled, possibly right after the headers arrived
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, stopErr
+	}
+	return resp, err
+}
+
+// h2Conn is a CONNECT stream, the embedded connection is the reserved stream slot.
+// An expired deadline cancels the stream, it can't be used afterwards.
+type h2Conn struct {
+	net.Conn
+	r      io.ReadCloser
+	w      *io.PipeWriter
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	rtimer  *time.Timer
+	wtimer  *time.Timer
+	expired bool
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if err != nil && c.isExpired() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil && c.isExpired() {
+		err = os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	c.setTimer(&c.rtimer, t)
+	return nil
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	c.setTimer(&c.wtimer, t)
+	return nil
+}
+
+func (c *h2Conn) setTimer(timer **time.Timer, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if *timer != nil {
+		(*timer).Stop()
+		*timer = nil
+	}
+	if t.IsZero() || c.expired {
+		return
+	}
+	*timer = time.AfterFunc(time.Until(t), c.expire)
+}
+
+func (c *h2Conn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	c.mu.Unlock()
+
+	c.w.CloseWithError(os.ErrDeadlineExceeded)
+	c.cancel()
+}
+
+func (c *h2Conn) isExpired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.expired
+}
+
+func (c *h2Conn) Close() error {
+	c.setTimer(&c.rtimer, time.Time{})
+	c.setTimer(&c.wtimer, time.Time{})
+	c.w.Close()
+	c.r.Close()
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// hopHeaders are connection-specific, HTTP/2 requests must not carry them (RFC 9113 section 8.2.2).
+var hopHeaders = []string{"Connection", "Proxy-Connection", "Keep-Alive", "Upgrade", "Transfer-Encoding"}
+
+// h2RequestConn sends the plain HTTP requests the handler writes to it in absolute-form as
+// ordinary requests on the HTTP/2 connection, so the proxy applies its policy for requests
+// instead of tunneling them. The responses are read from it as HTTP/1.1 responses.
+// The embedded connection is the reserved stream slot, the requests are sent one at a time.
+type h2RequestConn struct {
+	net.Conn
+	local  net.Conn
+	cancel context.CancelFunc
+}
+
+func newH2RequestConn(conn net.Conn, s h2Session) net.Conn {
+	local, remote := net.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &h2RequestConn{
+		Conn:   conn,
+		local:  local,
+		cancel: cancel,
+	}
+	go c.serve(ctx, s, remote)
+	return c
+}
+
+func (c *h2RequestConn) serve(ctx context.Context, s h2Session, conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		req.RequestURI = ""
+		if req.URL.Host == "" {
+			req.URL.Host = req.Host
+		}
+		for _, v := range req.Header.Values("Connection") {
+			for _, k := range strings.Split(v, ",") {
+				req.Header.Del(strings.TrimSpace(k))
+			}
+		}
+		for _, k := range hopHeaders {
+			req.Header.Del(k)
+		}
+
+		// the body is sent while the response is read,
+		// the next request follows it on the connection
+		body := &notifyCloser{ReadCloser: req.Body, done: make(chan struct{})}
+		if req.Body == http.NoBody {
+			body.Close()
+		} else {
+			req.Body = body
+		}
+
+		resp, err := s.RoundTrip(req.WithContext(ctx))
+		if err != nil {
+			log.Debug("connector", fmt.Sprintf("HTTP/2 request %s %s: %v", req.Method, req.URL, err))
+			return
+		}
+		resp.ProtoMajor, resp.ProtoMinor = 1, 1
+		if resp.ContentLength < 0 && bodyAllowed(resp) {
+			resp.TransferEncoding = []string{"chunked"}
+		}
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-body.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// bodyAllowed reports whether the response has a body.
+func bodyAllowed(resp *http.Response) bool {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return false
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified
+}
+
+func (c *h2RequestConn) Read(b []byte) (int, error) {
+	return c.local.Read(b)
+}
+
+func (c *h2RequestConn) Write(b []byte) (int, error) {
+	return c.local.Write(b)
+}
+
+func (c *h2RequestConn) SetDeadline(t time.Time) error {
+	return c.local.SetDeadline(t)
+}
+
+func (c *h2RequestConn) SetReadDeadline(t time.Time) error {
+	return c.local.SetReadDeadline(t)
+}
+
+func (c *h2RequestConn) SetWriteDeadline(t time.Time) error {
+	return c.local.SetWriteDeadline(t)
+}
+
+func (c *h2RequestConn) Close() error {
+	c.local.Close()
+	c.cancel()
+	return c.Conn.Close()
+}
+
+// notifyCloser closes done when the body is closed, closing it reads the rest of the body.
+type notifyCloser struct {
+	io.ReadCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (r *notifyCloser) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() { close(r.done) })
+	return err
+}
@@ -0,0 +1,409 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/connector"
+	"proxy_forwarder/gost/x/internal/loop"
+	"proxy_forwarder/log"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// default URI template of RFC 9298 section 3
+	defaultMASQUETemplate = "/.well-known/masque/udp/{target_host}/{target_port}/"
+	masqueProtocol        = "connect-udp"
+
+	// SETTINGS_ENABLE_CONNECT_PROTOCOL, RFC 8441 section 3
+	settingEnableConnectProtocol http2.SettingID = 0x8
+
+	h2StreamID          = 1
+	h2InitialWindowSize = 1 << 20
+	h2ConnWindowSize    = 1 << 24
+)
+
+var (
+	errExtendedConnectUnsupported = errors.New("upstream proxy does not support extended CONNECT")
+)
+
+// expandMASQUETemplate fills in the target of the URI template, IPv6 literals are percent-encoded.
+func expandMASQUETemplate(template, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	return strings.NewReplacer(
+		"{target_host}", strings.ReplaceAll(host, ":", "%3A"),
+		"{target_port}", port,
+	).Replace(template), nil
+}
+
+// connectUDP establishes a CONNECT-UDP (RFC 9298) tunnel to address.
+func (c *httpConnector) connectUDP(ctx context.Context, conn net.Conn, address string, logSrc, logDst string) (net.Conn, error) {
+	path, err := expandMASQUETemplate(c.md.masqueTemplate, address)
+	if err != nil {
+		return nil, err
+	}
+	authority := conn.RemoteAddr().String()
+
+	if c.md.connectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.md.connectTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	// names are not resolved locally, the proxy resolves them
+	raddr := conn.RemoteAddr()
+	if ap, err := netip.ParseAddrPort(address); err == nil {
+		raddr = net.UDPAddrFromAddrPort(ap)
+	}
+
+	useH2 := c.md.masqueHTTP2
+	if tc, ok := conn.(*tls.Conn); ok && useH2 && tc.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		log.ConnDebug("connector", logSrc, logDst, "upstream proxy did not negotiate h2, using HTTP/1.1 upgrade")
+		useH2 = false
+	}
+
+	if useH2 {
+		log.ConnDebug("connector", logSrc, logDst, "establishing CONNECT-UDP tunnel (HTTP/2 extended CONNECT)")
+		stream, err := c.openH2Stream(ctx, conn, authority, path)
+		if err != nil {
+			return nil, err
+		}
+		return &masqueConn{
+			Conn:  conn,
+			r:     bufio.NewReader(stream),
+			w:     stream,
+			raddr: raddr,
+		}, nil
+	}
+
+	log.ConnDebug("connector", logSrc, logDst, "establishing CONNECT-UDP tunnel (HTTP/1.1 upgrade)")
+	req, err := http.NewRequest(http.MethodGet, "http://"+authority+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.header(ctx) {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", masqueProtocol)
+	req.Header.Set("Capsule-Protocol", "?1")
+	req.Header.Add("Via", loop.Via())
+
+	br := bufio.NewReader(conn)
+	resp, err := c.roundTrip(conn, br, req, c.authFor(ctx), logSrc, logDst)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), masqueProtocol) {
+		resp.Body.Close()
+		return nil, proxyError(resp)
+	}
+
+	return &masqueConn{
+		Conn:  conn,
+		r:     br,
+		w:     conn,
+		raddr: raddr,
+	}, nil
+}
+
+// masqueConn carries one UDP payload per Read/Write as DATAGRAM capsules.
+type masqueConn struct {
+	net.Conn
+	r     *bufio.Reader
+	w     io.Writer
+	raddr net.Addr
+	wmu   sync.Mutex
+}
+
+func (c *masqueConn) Read(b []byte) (n int, err error) {
+	return readDatagramCapsule(c.r, b)
+}
+
+func (c *masqueConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err = writeDatagramCapsule(c.w, b); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (c *masqueConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// h2Stream is the single extended CONNECT stream of an HTTP/2 connection to the proxy.
+type h2Stream struct {
+	conn   net.Conn
+	framer *http2.Framer
+	wmu    sync.Mutex
+
+	pr *io.PipeReader
+	pw *io.PipeWriter
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	connWindow   int64
+	streamWindow int64
+	maxFrameSize uint32
+	err          error
+}
+
+func (c *httpConnector) openH2Stream(ctx context.Context, conn net.Conn, authority, path string) (*h2Stream, error) {
+	s := &h2Stream{
+		conn:         conn,
+		framer:       http2.NewFramer(conn, conn),
+		connWindow:   65535,
+		streamWindow: 65535,
+		maxFrameSize: 16384,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	s.pr, s.pw = io.Pipe()
+
+	if _, err := io.WriteString(conn, http2.ClientPreface); err != nil {
+		return nil, err
+	}
+	if err := s.framer.WriteSettings(
+		http2.Setting{ID: http2.SettingEnablePush, Val: 0},
+		http2.Setting{ID: http2.SettingInitialWindowSize, Val: h2InitialWindowSize},
+	); err != nil {
+		return nil, err
+	}
+	if err := s.framer.WriteWindowUpdate(0, h2ConnWindowSize-65535); err != nil {
+		return nil, err
+	}
+
+	// the proxy has to announce the support of extended CONNECT before we can use it
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		sf, ok := f.(*http2.SettingsFrame)
+		if !ok || sf.IsAck() {
+			if err := s.handleFrame(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := s.handleFrame(sf); err != nil {
+			return nil, err
+		}
+		if v, ok := sf.Value(settingEnableConnectProtocol); !ok || v != 1 {
+			return nil, errExtendedConnectUnsupported
+		}
+		break
+	}
+
+	var hbuf bytes.Buffer
+	enc := hpack.NewEncoder(&hbuf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: http.MethodConnect})
+	enc.WriteField(hpack.HeaderField{Name: ":protocol", Value: masqueProtocol})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: authority})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: path})
+	enc.WriteField(hpack.HeaderField{Name: "capsule-protocol", Value: "?1"})
+	enc.WriteField(hpack.HeaderField{Name: "via", Value: loop.Via()})
+	if auth := c.proxyAuthorization(ctx, http.MethodConnect, path); auth != "" {
+		enc.WriteField(hpack.HeaderField{Name: "proxy-authorization", Value: auth, Sensitive: true})
+	}
+	for k, vs := range c.header(ctx) {
+		for _, v := range vs {
+			enc.WriteField(hpack.HeaderField{Name: strings.ToLower(k), Value: v})
+		}
+	}
+	if err := s.framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      h2StreamID,
+		BlockFragment: hbuf.Bytes(),
+		EndHeaders:    true,
+	}); err != nil {
+		return nil, err
+	}
+
+	for {
+		f, err := s.framer.ReadFrame()
+		if err != nil {
+			return nil, err
+		}
+		hf, ok := f.(*http2.MetaHeadersFrame)
+		if !ok || hf.StreamID != h2StreamID {
+			if err := s.handleFrame(f); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		status, _ := strconv.Atoi(hf.PseudoValue("status"))
+		if status < 200 || status > 299 {
+			return nil, &connector.ProxyError{
+				StatusCode: status,
+				Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			}
+		}
+		break
+	}
+
+	go s.readLoop()
+	return s, nil
+}
+
+func (s *h2Stream) readLoop() {
+	for {
+		f, err := s.framer.ReadFrame()
+		if err == nil {
+			err = s.handleFrame(f)
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (s *h2Stream) handleFrame(f http2.Frame) error {
+	switch f := f.(type) {
+	case *http2.DataFrame:
+		if f.StreamID != h2StreamID {
+			return nil
+		}
+		if data := f.Data(); len(data) > 0 {
+			if _, err := s.pw.Write(data); err != nil {
+				return err
+			}
+		}
+		// the data is consumed, restore the receive windows.
+		// The padding counts against the windows as well, RFC 9113 section 6.9.1
+		if n := f.Header().Length; n > 0 {
+			s.wmu.Lock()
+			s.framer.WriteWindowUpdate(0, n)
+			s.framer.WriteWindowUpdate(h2StreamID, n)
+			s.wmu.Unlock()
+		}
+		if f.StreamEnded() {
+			return io.EOF
+		}
+
+	case *http2.WindowUpdateFrame:
+		s.mu.Lock()
+		if f.StreamID == 0 {
+			s.connWindow += int64(f.Increment)
+		} else if f.StreamID == h2StreamID {
+			s.streamWindow += int64(f.Increment)
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+	case *http2.SettingsFrame:
+		if f.IsAck() {
+			return nil
+		}
+		s.mu.Lock()
+		f.ForeachSetting(func(setting http2.Setting) error {
+			switch setting.ID {
+			case http2.SettingInitialWindowSize:
+				// the delta applies to the open stream, RFC 9113 section 6.9.2
+				s.streamWindow += int64(setting.Val) - 65535
+			case http2.SettingMaxFrameSize:
+				s.maxFrameSize = setting.Val
+			}
+			return nil
+		})
+		s.cond.Broadcast()
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		return s.framer.WriteSettingsAck()
+
+	case *http2.PingFrame:
+		if f.IsAck() {
+			return nil
+		}
+		s.wmu.Lock()
+		defer s.wmu.Unlock()
+		return s.framer.WritePing(true, f.Data)
+
+	case *http2.RSTStreamFrame:
+		if f.StreamID == h2StreamID {
+			return fmt.Errorf("stream reset by upstream proxy: %s", f.ErrCode)
+		}
+
+	case *http2.GoAwayFrame:
+		return fmt.Errorf("connection closed by upstream proxy: %s", f.ErrCode)
+	}
+
+	return nil
+}
+
+func (s *h2Stream) closeWithError(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.pw.CloseWithError(err)
+}
+
+func (s *h2Stream) Read(b []byte) (int, error) {
+	return s.pr.Read(b)
+}
+
+func (s *h2Stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		s.mu.Lock()
+		for s.err == nil && (s.connWindow <= 0 || s.streamWindow <= 0) {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			err = s.err
+			s.mu.Unlock()
+			return
+		}
+		size := int64(len(b))
+		if size > s.connWindow {
+			size = s.connWindow
+		}
+		if size > s.streamWindow {
+			size = s.streamWindow
+		}
+		if size > int64(s.maxFrameSize) {
+			size = int64(s.maxFrameSize)
+		}
+		s.connWindow -= size
+		s.streamWindow -= size
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		err = s.framer.WriteData(h2StreamID, false, b[:size])
+		s.wmu.Unlock()
+		if err != nil {
+			return
+		}
+		n += int(size)
+		b = b[size:]
+	}
+	return
+}
@@ -0,0 +1,262 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	xmd "proxy_forwarder/gost/x/metadata"
+
+	"golang.org/x/net/http2"
+)
+
+// TestMain runs the tests again with extended CONNECT enabled in the HTTP/2 server
+// of net/http, the setting is only read from the environment at startup.
+func TestMain(m *testing.M) {
+	const xconnect = "http2xconnect=1"
+	if godebug := os.Getenv("GODEBUG"); !strings.Contains(godebug, xconnect) {
+		if godebug != "" {
+			godebug += ","
+		}
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), "GODEBUG="+godebug+xconnect)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			if ee, ok := err.(*exec.ExitError); ok {
+				os.Exit(ee.ExitCode())
+			}
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// echoMASQUE answers CONNECT-UDP requests by sending the datagrams back.
+func echoMASQUE(t *testing.T, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get(":protocol") != masqueProtocol {
+			t.Errorf("unexpected request %s %s (protocol %q)", r.Method, r.URL, r.Header.Get(":protocol"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != path {
+			t.Errorf("unexpected path %s, want %s", r.URL.Path, path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Capsule-Protocol") != "?1" {
+			t.Errorf("missing capsule-protocol header")
+		}
+
+		rc := http.NewResponseController(w)
+		w.WriteHeader(http.StatusOK)
+		rc.Flush()
+
+		br := bufio.NewReader(r.Body)
+		b := make([]byte, 65536)
+		for {
+			n, err := readDatagramCapsule(br, b)
+			if err != nil {
+				return
+			}
+			if err := writeDatagramCapsule(w, b[:n]); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	})
+}
+
+func TestConnectUDPHTTP2(t *testing.T) {
+	srv := httptest.NewUnstartedServer(echoMASQUE(t, "/.well-known/masque/udp/192.0.2.1/53/"))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	conn, err := tls.Dial("tcp", srv.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{http2.NextProtoTLS},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	c := NewConnector().(*httpConnector)
+	if err := c.Init(xmd.NewMetadata(map[string]any{"masque.http2": true})); err != nil {
+		t.Fatal(err)
+	}
+	cc, err := c.Connect(context.Background(), conn, "udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cc.RemoteAddr().String(); got != "192.0.2.1:53" {
+		t.Errorf("remote address %s, want 192.0.2.1:53", got)
+	}
+
+	// more than the initial window of the stream, the writes wait for WINDOW_UPDATEs
+	// and the datagrams larger than a frame are split
+	b := make([]byte, 65536)
+	for i, size := range []int{1, 512, 1200, 20000, 40000, 1200, 1200} {
+		payload := bytes.Repeat([]byte{byte(i)}, size)
+		if _, err := cc.Write(payload); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+		n, err := cc.Read(b)
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if !bytes.Equal(b[:n], payload) {
+			t.Fatalf("datagram %d: got %d bytes, want %d", i, n, size)
+		}
+	}
+}
+
+// echoUpgradeMASQUE answers CONNECT-UDP requests using the HTTP/1.1 upgrade by sending the datagrams back.
+func echoUpgradeMASQUE(t *testing.T, path string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), masqueProtocol) ||
+			!strings.EqualFold(r.Header.Get("Connection"), "Upgrade") {
+			t.Errorf("unexpected request %s %s (upgrade %q)", r.Method, r.URL, r.Header.Get("Upgrade"))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path != path {
+			t.Errorf("unexpected path %s, want %s", r.URL.Path, path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Capsule-Protocol") != "?1" {
+			t.Errorf("missing capsule-protocol header")
+		}
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n")
+
+		b := make([]byte, 65536)
+		for {
+			n, err := readDatagramCapsule(brw.Reader, b)
+			if err != nil {
+				return
+			}
+			if err := writeDatagramCapsule(conn, b[:n]); err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestConnectUDPUpgrade(t *testing.T) {
+	tests := []struct {
+		address string
+		path    string
+		// empty for the address of the proxy, names are not resolved locally
+		raddr string
+	}{
+		{"192.0.2.1:53", "/.well-known/masque/udp/192.0.2.1/53/", "192.0.2.1:53"},
+		{"[2001:db8::1]:443", "/.well-known/masque/udp/2001:db8::1/443/", "[2001:db8::1]:443"},
+		{"dns.example.invalid:53", "/.well-known/masque/udp/dns.example.invalid/53/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			srv := httptest.NewServer(echoUpgradeMASQUE(t, tt.path))
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			c := NewConnector().(*httpConnector)
+			if err := c.Init(xmd.NewMetadata(map[string]any{})); err != nil {
+				t.Fatal(err)
+			}
+			cc, err := c.Connect(context.Background(), conn, "udp", tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raddr := tt.raddr
+			if raddr == "" {
+				raddr = conn.RemoteAddr().String()
+			}
+			if got := cc.RemoteAddr().String(); got != raddr {
+				t.Errorf("remote address %s, want %s", got, raddr)
+			}
+
+			b := make([]byte, 65536)
+			for i, size := range []int{1, 512, 1200, 20000} {
+				payload := bytes.Repeat([]byte{byte(i)}, size)
+				if _, err := cc.Write(payload); err != nil {
+					t.Fatalf("write %d: %v", i, err)
+				}
+				n, err := cc.Read(b)
+				if err != nil {
+					t.Fatalf("read %d: %v", i, err)
+				}
+				if !bytes.Equal(b[:n], payload) {
+					t.Fatalf("datagram %d: got %d bytes, want %d", i, n, size)
+				}
+			}
+		})
+	}
+}
+
+func TestH2StreamPaddedData(t *testing.T) {
+	var out bytes.Buffer
+	s := &h2Stream{
+		framer: http2.NewFramer(&out, nil),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	s.pr, s.pw = io.Pipe()
+	go io.Copy(io.Discard, s.pr)
+
+	var in bytes.Buffer
+	data := []byte("datagram")
+	pad := make([]byte, 100)
+	if err := http2.NewFramer(&in, nil).WriteDataPadded(h2StreamID, false, data, pad); err != nil {
+		t.Fatal(err)
+	}
+	f, err := http2.NewFramer(nil, &in).ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.handleFrame(f); err != nil {
+		t.Fatal(err)
+	}
+
+	// pad length field, data and padding
+	want := uint32(1 + len(data) + len(pad))
+	fr := http2.NewFramer(nil, &out)
+	for _, streamID := range []uint32{0, h2StreamID} {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wu, ok := f.(*http2.WindowUpdateFrame)
+		if !ok || wu.StreamID != streamID {
+			t.Fatalf("got %v, want WINDOW_UPDATE of stream %d", f, streamID)
+		}
+		if wu.Increment != want {
+			t.Errorf("stream %d: increment %d, want %d", streamID, wu.Increment, want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package http
 
 import (
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	mdata "proxy_forwarder/gost/core/metadata"
@@ -11,12 +13,23 @@ import (
 type metadata struct {
 	connectTimeout time.Duration
 	header         http.Header
+	masqueTemplate string
+	masqueHTTP2    bool
+	// client address as X-Forwarded-For and/or Forwarded header
+	forwardedFor bool
+	forwarded    bool
+	// name of the header carrying the original destination
+	dstHeader string
 }
 
 func (c *httpConnector) parseMetadata(md mdata.Metadata) (err error) {
 	const (
 		connectTimeout = "timeout"
 		header         = "header"
+		masqueTemplate = "masque.template"
+		masqueHTTP2    = "masque.http2"
+		forwarded      = "forwarded"
+		dstHeader      = "dstHeader"
 	)
 
 	c.md.connectTimeout = mdutil.GetDuration(md, connectTimeout)
@@ -29,5 +42,24 @@ func (c *httpConnector) parseMetadata(md mdata.Metadata) (err error) {
 		c.md.header = hd
 	}
 
+	c.md.masqueTemplate = mdutil.GetString(md, masqueTemplate)
+	if c.md.masqueTemplate == "" {
+		c.md.masqueTemplate = defaultMASQUETemplate
+	}
+	c.md.masqueHTTP2 = mdutil.GetBool(md, masqueHTTP2)
+
+	for _, v := range strings.Split(mdutil.GetString(md, forwarded), ",") {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "":
+		case "xff", "x-forwarded-for":
+			c.md.forwardedFor = true
+		case "forwarded":
+			c.md.forwarded = true
+		default:
+			return fmt.Errorf("invalid forwarded header %q", v)
+		}
+	}
+	c.md.dstHeader = http.CanonicalHeaderKey(mdutil.GetString(md, dstHeader))
+
 	return
 }
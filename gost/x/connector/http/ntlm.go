@@ -0,0 +1,210 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// NTLMv2 (MS-NLMP) as used by HTTP proxies, only authentication is done,
+// neither signing nor sealing.
+
+const (
+	ntlmNegotiateUnicode                 = 0x00000001
+	ntlmNegotiateOEM                     = 0x00000002
+	ntlmRequestTarget                    = 0x00000004
+	ntlmNegotiateNTLM                    = 0x00000200
+	ntlmNegotiateAlwaysSign              = 0x00008000
+	ntlmNegotiateExtendedSessionSecurity = 0x00080000
+	ntlmNegotiateTargetInfo              = 0x00800000
+
+	ntlmAvEOL       = 0
+	ntlmAvTimestamp = 7
+)
+
+var (
+	ntlmSignature = []byte("NTLMSSP\x00")
+
+	errNTLMChallenge = errors.New("ntlm: invalid challenge message")
+)
+
+const ntlmFlags = ntlmNegotiateUnicode | ntlmNegotiateOEM | ntlmRequestTarget | ntlmNegotiateNTLM |
+	ntlmNegotiateAlwaysSign | ntlmNegotiateExtendedSessionSecurity
+
+// ntlmNegotiate returns the NEGOTIATE_MESSAGE, without domain and workstation.
+func ntlmNegotiate() []byte {
+	b := make([]byte, 32)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], ntlmFlags)
+	return b
+}
+
+// ntlmAuthenticate answers the CHALLENGE_MESSAGE with an NTLMv2 AUTHENTICATE_MESSAGE.
+// The username may contain the domain as 'DOMAIN\user'.
+func ntlmAuthenticate(challenge []byte, username, password string) ([]byte, error) {
+	if len(challenge) < 32 || !bytes.Equal(challenge[:8], ntlmSignature) ||
+		binary.LittleEndian.Uint32(challenge[8:]) != 2 {
+		return nil, errNTLMChallenge
+	}
+	flags := binary.LittleEndian.Uint32(challenge[20:])
+	serverChallenge := challenge[24:32]
+
+	var targetInfo []byte
+	if flags&ntlmNegotiateTargetInfo != 0 && len(challenge) >= 48 {
+		l := int(binary.LittleEndian.Uint16(challenge[40:]))
+		off := int(binary.LittleEndian.Uint32(challenge[44:]))
+		if off+l > len(challenge) {
+			return nil, errNTLMChallenge
+		}
+		targetInfo = challenge[off : off+l]
+	}
+
+	domain := ""
+	if d, u, ok := strings.Cut(username, `\`); ok {
+		domain, username = d, u
+	}
+
+	timestamp := ntlmTimestamp(targetInfo)
+	clientChallenge := make([]byte, 8)
+	rand.Read(clientChallenge)
+
+	key := ntowfv2(username, password, domain)
+
+	// NTLMv2_CLIENT_CHALLENGE
+	var temp bytes.Buffer
+	temp.Write([]byte{1, 1, 0, 0, 0, 0, 0, 0})
+	temp.Write(timestamp)
+	temp.Write(clientChallenge)
+	temp.Write([]byte{0, 0, 0, 0})
+	temp.Write(targetInfo)
+	temp.Write([]byte{0, 0, 0, 0})
+
+	ntProof := hmacMD5(key, serverChallenge, temp.Bytes())
+	ntResponse := append(ntProof, temp.Bytes()...)
+	lmResponse := append(hmacMD5(key, serverChallenge, clientChallenge), clientChallenge...)
+
+	encode := func(s string) []byte { return []byte(s) }
+	if flags&ntlmNegotiateUnicode != 0 {
+		encode = utf16le
+	}
+
+	fields := [][]byte{lmResponse, ntResponse, encode(domain), encode(username), nil, nil}
+
+	const headerLen = 64
+	b := make([]byte, headerLen)
+	copy(b, ntlmSignature)
+	binary.LittleEndian.PutUint32(b[8:], 3)
+	for i, f := range fields {
+		pos := 12 + i*8
+		binary.LittleEndian.PutUint16(b[pos:], uint16(len(f)))
+		binary.LittleEndian.PutUint16(b[pos+2:], uint16(len(f)))
+		binary.LittleEndian.PutUint32(b[pos+4:], uint32(len(b)))
+		b = append(b, f...)
+	}
+	binary.LittleEndian.PutUint32(b[60:], flags&(ntlmFlags|ntlmNegotiateTargetInfo))
+	return b, nil
+}
+
+// ntlmTimestamp returns the MsvAvTimestamp of the server or the current time, as FILETIME.
+func ntlmTimestamp(targetInfo []byte) []byte {
+	for b := targetInfo; len(b) >= 4; {
+		id := binary.LittleEndian.Uint16(b)
+		l := int(binary.LittleEndian.Uint16(b[2:]))
+		if id == ntlmAvEOL || len(b) < 4+l {
+			break
+		}
+		if id == ntlmAvTimestamp && l == 8 {
+			return append([]byte{}, b[4:12]...)
+		}
+		b = b[4+l:]
+	}
+
+	t := make([]byte, 8)
+	// 100ns intervals since 1601-01-01
+	binary.LittleEndian.PutUint64(t, uint64(time.Now().UnixNano()/100+116444736000000000))
+	return t
+}
+
+// ntowfv2 is HMAC-MD5(MD4(UTF-16LE(password)), UTF-16LE(UPPER(user) + domain)).
+func ntowfv2(username, password, domain string) []byte {
+	h := md4(utf16le(password))
+	return hmacMD5(h[:], utf16le(strings.ToUpper(username)+domain))
+}
+
+func hmacMD5(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(md5.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+func utf16le(s string) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, 2*len(u))
+	for i, c := range u {
+		binary.LittleEndian.PutUint16(b[2*i:], c)
+	}
+	return b
+}
+
+// md4 implements RFC 1320, which is only needed for the NT hash.
+func md4(data []byte) [16]byte {
+	msg := append([]byte{}, data...)
+	msg = append(msg, 0x80)
+	for len(msg)%64 != 56 {
+		msg = append(msg, 0)
+	}
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(len(data))*8)
+
+	f := func(x, y, z uint32) uint32 { return x&y | ^x&z }
+	g := func(x, y, z uint32) uint32 { return x&y | x&z | y&z }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+	rotl := bits.RotateLeft32
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	var x [16]uint32
+	for len(msg) > 0 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(msg[4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+
+		for _, k := range []int{0, 4, 8, 12} {
+			a = rotl(a+f(b, c, d)+x[k], 3)
+			d = rotl(d+f(a, b, c)+x[k+1], 7)
+			c = rotl(c+f(d, a, b)+x[k+2], 11)
+			b = rotl(b+f(c, d, a)+x[k+3], 19)
+		}
+		for _, k := range []int{0, 1, 2, 3} {
+			a = rotl(a+g(b, c, d)+x[k]+0x5a827999, 3)
+			d = rotl(d+g(a, b, c)+x[k+4]+0x5a827999, 5)
+			c = rotl(c+g(d, a, b)+x[k+8]+0x5a827999, 9)
+			b = rotl(b+g(c, d, a)+x[k+12]+0x5a827999, 13)
+		}
+		for _, k := range []int{0, 2, 1, 3} {
+			a = rotl(a+h(b, c, d)+x[k]+0x6ed9eba1, 3)
+			d = rotl(d+h(a, b, c)+x[k+8]+0x6ed9eba1, 9)
+			c = rotl(c+h(d, a, b)+x[k+4]+0x6ed9eba1, 11)
+			b = rotl(b+h(c, d, a)+x[k+12]+0x6ed9eba1, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+		msg = msg[64:]
+	}
+
+	var sum [16]byte
+	binary.LittleEndian.PutUint32(sum[0:], a)
+	binary.LittleEndian.PutUint32(sum[4:], b)
+	binary.LittleEndian.PutUint32(sum[8:], c)
+	binary.LittleEndian.PutUint32(sum[12:], d)
+	return sum
+}
@@ -0,0 +1,102 @@
+package v5
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"proxy_forwarder/gost/core/common/bufpool"
+	"proxy_forwarder/gost/gosocks5"
+)
+
+// udpRelayConn sends the datagrams of a single flow over a SOCKS5 UDP relay.
+type udpRelayConn struct {
+	net.Conn // relay
+	tcpConn  net.Conn
+	taddr    *gosocks5.Addr
+	raddr    net.Addr
+
+	bufferSize int
+	closeOnce  sync.Once
+}
+
+func newUDPRelayConn(tcpConn, udpConn net.Conn, taddr *gosocks5.Addr, bufferSize int) *udpRelayConn {
+	c := &udpRelayConn{
+		Conn:       udpConn,
+		tcpConn:    tcpConn,
+		taddr:      taddr,
+		bufferSize: bufferSize,
+	}
+	if ip := net.ParseIP(taddr.Host); ip != nil {
+		c.raddr = &net.UDPAddr{IP: ip, Port: int(taddr.Port)}
+	}
+	go c.watch()
+	return c
+}
+
+// watch closes the relay when the proxy ends the association.
+func (c *udpRelayConn) watch() {
+	b := make([]byte, 1)
+	for {
+		if _, err := c.tcpConn.Read(b); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+func (c *udpRelayConn) Read(b []byte) (n int, err error) {
+	rbuf := bufpool.Get(c.bufferSize + 262)
+	defer bufpool.Put(rbuf)
+
+	for {
+		n, err = c.Conn.Read(*rbuf)
+		if err != nil {
+			return
+		}
+
+		header := gosocks5.UDPHeader{}
+		hlen, err := header.ReadFrom(bytes.NewReader((*rbuf)[:n]))
+		if err != nil {
+			return 0, err
+		}
+		if header.Frag != 0 {
+			// RFC 1928: implementations not supporting fragmentation drop fragments
+			continue
+		}
+		return copy(b, (*rbuf)[hlen:n]), nil
+	}
+}
+
+func (c *udpRelayConn) Write(b []byte) (n int, err error) {
+	wbuf := bufpool.Get(len(b) + 262)
+	defer bufpool.Put(wbuf)
+
+	buf := bytes.NewBuffer((*wbuf)[:0])
+	header := gosocks5.UDPHeader{Addr: c.taddr}
+	if _, err = header.WriteTo(buf); err != nil {
+		return
+	}
+	buf.Write(b)
+
+	if _, err = c.Conn.Write(buf.Bytes()); err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// RemoteAddr returns the target of the flow, or the relay if the proxy resolves the target.
+func (c *udpRelayConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.raddr
+}
+
+func (c *udpRelayConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		c.tcpConn.Close()
+	})
+	return
+}
@@ -0,0 +1,252 @@
+package v5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"proxy_forwarder/gost/core/connector"
+	md "proxy_forwarder/gost/core/metadata"
+	"proxy_forwarder/gost/gosocks5"
+	"proxy_forwarder/gost/gosocks5/client"
+	"proxy_forwarder/gost/x/internal/identity"
+	"proxy_forwarder/gost/x/registry"
+	"proxy_forwarder/log"
+)
+
+func init() {
+	registry.ConnectorRegistry().Register("socks5", NewConnector)
+	registry.ConnectorRegistry().Register("socks", NewConnector)
+	registry.ConnectorRegistry().Register("socks5h", NewRemoteDNSConnector)
+}
+
+type socks5Connector struct {
+	remoteDNS bool
+	md        metadata
+	options   connector.Options
+}
+
+func NewConnector(opts ...connector.Option) connector.Connector {
+	options := connector.Options{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &socks5Connector{
+		options: options,
+	}
+}
+
+// NewRemoteDNSConnector creates a connector that leaves resolving hostnames to the proxy (socks5h).
+func NewRemoteDNSConnector(opts ...connector.Option) connector.Connector {
+	c := NewConnector(opts...).(*socks5Connector)
+	c.remoteDNS = true
+	return c
+}
+
+func (c *socks5Connector) Init(md md.Metadata) (err error) {
+	if err = c.parseMetadata(md); err != nil {
+		return
+	}
+	if c.md.remoteDNS {
+		c.remoteDNS = true
+	}
+
+	return
+}
+
+// selector is created for each handshake as the credentials may be rotated
+// and the clients may have their own identity.
+func (c *socks5Connector) selector(ctx context.Context) gosocks5.Selector {
+	user := c.options.Auth
+	if c.options.Credentials != nil {
+		user = c.options.Credentials.Userinfo()
+	}
+	if id := identity.FromContext(ctx); id != nil && id.User != nil {
+		user = id.User
+	}
+
+	methods := []uint8{gosocks5.MethodNoAuth}
+	if user != nil {
+		methods = append(methods, gosocks5.MethodUserPass)
+	}
+	return client.NewClientSelector(user, methods...)
+}
+
+// Handshake implements connector.Handshaker.
+func (c *socks5Connector) Handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	if c.md.connectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.md.connectTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	cc := gosocks5.ClientConn(conn, c.selector(ctx))
+	if err := cc.Handleshake(); err != nil {
+		switch {
+		case errors.Is(err, gosocks5.ErrAuthFailure):
+			return nil, &connector.ProxyError{StatusCode: http.StatusProxyAuthRequired, Status: "407 SOCKS5 authentication failed"}
+		case errors.Is(err, gosocks5.ErrBadMethod):
+			return nil, &connector.ProxyError{StatusCode: http.StatusProxyAuthRequired, Status: "407 no acceptable SOCKS5 authentication method"}
+		}
+		return nil, err
+	}
+	return cc, nil
+}
+
+func (c *socks5Connector) Connect(ctx context.Context, conn net.Conn, l4proto string, address string, opts ...connector.ConnectOption) (net.Conn, error) {
+	logSrc := strings.Split(conn.LocalAddr().String(), ":")[0]
+	logDst := conn.RemoteAddr().String() + " => " + address + "/" + l4proto
+
+	var cc net.Conn
+	var err error
+	switch l4proto {
+	case "udp", "udp4", "udp6":
+		log.ConnDebug("connector", logSrc, logDst, "establishing SOCKS5 UDP association")
+		cc, err = c.associate(ctx, conn, l4proto, address, opts...)
+	default:
+		log.ConnDebug("connector", logSrc, logDst, "establishing SOCKS5 tunnel")
+		cc, err = c.connect(ctx, conn, l4proto, address)
+	}
+	if err != nil {
+		log.ConnError("connector", logSrc, logDst, err)
+		return nil, err
+	}
+	return cc, nil
+}
+
+func (c *socks5Connector) connect(ctx context.Context, conn net.Conn, network, address string) (net.Conn, error) {
+	addr, err := c.targetAddr(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = c.request(conn, gosocks5.CmdConnect, addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// associate sets up a UDP association, the datagrams are sent to the relay address of the proxy.
+// The association lasts as long as the connection to the proxy.
+func (c *socks5Connector) associate(ctx context.Context, conn net.Conn, network, address string, opts ...connector.ConnectOption) (net.Conn, error) {
+	var options connector.ConnectOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	taddr, err := c.targetAddr(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.request(conn, gosocks5.CmdUdp, &gosocks5.Addr{Type: gosocks5.AddrIPv4, Host: "0.0.0.0"})
+	if err != nil {
+		return nil, err
+	}
+
+	host := reply.Addr.Host
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		// the relay is on the address of the proxy
+		host, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	}
+	relay := net.JoinHostPort(host, strconv.Itoa(int(reply.Addr.Port)))
+
+	pc, err := options.NetDialer.Dial(ctx, "udp", relay)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 UDP relay %s: %w", relay, err)
+	}
+
+	return newUDPRelayConn(conn, pc, taddr, c.md.udpBufferSize), nil
+}
+
+func (c *socks5Connector) request(conn net.Conn, cmd uint8, addr *gosocks5.Addr) (*gosocks5.Reply, error) {
+	if c.md.connectTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.md.connectTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if err := gosocks5.NewRequest(cmd, addr).Write(conn); err != nil {
+		return nil, err
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Rep != gosocks5.Succeeded {
+		return nil, replyError(reply.Rep)
+	}
+	return reply, nil
+}
+
+// readReply reads exactly one reply, gosocks5.ReadReply may consume data sent right after it.
+func readReply(r io.Reader) (*gosocks5.Reply, error) {
+	var b [262]byte
+	if _, err := io.ReadFull(r, b[:5]); err != nil {
+		return nil, err
+	}
+
+	length := 0
+	switch b[3] {
+	case gosocks5.AddrIPv4:
+		length = 10
+	case gosocks5.AddrIPv6:
+		length = 22
+	case gosocks5.AddrDomain:
+		length = 7 + int(b[4])
+	default:
+		return nil, gosocks5.ErrBadAddrType
+	}
+	if _, err := io.ReadFull(r, b[5:length]); err != nil {
+		return nil, err
+	}
+	return gosocks5.ReadReply(bytes.NewReader(b[:length]))
+}
+
+// targetAddr returns the destination sent to the proxy, hostnames are resolved
+// locally unless the proxy resolves them.
+func (c *socks5Connector) targetAddr(ctx context.Context, network, address string) (*gosocks5.Addr, error) {
+	addr, err := gosocks5.NewAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if c.remoteDNS || addr.Type != gosocks5.AddrDomain {
+		return addr, nil
+	}
+
+	ipNetwork := "ip"
+	switch {
+	case strings.HasSuffix(network, "4"):
+		ipNetwork = "ip4"
+	case strings.HasSuffix(network, "6"):
+		ipNetwork = "ip6"
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNetwork, addr.Host)
+	if err != nil {
+		return nil, err
+	}
+	return gosocks5.NewAddr(net.JoinHostPort(ips[0].String(), strconv.Itoa(int(addr.Port))))
+}
+
+// replyError translates a refusal of the proxy, the codes match the ones of the http connector.
+func replyError(rep uint8) error {
+	switch rep {
+	case gosocks5.NotAllowed:
+		return &connector.ProxyError{StatusCode: http.StatusForbidden, Status: "403 connection not allowed by ruleset"}
+	case gosocks5.NetUnreachable:
+		return &connector.ProxyError{StatusCode: http.StatusBadGateway, Status: "502 network unreachable"}
+	case gosocks5.HostUnreachable:
+		return &connector.ProxyError{StatusCode: http.StatusBadGateway, Status: "502 host unreachable"}
+	case gosocks5.ConnRefused:
+		return &connector.ProxyError{StatusCode: http.StatusBadGateway, Status: "502 connection refused"}
+	case gosocks5.TTLExpired:
+		return &connector.ProxyError{StatusCode: http.StatusGatewayTimeout, Status: "504 TTL expired"}
+	}
+	return &connector.ProxyError{StatusCode: http.StatusBadGateway, Status: fmt.Sprintf("502 SOCKS5 reply %d", rep)}
+}
@@ -0,0 +1,36 @@
+package v5
+
+import (
+	"time"
+
+	mdata "proxy_forwarder/gost/core/metadata"
+	mdutil "proxy_forwarder/gost/core/metadata/util"
+)
+
+const (
+	defaultUDPBufferSize = 4096
+)
+
+type metadata struct {
+	connectTimeout time.Duration
+	remoteDNS      bool
+	udpBufferSize  int
+}
+
+func (c *socks5Connector) parseMetadata(md mdata.Metadata) (err error) {
+	const (
+		connectTimeout = "timeout"
+		remoteDNS      = "remoteDNS"
+		udpBufferSize  = "udpBufferSize"
+	)
+
+	c.md.connectTimeout = mdutil.GetDuration(md, connectTimeout)
+	c.md.remoteDNS = mdutil.GetBool(md, remoteDNS)
+
+	c.md.udpBufferSize = mdutil.GetInt(md, udpBufferSize)
+	if c.md.udpBufferSize <= 0 {
+		c.md.udpBufferSize = defaultUDPBufferSize
+	}
+
+	return
+}
@@ -0,0 +1,107 @@
+package http2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	errStreamOnly = errors.New("http2: the connection only carries HTTP/2 streams")
+)
+
+type session struct {
+	// the proxy address, with the client if the connection announces it
+	key  string
+	cc   *http2.ClientConn
+	conn net.Conn
+	// streams in use or reserved and the timer closing the idle connection,
+	// guarded by the mutex of the dialer
+	streams   int
+	idleTimer *time.Timer
+}
+
+// sessionConn is a reserved stream on an HTTP/2 connection to the proxy. It is not a
+// byte stream itself, the connector opens the stream by RoundTrip and closes the
+// connection to release the slot when the stream is done.
+type sessionConn struct {
+	session   *session
+	dialer    *http2Dialer
+	closeOnce sync.Once
+
+	// the deadlines apply to opening the stream, the connector sets the
+	// deadlines of the stream itself on the returned connection
+	mu        sync.Mutex
+	rDeadline time.Time
+	wDeadline time.Time
+}
+
+func (c *sessionConn) RoundTrip(req *http.Request) (*http.Response, error) {
+	return c.session.cc.RoundTrip(req)
+}
+
+// Ping checks the HTTP/2 connection with a PING frame, the health checks use it
+// as reserving a stream on an existing connection does not reach the proxy.
+func (c *sessionConn) Ping(ctx context.Context) error {
+	return c.session.cc.Ping(ctx)
+}
+
+func (c *sessionConn) Read(b []byte) (n int, err error) {
+	return 0, errStreamOnly
+}
+
+func (c *sessionConn) Write(b []byte) (n int, err error) {
+	return 0, errStreamOnly
+}
+
+// Close releases the stream slot, the HTTP/2 connection is kept.
+func (c *sessionConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.dialer.release(c.session)
+	})
+	return nil
+}
+
+func (c *sessionConn) LocalAddr() net.Addr {
+	return c.session.conn.LocalAddr()
+}
+
+func (c *sessionConn) RemoteAddr() net.Addr {
+	return c.session.conn.RemoteAddr()
+}
+
+func (c *sessionConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rDeadline, c.wDeadline = t, t
+	return nil
+}
+
+func (c *sessionConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rDeadline = t
+	return nil
+}
+
+func (c *sessionConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.wDeadline = t
+	return nil
+}
+
+// Deadline returns the earlier of the read and write deadline, zero if none is set.
+func (c *sessionConn) Deadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rDeadline.IsZero() || (!c.wDeadline.IsZero() && c.wDeadline.Before(c.rDeadline)) {
+		return c.wDeadline
+	}
+	return c.rDeadline
+}
@@ -0,0 +1,263 @@
+package http2
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/dialer"
+	md "proxy_forwarder/gost/core/metadata"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/net/proxyproto"
+	"proxy_forwarder/gost/x/registry"
+	"proxy_forwarder/log"
+
+	"golang.org/x/net/http2"
+)
+
+var (
+	errNoTLSConfig = errors.New("http2: no TLS config")
+)
+
+func init() {
+	registry.DialerRegistry().Register("h2", NewDialer)
+	registry.DialerRegistry().Register("http2", NewDialer)
+}
+
+// http2Dialer keeps a few HTTP/2 connections per proxy, the flows are carried as
+// CONNECT streams over them. If the proxy does not negotiate h2 the TLS connection
+// is used for HTTP/1.1.
+type http2Dialer struct {
+	md       metadata
+	options  dialer.Options
+	mu       sync.Mutex
+	sessions map[string][]*session
+	// connections being established, closed when done
+	dialing map[string]chan struct{}
+	// proxies that did not negotiate h2
+	http1 map[string]bool
+}
+
+func NewDialer(opts ...dialer.Option) dialer.Dialer {
+	options := dialer.Options{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &http2Dialer{
+		options:  options,
+		sessions: make(map[string][]*session),
+		dialing:  make(map[string]chan struct{}),
+		http1:    make(map[string]bool),
+	}
+}
+
+func (d *http2Dialer) Init(md md.Metadata) (err error) {
+	return d.parseMetadata(md)
+}
+
+// Multiplex implements dialer.Multiplexer interface.
+func (d *http2Dialer) Multiplex() bool {
+	return true
+}
+
+func (d *http2Dialer) Dial(ctx context.Context, addr string, opts ...dialer.DialOption) (net.Conn, error) {
+	key := d.sessionKey(ctx, addr)
+
+	// concurrent flows wait for the connection being established instead of opening their own
+	var own chan struct{}
+	for {
+		conn, wait, ch := d.reserve(key, addr)
+		if conn != nil {
+			return conn, nil
+		}
+		if wait == nil {
+			own = ch
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if own != nil {
+		defer d.dialed(key, own)
+	}
+
+	var options dialer.DialOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	conn, err := options.NetDialer.Dial(ctx, "tcp", addr)
+	if err != nil {
+		log.Error("dialer", err)
+		return nil, err
+	}
+
+	// the header is sent in plain, before the TLS handshake
+	pc, err := proxyproto.WrapClientConn(d.options.ProxyProtocol,
+		xctx.SrcAddrFromContext(ctx), xctx.DstAddrFromContext(ctx), conn)
+	if err != nil {
+		conn.Close()
+		log.Error("dialer", err)
+		return nil, err
+	}
+
+	tlsConn, err := d.handshake(ctx, pc)
+	if err != nil {
+		conn.Close()
+		log.Error("dialer", err)
+		return nil, err
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		log.Debug("dialer", fmt.Sprintf("%s did not negotiate h2, using HTTP/1.1", addr))
+		d.mu.Lock()
+		d.http1[addr] = true
+		d.mu.Unlock()
+		return tlsConn, nil
+	}
+
+	tr := &http2.Transport{
+		ReadIdleTimeout: d.md.pingInterval,
+		PingTimeout:     d.md.pingTimeout,
+	}
+	cc, err := tr.NewClientConn(tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		log.Error("dialer", err)
+		return nil, err
+	}
+
+	s := &session{
+		key:  key,
+		cc:   cc,
+		conn: tlsConn,
+	}
+	d.mu.Lock()
+	d.sessions[key] = append(d.sessions[key], s)
+	delete(d.http1, addr)
+	s.streams++
+	d.mu.Unlock()
+
+	log.Debug("dialer", fmt.Sprintf("new HTTP/2 connection to %s", addr))
+	return &sessionConn{session: s, dialer: d}, nil
+}
+
+// reserve returns a stream slot on an existing connection of key to addr. If all are busy and
+// a connection is being established, the wait channel is closed when it is done. Otherwise
+// the caller establishes the next connection and closes own by dialed.
+func (d *http2Dialer) reserve(key, addr string) (conn net.Conn, wait, own chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, s := range d.sessions[key] {
+		if !s.cc.CanTakeNewRequest() {
+			// closed, going away or at the stream limit of the proxy
+			if s.streams == 0 {
+				d.remove(s)
+			}
+			continue
+		}
+		if s.streams < d.md.maxStreams {
+			if s.idleTimer != nil {
+				s.idleTimer.Stop()
+			}
+			s.streams++
+			return &sessionConn{session: s, dialer: d}, nil, nil
+		}
+	}
+
+	if d.http1[addr] {
+		// connections to HTTP/1.1 proxies are not shared
+		return nil, nil, nil
+	}
+	if wait := d.dialing[key]; wait != nil {
+		return nil, wait, nil
+	}
+	own = make(chan struct{})
+	d.dialing[key] = own
+	return nil, nil, own
+}
+
+// dialed wakes up the flows waiting for the connection of key.
+func (d *http2Dialer) dialed(key string, own chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	close(own)
+	if d.dialing[key] == own {
+		delete(d.dialing, key)
+	}
+}
+
+// sessionKey returns the key of the connections to addr a flow may share. With the PROXY
+// protocol the connections announce a client, they are only shared by its flows.
+func (d *http2Dialer) sessionKey(ctx context.Context, addr string) string {
+	if d.options.ProxyProtocol <= 0 {
+		return addr
+	}
+	if src := xctx.SrcAddrFromContext(ctx); src != nil {
+		host, _, _ := net.SplitHostPort(src.String())
+		return addr + "|" + host
+	}
+	return addr
+}
+
+func (d *http2Dialer) release(s *session) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s.streams--
+	if s.streams > 0 {
+		return
+	}
+	s.idleTimer = time.AfterFunc(d.md.idleTimeout, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if s.streams == 0 {
+			d.remove(s)
+		}
+	})
+}
+
+// remove closes an unused connection, the lock must be held.
+func (d *http2Dialer) remove(s *session) {
+	s.cc.Close()
+
+	var sessions []*session
+	for _, v := range d.sessions[s.key] {
+		if v != s {
+			sessions = append(sessions, v)
+		}
+	}
+	if len(sessions) == 0 {
+		delete(d.sessions, s.key)
+	} else {
+		d.sessions[s.key] = sessions
+	}
+}
+
+func (d *http2Dialer) handshake(ctx context.Context, conn net.Conn) (*tls.Conn, error) {
+	if d.md.handshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(d.md.handshakeTimeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	if d.options.TLSConfig == nil {
+		return nil, errNoTLSConfig
+	}
+	cfg := d.options.TLSConfig.Clone()
+	cfg.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
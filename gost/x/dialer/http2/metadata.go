@@ -0,0 +1,51 @@
+package http2
+
+import (
+	"time"
+
+	mdata "proxy_forwarder/gost/core/metadata"
+	mdutil "proxy_forwarder/gost/core/metadata/util"
+)
+
+const (
+	defaultMaxStreams   = 100
+	defaultIdleTimeout  = 10 * time.Minute
+	defaultPingInterval = 30 * time.Second
+	defaultPingTimeout  = 15 * time.Second
+)
+
+type metadata struct {
+	handshakeTimeout time.Duration
+	// streams per connection, more connections are opened if all are busy
+	maxStreams   int
+	idleTimeout  time.Duration
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+}
+
+func (d *http2Dialer) parseMetadata(md mdata.Metadata) (err error) {
+	const (
+		handshakeTimeout = "handshakeTimeout"
+		maxStreams       = "h2.maxStreams"
+		idleTimeout      = "h2.idleTimeout"
+		pingInterval     = "h2.pingInterval"
+	)
+
+	d.md.handshakeTimeout = mdutil.GetDuration(md, handshakeTimeout)
+
+	d.md.maxStreams = mdutil.GetInt(md, maxStreams)
+	if d.md.maxStreams <= 0 {
+		d.md.maxStreams = defaultMaxStreams
+	}
+	d.md.idleTimeout = mdutil.GetDuration(md, idleTimeout)
+	if d.md.idleTimeout <= 0 {
+		d.md.idleTimeout = defaultIdleTimeout
+	}
+	d.md.pingInterval = mdutil.GetDuration(md, pingInterval)
+	if d.md.pingInterval <= 0 {
+		d.md.pingInterval = defaultPingInterval
+	}
+	d.md.pingTimeout = defaultPingTimeout
+
+	return
+}
@@ -7,6 +7,8 @@ import (
 	"proxy_forwarder/gost/core/dialer"
 	"proxy_forwarder/gost/core/logger"
 	md "proxy_forwarder/gost/core/metadata"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/net/proxyproto"
 	"proxy_forwarder/gost/x/registry"
 	"proxy_forwarder/log"
 )
@@ -16,18 +18,20 @@ func init() {
 }
 
 type tcpDialer struct {
-	md     metadata
-	logger logger.Logger
+	md      metadata
+	logger  logger.Logger
+	options dialer.Options
 }
 
 func NewDialer(opts ...dialer.Option) dialer.Dialer {
-	options := &dialer.Options{}
+	options := dialer.Options{}
 	for _, opt := range opts {
-		opt(options)
+		opt(&options)
 	}
 
 	return &tcpDialer{
-		logger: options.Logger,
+		logger:  options.Logger,
+		options: options,
 	}
 }
 
@@ -44,6 +48,16 @@ func (d *tcpDialer) Dial(ctx context.Context, addr string, opts ...dialer.DialOp
 	conn, err := options.NetDialer.Dial(ctx, "tcp", addr)
 	if err != nil {
 		log.Error("dialer", err)
+		return nil, err
+	}
+
+	// the client is announced to the proxy before anything else is sent
+	cc, err := proxyproto.WrapClientConn(d.options.ProxyProtocol,
+		xctx.SrcAddrFromContext(ctx), xctx.DstAddrFromContext(ctx), conn)
+	if err != nil {
+		conn.Close()
+		log.Error("dialer", err)
+		return nil, err
 	}
-	return conn, err
+	return cc, nil
 }
@@ -9,6 +9,8 @@ import (
 	"proxy_forwarder/gost/core/dialer"
 	"proxy_forwarder/gost/core/logger"
 	md "proxy_forwarder/gost/core/metadata"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/net/proxyproto"
 	"proxy_forwarder/gost/x/registry"
 )
 
@@ -47,8 +49,18 @@ func (d *tlsDialer) Dial(ctx context.Context, addr string, opts ...dialer.DialOp
 	conn, err := options.NetDialer.Dial(ctx, "tcp", addr)
 	if err != nil {
 		d.logger.Error(err)
+		return nil, err
+	}
+
+	// the header is sent in plain, before the TLS handshake
+	cc, err := proxyproto.WrapClientConn(d.options.ProxyProtocol,
+		xctx.SrcAddrFromContext(ctx), xctx.DstAddrFromContext(ctx), conn)
+	if err != nil {
+		conn.Close()
+		d.logger.Error(err)
+		return nil, err
 	}
-	return conn, err
+	return cc, nil
 }
 
 // Handshake implements dialer.Handshaker
@@ -0,0 +1,235 @@
+package dnssnoop
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/log"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// clients keep using answers for a while after their TTL expired
+	DefaultGrace      = 5 * time.Minute
+	DefaultMaxEntries = 65536
+
+	sweepInterval = time.Minute
+	maxCNAMEChain = 8
+)
+
+// record is a name an address was resolved for.
+type record struct {
+	name    string
+	client  string
+	seen    time.Time
+	expires time.Time
+}
+
+type options struct {
+	grace      time.Duration
+	maxEntries int
+}
+
+type Option func(opts *options)
+
+// GraceOption sets how long the answers are kept after their TTL expired.
+func GraceOption(grace time.Duration) Option {
+	return func(opts *options) {
+		opts.grace = grace
+	}
+}
+
+// MaxEntriesOption limits the number of addresses kept.
+func MaxEntriesOption(n int) Option {
+	return func(opts *options) {
+		opts.maxEntries = n
+	}
+}
+
+// Cache maps the addresses of observed DNS answers back to the names the clients resolved.
+type Cache struct {
+	mu      sync.Mutex
+	byIP    map[string][]*record
+	options options
+}
+
+func NewCache(opts ...Option) *Cache {
+	var options options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.grace < 0 {
+		options.grace = 0
+	} else if options.grace == 0 {
+		options.grace = DefaultGrace
+	}
+	if options.maxEntries <= 0 {
+		options.maxEntries = DefaultMaxEntries
+	}
+
+	c := &Cache{
+		byIP:    make(map[string][]*record),
+		options: options,
+	}
+	go c.periodSweep()
+	return c
+}
+
+// Observe records the A and AAAA answers of the message the client received.
+// Addresses reached through CNAMEs are recorded for the name the client asked for.
+func (c *Cache) Observe(client net.IP, m *dns.Msg) {
+	if m == nil || !m.Response || m.Rcode != dns.RcodeSuccess || len(m.Question) != 1 {
+		return
+	}
+	qname := strings.ToLower(strings.TrimSuffix(m.Question[0].Name, "."))
+
+	// owner names reachable from the question by CNAMEs
+	aliases := map[string]bool{dns.CanonicalName(m.Question[0].Name): true}
+	for i := 0; i < maxCNAMEChain; i++ {
+		added := false
+		for _, rr := range m.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok &&
+				aliases[dns.CanonicalName(cname.Hdr.Name)] && !aliases[dns.CanonicalName(cname.Target)] {
+				aliases[dns.CanonicalName(cname.Target)] = true
+				added = true
+			}
+		}
+		if !added {
+			break
+		}
+	}
+
+	now := time.Now()
+	clientKey := ""
+	if client != nil {
+		clientKey = client.String()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, rr := range m.Answer {
+		var ip net.IP
+		switch v := rr.(type) {
+		case *dns.A:
+			ip = v.A
+		case *dns.AAAA:
+			ip = v.AAAA
+		default:
+			continue
+		}
+
+		name := qname
+		if owner := dns.CanonicalName(rr.Header().Name); !aliases[owner] {
+			name = strings.TrimSuffix(owner, ".")
+		}
+		c.add(ip.String(), &record{
+			name:    name,
+			client:  clientKey,
+			seen:    now,
+			expires: now.Add(time.Duration(rr.Header().Ttl)*time.Second + c.options.grace),
+		})
+	}
+}
+
+// add stores the record, the caller has to hold the lock.
+func (c *Cache) add(ip string, r *record) {
+	records := c.byIP[ip]
+	for i, v := range records {
+		if v.name == r.name && v.client == r.client {
+			records[i] = r
+			return
+		}
+	}
+
+	if len(records) == 0 && len(c.byIP) >= c.options.maxEntries {
+		c.sweep(time.Now())
+		if len(c.byIP) >= c.options.maxEntries {
+			return
+		}
+	}
+	c.byIP[ip] = append(records, r)
+}
+
+// Lookup returns the name the address was resolved for. If several names resolve to it,
+// the most recent answer the client received wins, then the most recent answer of any client.
+// Remaining ties are broken by the name. The number of distinct names is returned as well.
+func (c *Cache) Lookup(client, ip net.IP) (name string, names int) {
+	if ip == nil {
+		return
+	}
+	clientKey := ""
+	if client != nil {
+		clientKey = client.String()
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	var candidates []record
+	for _, r := range c.byIP[ip.String()] {
+		if now.Before(r.expires) {
+			candidates = append(candidates, *r)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return
+	}
+
+	distinct := make(map[string]bool)
+	for _, r := range candidates {
+		distinct[r.name] = true
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		ci, cj := candidates[i].client == clientKey, candidates[j].client == clientKey
+		if ci != cj {
+			return ci
+		}
+		if !candidates[i].seen.Equal(candidates[j].seen) {
+			return candidates[i].seen.After(candidates[j].seen)
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	name, names = candidates[0].name, len(distinct)
+	if names > 1 {
+		log.Debug("dnssnoop", fmt.Sprintf("%s is known as %d names, using %s", ip, names, name))
+	}
+	return
+}
+
+func (c *Cache) periodSweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.mu.Lock()
+		c.sweep(time.Now())
+		c.mu.Unlock()
+	}
+}
+
+// sweep drops the expired records, the caller has to hold the lock.
+func (c *Cache) sweep(now time.Time) {
+	for ip, records := range c.byIP {
+		n := 0
+		for _, r := range records {
+			if now.Before(r.expires) {
+				records[n] = r
+				n++
+			}
+		}
+		if n == 0 {
+			delete(c.byIP, ip)
+		} else {
+			c.byIP[ip] = records[:n]
+		}
+	}
+}
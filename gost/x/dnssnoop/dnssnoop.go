@@ -0,0 +1,46 @@
+package dnssnoop
+
+import (
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	global   *Cache
+	globalMu sync.Mutex
+)
+
+// Setup creates the cache shared by all services, later calls return the existing cache.
+func Setup(opts ...Option) *Cache {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	if global == nil {
+		global = NewCache(opts...)
+	}
+	return global
+}
+
+// Default returns the shared cache, nil if snooping is disabled.
+func Default() *Cache {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	return global
+}
+
+// ObserveRaw records the answers of the DNS message b if snooping is enabled.
+func ObserveRaw(client net.IP, b []byte) {
+	c := Default()
+	if c == nil {
+		return
+	}
+
+	m := &dns.Msg{}
+	if err := m.Unpack(b); err != nil {
+		return
+	}
+	c.Observe(client, m)
+}
@@ -0,0 +1,94 @@
+package fakeip
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+var (
+	global   *Pool
+	globalMu sync.Mutex
+)
+
+// Setup creates the pool shared by all services, later calls return the existing pool.
+func Setup(opts ...Option) (*Pool, error) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	if global != nil {
+		return global, nil
+	}
+
+	p, err := NewPool(opts...)
+	if err != nil {
+		return nil, err
+	}
+	global = p
+	return p, nil
+}
+
+// Default returns the shared pool, nil if fake-ip is disabled.
+func Default() *Pool {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	return global
+}
+
+// Handler serves the mappings of the shared pool for debugging.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := Default()
+		if p == nil {
+			http.Error(w, "fake-ip is disabled", http.StatusNotFound)
+			return
+		}
+		p.ServeHTTP(w, r)
+	})
+}
+
+// Addr is the destination of a connection to a fake address.
+type Addr struct {
+	Net  string
+	Host string
+	Port int
+}
+
+func (a *Addr) Network() string {
+	return a.Net
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// ResolveAddr returns the hostname destination if addr is a fake address of the shared pool.
+func ResolveAddr(addr net.Addr) (net.Addr, bool) {
+	p := Default()
+	if p == nil {
+		return addr, false
+	}
+
+	var ip net.IP
+	var port int
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	default:
+		return addr, false
+	}
+
+	host, ok := p.Lookup(ip)
+	if !ok {
+		return addr, false
+	}
+	return &Addr{
+		Net:  addr.Network(),
+		Host: host,
+		Port: port,
+	}, true
+}
@@ -0,0 +1,358 @@
+package fakeip
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"proxy_forwarder/log"
+)
+
+const (
+	DefaultRange4 = "198.18.0.0/15"
+	DefaultRange6 = "fdfe:dcba:9876::/64"
+	DefaultTTL    = time.Hour
+	DefaultSize   = 65536
+
+	saveInterval = 10 * time.Second
+)
+
+var (
+	ErrPoolExhausted = errors.New("fake-ip pool exhausted")
+)
+
+// Entry maps a fake address to the hostname it was handed out for.
+type Entry struct {
+	Host    string    `json:"host"`
+	IP      net.IP    `json:"ip"`
+	Expires time.Time `json:"expires"`
+}
+
+type options struct {
+	range4 *net.IPNet
+	range6 *net.IPNet
+	ttl    time.Duration
+	size   int
+	file   string
+}
+
+type Option func(opts *options)
+
+func Range4Option(n *net.IPNet) Option {
+	return func(opts *options) {
+		opts.range4 = n
+	}
+}
+
+func Range6Option(n *net.IPNet) Option {
+	return func(opts *options) {
+		opts.range6 = n
+	}
+}
+
+// TTLOption sets how long a mapping is kept after it was last used.
+func TTLOption(ttl time.Duration) Option {
+	return func(opts *options) {
+		opts.ttl = ttl
+	}
+}
+
+// SizeOption limits the number of addresses used from each range.
+func SizeOption(size int) Option {
+	return func(opts *options) {
+		opts.size = size
+	}
+}
+
+// FileOption sets the file the mappings are persisted to.
+func FileOption(file string) Option {
+	return func(opts *options) {
+		opts.file = file
+	}
+}
+
+// block is the part of a range addresses are handed out from, addressed by their offset to the network address.
+type block struct {
+	network  *net.IPNet
+	size     uint64
+	cursor   uint64
+	byOffset map[uint64]*Entry
+	byHost   map[string]*Entry
+}
+
+func newBlock(network *net.IPNet, limit int) *block {
+	ones, bits := network.Mask.Size()
+	size := uint64(limit)
+	if hostBits := bits - ones; hostBits < 32 {
+		// neither the network nor the broadcast address are handed out
+		if n := uint64(1)<<hostBits - 2; n < size {
+			size = n
+		}
+	}
+	return &block{
+		network:  network,
+		size:     size,
+		byOffset: make(map[uint64]*Entry),
+		byHost:   make(map[string]*Entry),
+	}
+}
+
+func (b *block) ip(offset uint64) net.IP {
+	ip := make(net.IP, len(b.network.IP))
+	copy(ip, b.network.IP)
+	tail := ip
+	if len(ip) > 8 {
+		tail = ip[len(ip)-8:]
+	}
+	v := uint64(0)
+	for _, c := range tail {
+		v = v<<8 | uint64(c)
+	}
+	v += offset
+	for i := len(tail) - 1; i >= 0; i-- {
+		tail[i] = byte(v)
+		v >>= 8
+	}
+	return ip
+}
+
+func (b *block) offset(ip net.IP) uint64 {
+	n := len(b.network.IP)
+	if n == net.IPv4len {
+		return uint64(binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(b.network.IP))
+	}
+	return binary.BigEndian.Uint64(ip.To16()[8:]) - binary.BigEndian.Uint64(b.network.IP[8:])
+}
+
+func (b *block) add(e *Entry) {
+	b.byOffset[b.offset(e.IP)] = e
+	b.byHost[e.Host] = e
+}
+
+// Pool hands out fake addresses for hostnames and resolves them back.
+type Pool struct {
+	mu      sync.Mutex
+	v4      *block
+	v6      *block
+	dirty   bool
+	options options
+}
+
+func NewPool(opts ...Option) (*Pool, error) {
+	var options options
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if options.range4 == nil {
+		_, options.range4, _ = net.ParseCIDR(DefaultRange4)
+	}
+	if options.range6 == nil {
+		_, options.range6, _ = net.ParseCIDR(DefaultRange6)
+	}
+	if options.range4.IP.To4() == nil || options.range6.IP.To4() != nil {
+		return nil, errors.New("fake-ip ranges have to be an IPv4 and an IPv6 network")
+	}
+	options.range4.IP = options.range4.IP.To4()
+	if options.ttl <= 0 {
+		options.ttl = DefaultTTL
+	}
+	if options.size <= 0 {
+		options.size = DefaultSize
+	}
+
+	p := &Pool{
+		v4:      newBlock(options.range4, options.size),
+		v6:      newBlock(options.range6, options.size),
+		options: options,
+	}
+
+	if options.file != "" {
+		if err := p.load(); err != nil && !os.IsNotExist(err) {
+			log.Warn("fakeip", fmt.Sprintf("loading %s: %v", options.file, err))
+		}
+		go p.periodSave()
+	}
+
+	return p, nil
+}
+
+func (p *Pool) block(ip net.IP) *block {
+	if p.v4.network.Contains(ip) {
+		return p.v4
+	}
+	if p.v6.network.Contains(ip) {
+		return p.v6
+	}
+	return nil
+}
+
+// Allocate returns the fake address of the host, a new one is assigned if there is none yet.
+// Addresses of expired mappings are reused once the range is used up.
+func (p *Pool) Allocate(host string, ipv6 bool) (net.IP, error) {
+	b := p.v4
+	if ipv6 {
+		b = p.v6
+	}
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e := b.byHost[host]; e != nil {
+		e.Expires = now.Add(p.options.ttl)
+		return e.IP, nil
+	}
+
+	for i := uint64(0); i < b.size; i++ {
+		b.cursor = b.cursor%b.size + 1
+		if e := b.byOffset[b.cursor]; e != nil {
+			if now.Before(e.Expires) {
+				continue
+			}
+			delete(b.byHost, e.Host)
+		}
+
+		e := &Entry{
+			Host:    host,
+			IP:      b.ip(b.cursor),
+			Expires: now.Add(p.options.ttl),
+		}
+		b.add(e)
+		p.dirty = true
+		return e.IP, nil
+	}
+
+	return nil, ErrPoolExhausted
+}
+
+// Lookup returns the host the fake address was handed out for.
+func (p *Pool) Lookup(ip net.IP) (host string, ok bool) {
+	b := p.block(ip)
+	if b == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := b.byOffset[b.offset(ip)]
+	if e == nil {
+		return
+	}
+	e.Expires = time.Now().Add(p.options.ttl)
+	return e.Host, true
+}
+
+// Contains reports whether the address is part of the fake ranges.
+func (p *Pool) Contains(ip net.IP) bool {
+	return p.block(ip) != nil
+}
+
+// Entries returns a snapshot of the mappings sorted by host.
+func (p *Pool) Entries() []Entry {
+	p.mu.Lock()
+	entries := make([]Entry, 0, len(p.v4.byOffset)+len(p.v6.byOffset))
+	for _, b := range []*block{p.v4, p.v6} {
+		for _, e := range b.byOffset {
+			entries = append(entries, *e)
+		}
+	}
+	p.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Host != entries[j].Host {
+			return entries[i].Host < entries[j].Host
+		}
+		return len(entries[i].IP) < len(entries[j].IP)
+	})
+	return entries
+}
+
+// ServeHTTP writes the mappings as JSON.
+func (p *Pool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(p.Entries())
+}
+
+func (p *Pool) load() error {
+	f, err := os.Open(p.options.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range entries {
+		e := &entries[i]
+		if e.Host == "" || now.After(e.Expires) {
+			continue
+		}
+		// mappings outside of the configured ranges are dropped
+		if b := p.block(e.IP); b != nil {
+			if off := b.offset(e.IP); off >= 1 && off <= b.size {
+				if ip4 := e.IP.To4(); ip4 != nil {
+					e.IP = ip4
+				}
+				b.add(e)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Pool) periodSave() {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := p.Save(); err != nil {
+			log.Warn("fakeip", fmt.Sprintf("saving %s: %v", p.options.file, err))
+		}
+	}
+}
+
+// Save writes the mappings to the file if they changed since the last save.
+func (p *Pool) Save() error {
+	if p.options.file == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	dirty := p.dirty
+	p.dirty = false
+	p.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	b, err := json.Marshal(p.Entries())
+	if err != nil {
+		return err
+	}
+
+	// replace the file at once so a crash does not leave a partial file behind
+	tmp := p.options.file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.options.file)
+}
@@ -0,0 +1,386 @@
+package redirect
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/chain"
+	"proxy_forwarder/gost/core/common/bufpool"
+	"proxy_forwarder/gost/core/handler"
+	"proxy_forwarder/gost/core/hosts"
+	"proxy_forwarder/gost/core/logger"
+	md "proxy_forwarder/gost/core/metadata"
+	"proxy_forwarder/gost/x/dnssnoop"
+	"proxy_forwarder/gost/x/fakeip"
+	resolver_util "proxy_forwarder/gost/x/internal/util/resolver"
+	"proxy_forwarder/gost/x/registry"
+	"proxy_forwarder/gost/x/resolver/exchanger"
+	"proxy_forwarder/log"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultStaticTTL = 60 * time.Second
+	maxMessageSize   = 65535
+	// fake addresses are cheap to hand out again, clients should not keep them around
+	fakeIPAnswerTTL = 1
+)
+
+func init() {
+	registry.HandlerRegistry().Register("redns", NewHandler)
+}
+
+// upstream is a name server used for the queries of a domain and its subdomains.
+type upstream struct {
+	domain    string
+	exchanger exchanger.Exchanger
+}
+
+type dnsHandler struct {
+	router     *chain.Router
+	hostMapper hosts.HostMapper
+	cache      *resolver_util.Cache
+	logger     logger.Logger
+	upstreams  []upstream
+	fallback   exchanger.Exchanger
+	fakeIP     *fakeip.Pool
+	// exchangers for the original destinations if no upstream is configured
+	dstExchangers sync.Map
+	md            metadata
+	options       handler.Options
+}
+
+func NewHandler(opts ...handler.Option) handler.Handler {
+	options := handler.Options{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return &dnsHandler{
+		options: options,
+	}
+}
+
+func (h *dnsHandler) Init(md md.Metadata) (err error) {
+	if err = h.parseMetadata(md); err != nil {
+		return
+	}
+
+	h.router = h.options.Router
+	if h.router == nil {
+		h.router = chain.NewRouter()
+	}
+	h.hostMapper = h.router.Options().HostMapper
+
+	h.logger = logger.Default().WithFields(map[string]any{"handler": "redns"})
+	h.cache = resolver_util.NewCache().WithLogger(h.logger).WithMaxSize(h.md.cacheSize)
+
+	if h.md.upstream != "" {
+		if h.fallback, err = h.newExchanger(h.md.upstream); err != nil {
+			return
+		}
+	}
+	if h.md.fakeIP {
+		if h.fakeIP, err = fakeip.Setup(
+			fakeip.Range4Option(h.md.fakeIPRange4),
+			fakeip.Range6Option(h.md.fakeIPRange6),
+			fakeip.TTLOption(h.md.fakeIPTTL),
+			fakeip.SizeOption(h.md.fakeIPSize),
+			fakeip.FileOption(h.md.fakeIPFile),
+		); err != nil {
+			return
+		}
+	}
+
+	for domain, addr := range h.md.upstreams {
+		ex, err := h.newExchanger(addr)
+		if err != nil {
+			return err
+		}
+		h.upstreams = append(h.upstreams, upstream{
+			domain:    domain,
+			exchanger: ex,
+		})
+	}
+
+	return
+}
+
+func (h *dnsHandler) newExchanger(addr string) (exchanger.Exchanger, error) {
+	return exchanger.NewExchanger(addr,
+		exchanger.RouterOption(h.router),
+		exchanger.TimeoutOption(h.md.timeout),
+		exchanger.LoggerOption(h.logger),
+	)
+}
+
+func (h *dnsHandler) Handle(ctx context.Context, conn net.Conn, opts ...handler.HandleOption) error {
+	defer conn.Close()
+	logSrc := conn.LocalAddr().String() + "/" + conn.LocalAddr().Network()
+	logDst := conn.RemoteAddr().String()
+	log.ConnInfo("handler", logSrc, logDst, "red-dns")
+
+	start := time.Now()
+
+	defer func() {
+		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("connection finished after %s", time.Since(start)))
+	}()
+
+	// clients send the queries for A and AAAA records at the same time, they are answered concurrently
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		b := bufpool.Get(maxMessageSize)
+		n, err := conn.Read(*b)
+		if err != nil {
+			bufpool.Put(b)
+			return nil
+		}
+
+		mq := &dns.Msg{}
+		err = mq.Unpack((*b)[:n])
+		bufpool.Put(b)
+		if err != nil {
+			log.ConnError("handler", logSrc, logDst, fmt.Errorf("invalid DNS query: %v", err))
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mr := h.answer(ctx, conn.LocalAddr(), mq, logSrc, logDst)
+			if c := dnssnoop.Default(); c != nil && !h.isFakeIP(mr) {
+				if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+					c.Observe(addr.IP, mr)
+				}
+			}
+			reply, err := mr.Pack()
+			if err != nil {
+				log.ConnError("handler", logSrc, logDst, err)
+				return
+			}
+			if _, err := conn.Write(reply); err != nil {
+				log.ConnError("handler", logSrc, logDst, err)
+			}
+		}()
+	}
+}
+
+func (h *dnsHandler) answer(ctx context.Context, dstAddr net.Addr, mq *dns.Msg, logSrc, logDst string) (mr *dns.Msg) {
+	defer func() {
+		// answers have to fit the buffer of the client
+		size := dns.MinMsgSize
+		if opt := mq.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		mr.Truncate(size)
+	}()
+
+	if len(mq.Question) != 1 {
+		mr = &dns.Msg{}
+		return mr.SetRcode(mq, dns.RcodeFormatError)
+	}
+	q := mq.Question[0]
+	name := strings.TrimSuffix(q.Name, ".")
+
+	if mr = h.lookupStatic(ctx, mq, name); mr != nil {
+		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("static answer for %s", name))
+		return
+	}
+
+	if mr = h.lookupFakeIP(mq, name); mr != nil {
+		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("fake-ip answer for %s", name))
+		return
+	}
+
+	ex, err := h.selectExchanger(name, dstAddr)
+	if err != nil {
+		log.ConnError("handler", logSrc, logDst, err)
+		mr = &dns.Msg{}
+		return mr.SetRcode(mq, dns.RcodeServerFailure)
+	}
+
+	// the answers of different name servers may differ (split-horizon), they are cached apart
+	key := resolver_util.NewCacheKey(&q) + resolver_util.CacheKey("@"+ex.String())
+	if cached, ttl := h.cache.Load(key); ttl > 0 {
+		cached.Id = mq.Id
+		return cached
+	}
+
+	log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("resolving %s %s via %s", name, dns.TypeToString[q.Qtype], ex.String()))
+
+	mr, err = h.exchange(ctx, ex, mq)
+	if err != nil {
+		log.ConnError("handler", logSrc, logDst, fmt.Errorf("resolving %s via %s: %v", name, ex.String(), err))
+		mr = &dns.Msg{}
+		return mr.SetRcode(mq, dns.RcodeServerFailure)
+	}
+
+	if mr.Rcode == dns.RcodeSuccess || mr.Rcode == dns.RcodeNameError {
+		h.cache.Store(key, mr, h.md.ttl)
+	}
+	return
+}
+
+// lookupStatic answers address queries for hosts of the host mapper.
+func (h *dnsHandler) lookupStatic(ctx context.Context, mq *dns.Msg, name string) *dns.Msg {
+	if h.hostMapper == nil {
+		return nil
+	}
+
+	q := mq.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+
+	// hosts without an address of the queried family get an empty answer
+	ips, _ := h.hostMapper.Lookup(ctx, "ip", name)
+	if len(ips) == 0 {
+		return nil
+	}
+
+	ttl := h.md.ttl
+	if ttl <= 0 {
+		ttl = defaultStaticTTL
+	}
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl.Seconds()),
+	}
+
+	mr := &dns.Msg{}
+	mr.SetReply(mq)
+	mr.Authoritative = true
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			mr.Answer = append(mr.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			mr.Answer = append(mr.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return mr
+}
+
+// lookupFakeIP answers address queries with addresses of the fake-ip pool,
+// connections to them are sent to the proxy by hostname.
+func (h *dnsHandler) lookupFakeIP(mq *dns.Msg, name string) *dns.Msg {
+	if h.fakeIP == nil || h.fakeIPExcluded(name) {
+		return nil
+	}
+
+	q := mq.Question[0]
+	mr := &dns.Msg{}
+	mr.SetReply(mq)
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+	case dns.TypeHTTPS, dns.TypeSVCB:
+		// their address hints would bypass the fake addresses
+		return mr
+	default:
+		return nil
+	}
+
+	ip, err := h.fakeIP.Allocate(strings.ToLower(name), q.Qtype == dns.TypeAAAA)
+	if err != nil {
+		log.Warn("handler", fmt.Sprintf("%s: %v", name, err))
+		return nil
+	}
+
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    fakeIPAnswerTTL,
+	}
+	if q.Qtype == dns.TypeA {
+		mr.Answer = append(mr.Answer, &dns.A{Hdr: hdr, A: ip})
+	} else {
+		mr.Answer = append(mr.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return mr
+}
+
+// isFakeIP reports whether the answer holds addresses of the fake-ip pool.
+func (h *dnsHandler) isFakeIP(mr *dns.Msg) bool {
+	if h.fakeIP == nil {
+		return false
+	}
+	for _, rr := range mr.Answer {
+		switch v := rr.(type) {
+		case *dns.A:
+			return h.fakeIP.Contains(v.A)
+		case *dns.AAAA:
+			return h.fakeIP.Contains(v.AAAA)
+		}
+	}
+	return false
+}
+
+func (h *dnsHandler) fakeIPExcluded(name string) bool {
+	name = strings.ToLower(name)
+	for _, domain := range h.md.fakeIPExclude {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectExchanger returns the upstream of the longest matching domain,
+// the configured default or the name server the client sent the query to.
+func (h *dnsHandler) selectExchanger(name string, dstAddr net.Addr) (exchanger.Exchanger, error) {
+	var ex exchanger.Exchanger
+	matched := -1
+	for _, u := range h.upstreams {
+		if (name == u.domain || strings.HasSuffix(name, "."+u.domain)) && len(u.domain) > matched {
+			ex = u.exchanger
+			matched = len(u.domain)
+		}
+	}
+	if ex != nil {
+		return ex, nil
+	}
+	if h.fallback != nil {
+		return h.fallback, nil
+	}
+
+	// the proxy can't carry UDP, the query is sent over TCP
+	addr := "tcp://" + dstAddr.String()
+	if v, ok := h.dstExchangers.Load(addr); ok {
+		return v.(exchanger.Exchanger), nil
+	}
+	ex, err := h.newExchanger(addr)
+	if err != nil {
+		return nil, err
+	}
+	v, _ := h.dstExchangers.LoadOrStore(addr, ex)
+	return v.(exchanger.Exchanger), nil
+}
+
+func (h *dnsHandler) exchange(ctx context.Context, ex exchanger.Exchanger, mq *dns.Msg) (*dns.Msg, error) {
+	query, err := mq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := ex.Exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	mr := &dns.Msg{}
+	if err := mr.Unpack(reply); err != nil {
+		return nil, err
+	}
+	mr.Id = mq.Id
+	return mr, nil
+}
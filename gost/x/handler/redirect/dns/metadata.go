@@ -0,0 +1,102 @@
+package redirect
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	mdata "proxy_forwarder/gost/core/metadata"
+	mdutil "proxy_forwarder/gost/core/metadata/util"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+)
+
+type metadata struct {
+	upstream  string
+	upstreams map[string]string
+	ttl       time.Duration
+	timeout   time.Duration
+	cacheSize int
+
+	fakeIP        bool
+	fakeIPRange4  *net.IPNet
+	fakeIPRange6  *net.IPNet
+	fakeIPTTL     time.Duration
+	fakeIPSize    int
+	fakeIPFile    string
+	fakeIPExclude []string
+}
+
+func (h *dnsHandler) parseMetadata(md mdata.Metadata) (err error) {
+	const (
+		upstream  = "dns.upstream"
+		upstreams = "dns.upstreams"
+		ttl       = "dns.ttl"
+		timeout   = "dns.timeout"
+		cacheSize = "dns.cacheSize"
+
+		fakeIP        = "fakeip"
+		fakeIPRange4  = "fakeip.range4"
+		fakeIPRange6  = "fakeip.range6"
+		fakeIPTTL     = "fakeip.ttl"
+		fakeIPSize    = "fakeip.size"
+		fakeIPFile    = "fakeip.file"
+		fakeIPExclude = "fakeip.exclude"
+	)
+
+	h.md.upstream = mdutil.GetString(md, upstream)
+
+	// entries are in the form 'domain=nameserver'
+	h.md.upstreams = make(map[string]string)
+	for _, s := range getStrings(md, upstreams) {
+		domain, addr, ok := strings.Cut(s, "=")
+		domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if !ok || domain == "" || addr == "" {
+			return fmt.Errorf("invalid DNS upstream %q, expected 'domain=nameserver'", s)
+		}
+		h.md.upstreams[domain] = strings.TrimSpace(addr)
+	}
+
+	h.md.ttl = mdutil.GetDuration(md, ttl)
+	h.md.timeout = mdutil.GetDuration(md, timeout)
+	if h.md.timeout <= 0 {
+		h.md.timeout = defaultTimeout
+	}
+	h.md.cacheSize = mdutil.GetInt(md, cacheSize)
+
+	h.md.fakeIP = mdutil.GetBool(md, fakeIP)
+	if v := mdutil.GetString(md, fakeIPRange4); v != "" {
+		if _, h.md.fakeIPRange4, err = net.ParseCIDR(v); err != nil {
+			return
+		}
+	}
+	if v := mdutil.GetString(md, fakeIPRange6); v != "" {
+		if _, h.md.fakeIPRange6, err = net.ParseCIDR(v); err != nil {
+			return
+		}
+	}
+	h.md.fakeIPTTL = mdutil.GetDuration(md, fakeIPTTL)
+	h.md.fakeIPSize = mdutil.GetInt(md, fakeIPSize)
+	h.md.fakeIPFile = mdutil.GetString(md, fakeIPFile)
+	for _, domain := range getStrings(md, fakeIPExclude) {
+		h.md.fakeIPExclude = append(h.md.fakeIPExclude, strings.Trim(strings.ToLower(domain), "."))
+	}
+
+	return
+}
+
+// getStrings accepts a list or a comma-separated string.
+func getStrings(md mdata.Metadata, key string) (ss []string) {
+	if ss = mdutil.GetStrings(md, key); len(ss) > 0 {
+		return
+	}
+	for _, s := range strings.Split(mdutil.GetString(md, key), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ss = append(ss, s)
+		}
+	}
+	return
+}
@@ -0,0 +1,167 @@
+package redirect
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"proxy_forwarder/gost/core/connector"
+	"proxy_forwarder/gost/core/metrics"
+	"proxy_forwarder/gost/core/sniffer"
+	dissector "proxy_forwarder/gost/tls-dissector"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	xmetrics "proxy_forwarder/gost/x/metrics"
+)
+
+const (
+	denyReasonPolicy   = "policy"
+	denyReasonUpstream = "upstream"
+)
+
+const defaultDenyTemplate = `<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.StatusText}}</h1>
+<p>Access to <b>{{.Host}}</b> was denied: {{.Reason}}.</p>
+<hr>
+<p>Client: {{.Client}}</p>
+</body>
+</html>
+`
+
+var (
+	tlsAlerts = map[string]uint8{
+		"access_denied":     dissector.AlertAccessDenied,
+		"unrecognized_name": dissector.AlertUnrecognizedName,
+	}
+)
+
+type denyPage struct {
+	Status     int
+	StatusText string
+	Host       string
+	Client     string
+	Reason     string
+}
+
+// denied reports whether the destination, the sniffed protocol ('proto:<protocol>') or the
+// TLS fingerprint ('ja3:<md5>', 'ja4:<fingerprint>') of the flow is blocked by the bypass of the service.
+// addr is the address the flow is dialed to and always checked, host is the name the client
+// asked for and checked as well if it is set. A name learned from DNS answers or sent by the client
+// does not exempt the address that is actually dialed.
+func (h *redirectHandler) denied(ctx context.Context, host, addr string) bool {
+	if h.options.Bypass == nil {
+		return false
+	}
+	if addr != "" && h.options.Bypass.Contains(ctx, addr) {
+		return true
+	}
+	if host != "" && hostOnly(host) != hostOnly(addr) && h.options.Bypass.Contains(ctx, host) {
+		return true
+	}
+	if res := sniffer.ResultFromContext(ctx); res != nil &&
+		h.options.Bypass.Contains(ctx, "proto:"+res.Protocol) {
+		return true
+	}
+	if fp := xctx.TLSFingerprintFromContext(ctx); fp != nil &&
+		(h.options.Bypass.Contains(ctx, "ja3:"+fp.JA3) || h.options.Bypass.Contains(ctx, "ja4:"+fp.JA4)) {
+		return true
+	}
+	return false
+}
+
+// hostOnly strips the port of addr if it has one.
+func hostOnly(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// upstreamDenial returns the status code of the upstream proxy if it refused the connection.
+func upstreamDenial(err error) (code int, ok bool) {
+	var perr *connector.ProxyError
+	if !errors.As(err, &perr) {
+		return
+	}
+	return perr.StatusCode, true
+}
+
+// denyHTTP answers a plain HTTP request with an error page rendered from the deny template.
+func (h *redirectHandler) denyHTTP(w io.Writer, status int, host, client, reason string) error {
+	var body bytes.Buffer
+	err := h.md.denyTemplate.Execute(&body, &denyPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Host:       host,
+		Client:     client,
+		Reason:     reason,
+	})
+	if err != nil {
+		return err
+	}
+
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp.Write(w)
+}
+
+// denyTLS aborts the TLS handshake of the client with a fatal alert.
+func (h *redirectHandler) denyTLS(w io.Writer, alert uint8) error {
+	_, err := dissector.NewAlertRecord(dissector.AlertLevelFatal, alert).WriteTo(w)
+	return err
+}
+
+// denyRaw resets the client connection.
+func (h *redirectHandler) denyRaw(conn net.Conn) error {
+	if err := resetConn(conn); err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// upstreamHTTPStatus translates a refusal of the upstream proxy into the status sent to plain HTTP clients.
+func upstreamHTTPStatus(code int) int {
+	switch code {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return http.StatusForbidden
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// upstreamTLSAlert translates a refusal of the upstream proxy into the alert sent to TLS clients.
+// Gateway errors mostly mean that the proxy could not resolve or reach the server name.
+func upstreamTLSAlert(code int) uint8 {
+	switch code {
+	case http.StatusForbidden, http.StatusProxyAuthRequired:
+		return dissector.AlertAccessDenied
+	default:
+		return dissector.AlertUnrecognizedName
+	}
+}
+
+func upstreamReason(code int) string {
+	return fmt.Sprintf("the upstream proxy refused the connection (%d)", code)
+}
+
+func (h *redirectHandler) recordDenied(reason string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceDeniedCounter,
+		metrics.Labels{"service": h.options.Service, "reason": reason}); v != nil {
+		v.Inc()
+	}
+}
@@ -0,0 +1,55 @@
+package redirect
+
+import (
+	"sync"
+
+	"proxy_forwarder/gost/core/metrics"
+	dissector "proxy_forwarder/gost/tls-dissector"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	xmetrics "proxy_forwarder/gost/x/metrics"
+)
+
+const (
+	defaultFingerprintsMetricsLimit = 100
+	fingerprintOther                = "other"
+)
+
+// fingerprintLabels bounds the cardinality of the fingerprint label,
+// fingerprints seen after the limit was reached are counted as 'other'.
+type fingerprintLabels struct {
+	limit int
+	mu    sync.Mutex
+	seen  map[string]struct{}
+}
+
+func (l *fingerprintLabels) label(fp string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.seen[fp]; ok {
+		return fp
+	}
+	if len(l.seen) >= l.limit {
+		return fingerprintOther
+	}
+	if l.seen == nil {
+		l.seen = make(map[string]struct{})
+	}
+	l.seen[fp] = struct{}{}
+	return fp
+}
+
+func fingerprint(clientHello *dissector.ClientHelloMsg) *xctx.TLSFingerprint {
+	_, ja3 := dissector.JA3(clientHello)
+	return &xctx.TLSFingerprint{
+		JA3: ja3,
+		JA4: dissector.JA4(clientHello),
+	}
+}
+
+func (h *redirectHandler) recordFingerprint(fp *xctx.TLSFingerprint) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceTLSFingerprintsCounter,
+		metrics.Labels{"service": h.options.Service, "ja4": h.fingerprints.label(fp.JA4)}); v != nil {
+		v.Inc()
+	}
+}
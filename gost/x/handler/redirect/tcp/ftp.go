@@ -0,0 +1,339 @@
+package redirect
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	netpkg "proxy_forwarder/gost/x/internal/net"
+	"proxy_forwarder/log"
+)
+
+const (
+	// defaultFTPDataTimeout is the time a client has to open a passive data connection.
+	defaultFTPDataTimeout = 30 * time.Second
+)
+
+var (
+	errFTPReply = errors.New("invalid passive mode reply")
+)
+
+func (h *redirectHandler) isFTP(dstAddr net.Addr) bool {
+	if len(h.md.ftpPorts) == 0 {
+		return false
+	}
+	_, port, err := net.SplitHostPort(dstAddr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range h.md.ftpPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// handleFTP relays an FTP control connection. Passive mode replies are rewritten to point
+// to a port of the forwarder, the data connections are tunneled to the server separately.
+func (h *redirectHandler) handleFTP(ctx context.Context, conn net.Conn, dstAddr net.Addr, logSrc, logDst string) error {
+	log.ConnDebug("handler", logSrc, logDst, "red-tcp handle FTP")
+
+	addr := h.dialAddr(ctx, dstAddr)
+	if h.denied(ctx, xctx.ResolvedHostFromContext(ctx), addr) {
+		log.ConnInfo("handler", logSrc, logDst, "connection denied by policy")
+		h.recordDenied(denyReasonPolicy)
+		return h.denyRaw(conn)
+	}
+
+	log.ConnDebug("handler", logSrc, logDst, "connecting")
+
+	cc, err := h.router.Dial(ctx, "tcp", addr)
+	if err != nil {
+		log.ConnError("handler", logSrc, logDst, err)
+		if _, ok := upstreamDenial(err); ok {
+			h.recordDenied(denyReasonUpstream)
+			h.denyRaw(conn)
+		}
+		return err
+	}
+	defer cc.Close()
+
+	serverHost, _, _ := net.SplitHostPort(addr)
+	s := &ftpSession{
+		h:          h,
+		ctx:        ctx,
+		client:     conn,
+		server:     cc,
+		serverHost: serverHost,
+		dataIP:     h.ftpDataIP(conn),
+		logSrc:     logSrc,
+		logDst:     logDst,
+		done:       make(chan struct{}),
+	}
+
+	t := time.Now()
+	log.ConnInfo("handler", logSrc, logDst, "connection established")
+	s.run()
+	log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("connection closed after %s", time.Since(t)))
+
+	return nil
+}
+
+// ftpDataIP returns the address the data connections of the client are accepted on.
+func (h *redirectHandler) ftpDataIP(conn net.Conn) net.IP {
+	if h.md.ftpAddr != nil {
+		return h.md.ftpAddr
+	}
+
+	// in TProxy mode the local address is the one of the server
+	if !h.md.tproxy {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			return addr.IP
+		}
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		return net.IPv6loopback
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+type ftpSession struct {
+	h          *redirectHandler
+	ctx        context.Context
+	client     net.Conn
+	server     net.Conn
+	serverHost string
+	dataIP     net.IP
+	logSrc     string
+	logDst     string
+
+	// replies to the client are written by both directions
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+func (s *ftpSession) run() {
+	errc := make(chan error, 2)
+	go func() {
+		errc <- s.relayCommands()
+	}()
+	go func() {
+		errc <- s.relayReplies()
+	}()
+
+	<-errc
+	close(s.done)
+	s.client.Close()
+	s.server.Close()
+	<-errc
+}
+
+func (s *ftpSession) reply(line string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := io.WriteString(s.client, line)
+	return err
+}
+
+func (s *ftpSession) relayCommands() error {
+	br := bufio.NewReader(s.client)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		cmd, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(cmd) {
+		case "PORT", "EPRT":
+			// the server can't connect back to the client through the proxy
+			log.ConnDebug("handler", s.logSrc, s.logDst, "FTP active mode refused")
+			if err = s.reply("502 Active mode is not supported, use passive mode.\r\n"); err != nil {
+				return err
+			}
+			continue
+
+		case "AUTH":
+			// the control connection is encrypted from now on
+			log.ConnDebug("handler", s.logSrc, s.logDst, "FTP control connection switches to TLS, data connections are not tracked")
+			if _, err = io.WriteString(s.server, line); err != nil {
+				return err
+			}
+			_, err = io.Copy(s.server, br)
+			return err
+		}
+
+		if _, err = io.WriteString(s.server, line); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *ftpSession) relayReplies() error {
+	br := bufio.NewReader(s.server)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return err
+		}
+
+		// continuation lines of multi-line replies are relayed as they are
+		if len(line) > 3 && line[3] == ' ' {
+			switch line[:3] {
+			case "227":
+				line = s.passive(line, false)
+			case "229":
+				line = s.passive(line, true)
+			case "234":
+				if err = s.reply(line); err != nil {
+					return err
+				}
+				s.mu.Lock()
+				_, err = io.Copy(s.client, br)
+				s.mu.Unlock()
+				return err
+			}
+		}
+
+		if err = s.reply(line); err != nil {
+			return err
+		}
+	}
+}
+
+// passive opens a data port for a passive mode reply and returns the reply for the client.
+// The data connection goes to the host of the control connection, like most clients do,
+// the address in the reply is often a private one.
+func (s *ftpSession) passive(line string, extended bool) string {
+	port, err := parsePassiveReply(line, extended)
+	if err != nil {
+		log.ConnError("handler", s.logSrc, s.logDst, fmt.Errorf("%w: %s", err, strings.TrimSpace(line)))
+		return line
+	}
+
+	if !extended && s.dataIP.To4() == nil {
+		return "425 Use EPSV on IPv6 connections.\r\n"
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: s.dataIP})
+	if err != nil {
+		log.ConnError("handler", s.logSrc, s.logDst, err)
+		return "425 Can't open data connection.\r\n"
+	}
+	go s.serveData(ln, net.JoinHostPort(s.serverHost, strconv.Itoa(port)))
+
+	p := ln.Addr().(*net.TCPAddr).Port
+	if extended {
+		return fmt.Sprintf("229 Entering Extended Passive Mode (|||%d|)\r\n", p)
+	}
+	ip := s.dataIP.To4()
+	return fmt.Sprintf("227 Entering Passive Mode (%d,%d,%d,%d,%d,%d).\r\n", ip[0], ip[1], ip[2], ip[3], p>>8, p&0xff)
+}
+
+// serveData accepts a single data connection of the client and tunnels it to target.
+func (s *ftpSession) serveData(ln *net.TCPListener, target string) {
+	accepted := make(chan struct{})
+	go func() {
+		timer := time.NewTimer(s.h.md.ftpDataTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-accepted:
+			return
+		case <-s.done:
+		case <-timer.C:
+		}
+		ln.Close()
+	}()
+
+	conn, err := ln.Accept()
+	close(accepted)
+	ln.Close()
+	if err != nil {
+		log.ConnDebug("handler", s.logSrc, s.logDst, fmt.Sprintf("FTP data connection to %s was not opened", target))
+		return
+	}
+	defer conn.Close()
+
+	logSrc := conn.RemoteAddr().String()
+	logDst := target + "/tcp"
+
+	// only the client of the control connection may use the port
+	if !sameIP(conn.RemoteAddr(), s.client.RemoteAddr()) {
+		log.ConnInfo("handler", logSrc, logDst, fmt.Sprintf("FTP data connection refused, expected client %s", s.client.RemoteAddr()))
+		return
+	}
+
+	cc, err := s.h.router.Dial(s.ctx, "tcp", target)
+	if err != nil {
+		log.ConnError("handler", logSrc, logDst, err)
+		return
+	}
+	defer cc.Close()
+
+	t := time.Now()
+	log.ConnDebug("handler", logSrc, logDst, "FTP data connection established")
+	netpkg.Transport(conn, cc)
+	log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("FTP data connection closed after %s", time.Since(t)))
+}
+
+// parsePassiveReply returns the data port of a PASV (227) or EPSV (229) reply.
+func parsePassiveReply(line string, extended bool) (int, error) {
+	if extended {
+		// 229 Entering Extended Passive Mode (|||6446|)
+		start := strings.IndexByte(line, '(')
+		end := strings.LastIndexByte(line, ')')
+		if start < 0 || end-start < 6 {
+			return 0, errFTPReply
+		}
+		s := line[start+1 : end]
+		fields := strings.Split(s, s[:1])
+		if len(fields) != 5 {
+			return 0, errFTPReply
+		}
+		port, err := strconv.Atoi(fields[3])
+		if err != nil || port <= 0 || port > 0xffff {
+			return 0, errFTPReply
+		}
+		return port, nil
+	}
+
+	// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2).
+	start := strings.IndexFunc(line[4:], func(r rune) bool { return r >= '0' && r <= '9' })
+	if start < 0 {
+		return 0, errFTPReply
+	}
+	s := line[4+start:]
+	if end := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != ',' }); end >= 0 {
+		s = s[:end]
+	}
+	fields := strings.Split(s, ",")
+	if len(fields) != 6 {
+		return 0, errFTPReply
+	}
+	var v [6]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 || n > 0xff {
+			return 0, errFTPReply
+		}
+		v[i] = n
+	}
+	return v[4]<<8 | v[5], nil
+}
+
+func sameIP(a, b net.Addr) bool {
+	ta, ok1 := a.(*net.TCPAddr)
+	tb, ok2 := b.(*net.TCPAddr)
+	return ok1 && ok2 && ta.IP.Equal(tb.IP)
+}
@@ -0,0 +1,48 @@
+package redirect
+
+import "testing"
+
+func TestParsePassiveReply(t *testing.T) {
+	tests := []struct {
+		line     string
+		extended bool
+		port     int
+	}{
+		// RFC 959, the parentheses are not required
+		{"227 Entering Passive Mode (192,0,2,10,25,46).\r\n", false, 25<<8 | 46},
+		{"227 Entering Passive Mode 192,0,2,10,0,21\r\n", false, 21},
+		{"227 =192,0,2,10,255,255\r\n", false, 0xffff},
+		{"227 Entering Passive Mode (192,0,2,10,25).\r\n", false, 0},
+		{"227 Entering Passive Mode (192,0,2,10,25,46,1).\r\n", false, 0},
+		{"227 Entering Passive Mode (192,0,2,10,256,46).\r\n", false, 0},
+		{"227 Entering Passive Mode (192,0,2,10,,46).\r\n", false, 0},
+		{"227 Entering Passive Mode.\r\n", false, 0},
+		{"227 \r\n", false, 0},
+
+		// RFC 2428, any printable delimiter
+		{"229 Entering Extended Passive Mode (|||6446|)\r\n", true, 6446},
+		{"229 Entering Extended Passive Mode (!!!6446!)\r\n", true, 6446},
+		{"229 Entering Extended Passive Mode (|||65535|)\r\n", true, 65535},
+		{"229 Entering Extended Passive Mode (|||0|)\r\n", true, 0},
+		{"229 Entering Extended Passive Mode (|||65536|)\r\n", true, 0},
+		{"229 Entering Extended Passive Mode (|||port|)\r\n", true, 0},
+		{"229 Entering Extended Passive Mode (||6446|)\r\n", true, 0},
+		// the data connection goes to the host of the control connection, an address is ignored
+		{"229 Entering Extended Passive Mode (|1|192.0.2.10|6446|)\r\n", true, 6446},
+		{"229 Entering Extended Passive Mode (|||6446\r\n", true, 0},
+		{"229 Entering Extended Passive Mode )|||6446|(\r\n", true, 0},
+		{"229 Entering Extended Passive Mode ()\r\n", true, 0},
+	}
+	for _, tt := range tests {
+		port, err := parsePassiveReply(tt.line, tt.extended)
+		if tt.port == 0 {
+			if err != errFTPReply {
+				t.Errorf("%q: port %d, error %v, want %v", tt.line, port, err, errFTPReply)
+			}
+			continue
+		}
+		if err != nil || port != tt.port {
+			t.Errorf("%q: port %d, error %v, want %d", tt.line, port, err, tt.port)
+		}
+	}
+}
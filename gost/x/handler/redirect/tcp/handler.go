@@ -4,23 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
+	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"proxy_forwarder/gost/core/chain"
 	"proxy_forwarder/gost/core/handler"
 	md "proxy_forwarder/gost/core/metadata"
+	"proxy_forwarder/gost/core/metrics"
+	"proxy_forwarder/gost/core/sniffer"
 	dissector "proxy_forwarder/gost/tls-dissector"
+	"proxy_forwarder/gost/x/dnssnoop"
+	"proxy_forwarder/gost/x/fakeip"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/identity"
 	xio "proxy_forwarder/gost/x/internal/io"
+	"proxy_forwarder/gost/x/internal/loop"
 	netpkg "proxy_forwarder/gost/x/internal/net"
+	xmetrics "proxy_forwarder/gost/x/metrics"
 	"proxy_forwarder/gost/x/registry"
 	"proxy_forwarder/log"
 	"proxy_forwarder/meta"
@@ -30,10 +38,25 @@ func init() {
 	registry.HandlerRegistry().Register("redirect", NewHandler)
 }
 
+const (
+	// the buffer has to hold a complete ClientHello for the sniffers to see the server name.
+	sniffingBufferSize = 4096
+
+	sniffServerFirst = "server-first"
+	sniffUnknown     = "unknown"
+
+	// request bodies up to this size are kept to send the request again after a challenge
+	maxReplayBodySize = 64 << 10
+)
+
 type redirectHandler struct {
-	router  *chain.Router
-	md      metadata
-	options handler.Options
+	router       *chain.Router
+	md           metadata
+	options      handler.Options
+	pinned       *pinnedHosts
+	fingerprints *fingerprintLabels
+	snoop        *dnssnoop.Cache
+	loops        *loop.Detector
 }
 
 func NewHandler(opts ...handler.Option) handler.Handler {
@@ -56,6 +79,12 @@ func (h *redirectHandler) Init(md md.Metadata) (err error) {
 	if h.router == nil {
 		h.router = chain.NewRouter()
 	}
+	h.loops = loop.NewDetector(h.router)
+	h.pinned = &pinnedHosts{ttl: h.md.mitmPinTTL}
+	h.fingerprints = &fingerprintLabels{limit: h.md.fingerprintsMetricsLimit}
+	if h.md.snoop {
+		h.snoop = dnssnoop.Setup(dnssnoop.GraceOption(h.md.snoopGrace))
+	}
 
 	return
 }
@@ -82,38 +111,118 @@ func (h *redirectHandler) Handle(ctx context.Context, conn net.Conn, opts ...han
 			return
 		}
 	}
+	// the mark of accepted connections is only set with net.ipv4.tcp_fwmark_accept
+	if reason := h.loops.Detect(dstAddr, socketMark(conn)); reason != "" {
+		log.ConnError("handler", logSrc, dstAddr.String(), loop.Error(reason))
+		h.recordLoop(reason)
+		return h.denyRaw(conn)
+	}
+	if h.md.identities != nil {
+		if id := h.md.identities.Identify(&identity.Client{Addr: conn.RemoteAddr(), Dst: dstAddr, Mark: socketMark(conn)}); id != nil {
+			log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("upstream identity %s", id.Name))
+			ctx = identity.ContextWithIdentity(ctx, id)
+		}
+	}
+	if addr, ok := fakeip.ResolveAddr(dstAddr); ok {
+		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("fake-ip %s belongs to %s", dstAddr, addr))
+		dstAddr = addr
+	}
 	logDst = conn.RemoteAddr().String() + " => " + dstAddr.String() + "/" + dstAddr.Network()
+	ctx = xctx.ContextWithSrcAddr(ctx, conn.RemoteAddr())
+	ctx = xctx.ContextWithDstAddr(ctx, dstAddr)
+
+	if name := h.snoopedName(conn.RemoteAddr(), dstAddr); name != "" {
+		ctx = xctx.ContextWithResolvedHost(ctx, name)
+		logDst = conn.RemoteAddr().String() + " => " + dstAddr.String() + " (" + name + ")/" + dstAddr.Network()
+	}
+
+	if h.isFTP(dstAddr) {
+		// FTP servers talk first, there is nothing to sniff
+		return h.handleFTP(ctx, conn, dstAddr, logSrc, logDst)
+	}
 
 	var rw io.ReadWriter = conn
 	if h.md.sniffing {
-		if h.md.sniffingTimeout > 0 {
-			conn.SetReadDeadline(time.Now().Add(h.md.sniffingTimeout))
+		br := bufio.NewReaderSize(conn, sniffingBufferSize)
+		rw = xio.NewReadWriter(br, conn)
+
+		conn.SetReadDeadline(time.Now().Add(h.md.sniffingTimeout))
+		_, err := br.Peek(1)
+		if err == nil && br.Buffered() < dissector.RecordHeaderLen {
+			br.Peek(dissector.RecordHeaderLen)
 		}
-		// try to sniff TLS traffic
-		var hdr [dissector.RecordHeaderLen]byte
-		n, err := io.ReadFull(rw, hdr[:])
-		if h.md.sniffingTimeout > 0 {
-			conn.SetReadDeadline(time.Time{})
+		conn.SetReadDeadline(time.Time{})
+
+		if br.Buffered() == 0 && isTimeout(err) {
+			// the client is waiting for the server to talk first (SSH, SMTP, FTP, MySQL, ...)
+			log.ConnInfo("handler", logSrc, logDst, fmt.Sprintf("no client data within %s, assuming server-first protocol", h.md.sniffingTimeout))
+			h.recordSniffing(sniffServerFirst)
+			return h.handleRaw(ctx, conn, rw, dstAddr, logSrc, logDst)
+		}
+
+		peeked, _ := br.Peek(br.Buffered())
+		res := h.sniff(ctx, peeked)
+		if res == nil {
+			h.recordSniffing(sniffUnknown)
+			return h.handleRaw(ctx, conn, rw, dstAddr, logSrc, logDst)
 		}
-		rw = xio.NewReadWriter(io.MultiReader(bytes.NewReader(hdr[:n]), rw), rw)
-		if err == nil &&
-			hdr[0] == dissector.Handshake &&
-			binary.BigEndian.Uint16(hdr[1:3]) == tls.VersionTLS10 {
-			return h.handleHTTPS(ctx, rw, conn.RemoteAddr(), dstAddr)
+
+		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("sniffed protocol %s (host: '%s', confidence: %s)", res.Protocol, res.Host, res.Confidence))
+		h.recordSniffing(res.Protocol)
+		ctx = sniffer.ContextWithResult(ctx, res)
+
+		switch res.Protocol {
+		case sniffer.ProtocolTLS:
+			return h.handleHTTPS(ctx, conn, rw, dstAddr)
+		case sniffer.ProtocolHTTP:
+			return h.handleHTTP(ctx, rw, conn.RemoteAddr(), dstAddr)
 		}
+	}
 
-		// try to sniff HTTP traffic
-		if isHTTP(string(hdr[:])) {
-			return h.handleHTTP(ctx, rw, conn.RemoteAddr())
+	return h.handleRaw(ctx, conn, rw, dstAddr, logSrc, logDst)
+}
+
+// sniff runs all registered sniffers and returns the most confident result.
+// Ties are resolved by the name of the sniffer to keep the choice deterministic.
+func (h *redirectHandler) sniff(ctx context.Context, b []byte) (res *sniffer.Result) {
+	sniffers := registry.SnifferRegistry().GetAll()
+	names := make([]string, 0, len(sniffers))
+	for name := range sniffers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r := sniffers[name].Sniff(ctx, b)
+		if r == nil || r.Confidence <= sniffer.ConfidenceNone {
+			continue
+		}
+		if res == nil || r.Confidence > res.Confidence {
+			res = r
 		}
 	}
+	return
+}
 
+func (h *redirectHandler) handleRaw(ctx context.Context, conn net.Conn, rw io.ReadWriter, dstAddr net.Addr, logSrc, logDst string) error {
 	log.ConnDebug("handler", logSrc, logDst, "red-tcp handle NON HTTP/S")
+
+	addr := h.dialAddr(ctx, dstAddr)
+	if h.denied(ctx, xctx.ResolvedHostFromContext(ctx), addr) {
+		log.ConnInfo("handler", logSrc, logDst, "connection denied by policy")
+		h.recordDenied(denyReasonPolicy)
+		return h.denyRaw(conn)
+	}
+
 	log.ConnDebug("handler", logSrc, logDst, "connecting")
 
-	cc, err := h.router.Dial(ctx, dstAddr.Network(), dstAddr.String())
+	cc, err := h.router.Dial(ctx, dstAddr.Network(), addr)
 	if err != nil {
 		log.ConnError("handler", logSrc, logDst, err)
+		if _, ok := upstreamDenial(err); ok {
+			h.recordDenied(denyReasonUpstream)
+			h.denyRaw(conn)
+		}
 		return err
 	}
 	defer cc.Close()
@@ -126,24 +235,68 @@ func (h *redirectHandler) Handle(ctx context.Context, conn net.Conn, opts ...han
 	return nil
 }
 
-func (h *redirectHandler) handleHTTP(ctx context.Context, rw io.ReadWriter, raddr net.Addr) error {
-	req, err := http.ReadRequest(bufio.NewReader(rw))
-	if err != nil {
-		return err
+func (h *redirectHandler) handleHTTP(ctx context.Context, rw io.ReadWriter, raddr, dstAddr net.Addr) error {
+	br := bufio.NewReader(rw)
+	ctx = xctx.ContextWithPlainHTTP(ctx)
+
+	t := time.Now()
+	defer func() {
+		log.ConnDebug("handler", raddr.String(), dstAddr.String()+"/"+raddr.Network(), fmt.Sprintf("connection closed after %s", time.Since(t)))
+	}()
+
+	// each request gets its own connection to the proxy, which is released to the
+	// pool of the node once the response was passed on completely.
+	for first := true; ; first = false {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if !first && err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		done, err := h.roundTripHTTP(ctx, rw, br, req, raddr, "http")
+		if err != nil || done {
+			return err
+		}
 	}
+}
 
-	host := req.Host
-	host = buildHostPort(host, "80")
+// roundTripHTTP forwards a plain HTTP request to the proxy and its response to the client,
+// done is true if the client connection must not be used anymore. The scheme is the one of
+// the client connection, https for the requests of an intercepted TLS connection.
+func (h *redirectHandler) roundTripHTTP(ctx context.Context, rw io.ReadWriter, br *bufio.Reader, req *http.Request, raddr net.Addr, scheme string) (done bool, err error) {
+	defaultPort := "80"
+	if scheme == "https" {
+		defaultPort = "443"
+	}
+	host := buildHostPort(req.Host, defaultPort)
 
 	logSrc := raddr.String()
 	logDst := host + "/" + raddr.Network()
 	log.ConnDebug("handler", logSrc, logDst, "red-tcp handle HTTP")
 
-	req.URL = &url.URL{
-		Path: fmt.Sprintf("http://%s%s", host, req.URL.Path),
+	if loop.IsMarked(req.Header.Values("Via")) {
+		log.ConnError("handler", logSrc, logDst, loop.ErrMarker)
+		h.recordLoop(loop.ReasonMarker)
+		return true, h.denyHTTP(rw, http.StatusLoopDetected, req.Host, raddr.String(), "the request was redirected back to the forwarder")
 	}
+
+	if h.denied(ctx, req.Host, host) {
+		log.ConnInfo("handler", logSrc, logDst, "request denied by policy")
+		h.recordDenied(denyReasonPolicy)
+		return true, h.denyHTTP(rw, http.StatusForbidden, req.Host, raddr.String(), "the destination is blocked by policy")
+	}
+
+	req.URL.Scheme = scheme
+	req.URL.Host = req.Host
+	if req.URL.Host == "" {
+		req.URL.Host = host
+	}
+	req.RequestURI = ""
 	req.ProtoMajor = 1
 	req.ProtoMinor = 1
+	req.Header.Add("Via", loop.Via())
 
 	if meta.DEBUG {
 		dump, _ := httputil.DumpRequest(req, false)
@@ -154,45 +307,181 @@ func (h *redirectHandler) handleHTTP(ctx context.Context, rw io.ReadWriter, radd
 	cc, err := h.router.Dial(ctx, "tcp", host)
 	if err != nil {
 		log.ConnError("handler", logSrc, logDst, err)
-		return err
+		if code, ok := upstreamDenial(err); ok {
+			h.recordDenied(denyReasonUpstream)
+			h.denyHTTP(rw, upstreamHTTPStatus(code), req.Host, raddr.String(), upstreamReason(code))
+		}
+		return true, err
 	}
-	defer cc.Close()
-
-	t := time.Now()
+	release := false
 	defer func() {
-		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("connection closed after %s", time.Since(t)))
+		if release {
+			netpkg.Release(cc)
+		} else {
+			cc.Close()
+		}
 	}()
 
-	if err := req.Write(cc); err != nil {
+	// added after the dump, it may carry credentials
+	netpkg.SetProxyHeader(cc, req.Header)
+	// a small body is kept, so the request can be sent again
+	if err := bufferBody(req); err != nil {
 		log.ConnError("handler", logSrc, logDst, err)
-		return err
+		return true, err
 	}
-	log.ConnInfo("handler", logSrc, logDst, "connection established")
 
-	var rw2 io.ReadWriter = cc
-	if meta.DEBUG {
-		var buf bytes.Buffer
-		resp, err := http.ReadResponse(bufio.NewReader(io.TeeReader(cc, &buf)), req)
-		if err != nil {
+	ccr := bufio.NewReader(cc)
+	resp, err := h.sendHTTP(cc, ccr, req, logSrc, logDst)
+	if errors.Is(err, errStaleConn) && netpkg.Reused(cc) && replayable(req) {
+		// the proxy closed the idle connection after the pool checked it
+		log.ConnDebug("handler", logSrc, logDst, "the idle connection to the proxy was closed, retrying on a new connection")
+		cc.Close()
+		if cc, err = h.router.Dial(xctx.ContextWithFreshConn(ctx), "tcp", host); err != nil {
 			log.ConnError("handler", logSrc, logDst, err)
-			return err
+			return true, err
 		}
-		defer resp.Body.Close()
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return true, err
+			}
+		}
+		ccr = bufio.NewReader(cc)
+		resp, err = h.sendHTTP(cc, ccr, req, logSrc, logDst)
+	}
+	if err != nil {
+		log.ConnError("handler", logSrc, logDst, err)
+		return true, err
+	}
 
+	// interim responses, e.g. 100 Continue, are forwarded until the final response arrives
+	for resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		if err := writeInterimResponse(rw, resp); err != nil {
+			return true, err
+		}
+		if resp, err = http.ReadResponse(ccr, req); err != nil {
+			log.ConnError("handler", logSrc, logDst, err)
+			return true, err
+		}
+	}
+	log.ConnInfo("handler", logSrc, logDst, fmt.Sprintf("%s %s %d", req.Method, req.URL.String(), resp.StatusCode))
+
+	if meta.DEBUG {
 		dump, _ := httputil.DumpResponse(resp, false)
 		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("Response: %s", string(dump)))
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// e.g. websocket, the connection is not HTTP anymore
+		if err := resp.Write(rw); err != nil {
+			return true, err
+		}
+		return true, netpkg.Transport(xio.NewReadWriter(br, rw), xio.NewReadWriter(ccr, cc))
+	}
+
+	err = resp.Write(rw)
+	resp.Body.Close()
+	if err != nil {
+		return true, err
+	}
+
+	// nothing must be left of the response, otherwise the connection is out of sync
+	release = !req.Close && !resp.Close && ccr.Buffered() == 0
+	return req.Close || resp.Close, nil
+}
 
-		rw2 = xio.NewReadWriter(io.MultiReader(&buf, cc), cc)
+// sendHTTP writes a plain HTTP request to the proxy and answers its authentication challenges
+// on the same connection. The returned response is the last one, its body is not read.
+func (h *redirectHandler) sendHTTP(cc net.Conn, ccr *bufio.Reader, req *http.Request, logSrc, logDst string) (*http.Response, error) {
+	auth := netpkg.ProxyAuthenticatorFromConn(cc)
+	uri := req.URL.String()
+
+	var sent string
+	if auth != nil {
+		sent = auth.Authorization(req.Method, uri)
 	}
 
-	netpkg.Transport(rw, rw2)
+	send := func(round int, authorization string) (*http.Response, error) {
+		if round > 0 && req.GetBody != nil {
+			var err error
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		if authorization != "" {
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		if err := req.WriteProxy(cc); err != nil {
+			if round == 0 {
+				err = fmt.Errorf("%w: %v", errStaleConn, err)
+			}
+			return nil, err
+		}
+		resp, err := http.ReadResponse(ccr, req)
+		if err != nil {
+			// nothing was read, the proxy closed the connection before the request arrived
+			if round == 0 && (err == io.EOF || errors.Is(err, syscall.ECONNRESET)) {
+				err = fmt.Errorf("%w: %v", errStaleConn, err)
+			}
+			return nil, err
+		}
+		return resp, nil
+	}
+	answer := func(resp *http.Response, sent string) string {
+		// requests with a body that was not kept are only sent with the credentials known beforehand
+		if auth == nil || !replayable(req) {
+			return ""
+		}
+		v := auth.Answer(resp, req.Method, uri, sent)
+		if v != "" {
+			log.ConnDebug("handler", logSrc, logDst, "answering the authentication challenge of the proxy")
+		}
+		return v
+	}
+	return netpkg.AuthRoundTrip(sent, send, answer)
+}
+
+var errStaleConn = errors.New("connection closed by the proxy")
+
+// replayable reports whether the request can be sent again, its body was kept if it has one.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// writeInterimResponse forwards a 1xx response, it has no body and no Content-Length.
+func writeInterimResponse(w io.Writer, resp *http.Response) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %s\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err := resp.Header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
 
+// bufferBody keeps a small request body in memory, so the request can be sent again.
+// Bodies the client only sends after a 100 Continue are not waited for.
+func bufferBody(req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || req.Header.Get("Expect") != "" ||
+		req.ContentLength <= 0 || req.ContentLength > maxReplayBodySize {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+	if err != nil {
+		return err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
 	return nil
 }
 
-func (h *redirectHandler) handleHTTPS(ctx context.Context, rw io.ReadWriter, raddr, dstAddr net.Addr) error {
+func (h *redirectHandler) handleHTTPS(ctx context.Context, conn net.Conn, rw io.ReadWriter, dstAddr net.Addr) error {
+	raddr := conn.RemoteAddr()
 	buf := new(bytes.Buffer)
-	host, err := h.getServerName(ctx, io.TeeReader(rw, buf))
+	clientHello, err := h.readClientHello(io.TeeReader(rw, buf))
+	host := getServerName(clientHello)
 	logSrc := raddr.String()
 	logDst := host + "/" + raddr.Network()
 	log.ConnDebug("handler", logSrc, logDst, "red-tcp handle HTTPS")
@@ -201,12 +490,46 @@ func (h *redirectHandler) handleHTTPS(ctx context.Context, rw io.ReadWriter, rad
 		log.ConnError("handler", logSrc, logDst, err)
 		return err
 	}
-	host = buildHostPort(host, "443")
+	if host == "" {
+		// clients connecting to an address don't send a server name
+		host = h.dialAddr(ctx, dstAddr)
+	} else {
+		host = buildHostPort(host, "443")
+	}
 	logDst = host + "/" + raddr.Network()
 
+	fp := fingerprint(clientHello)
+	log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("TLS fingerprint ja3=%s ja4=%s", fp.JA3, fp.JA4))
+	h.recordFingerprint(fp)
+	ctx = xctx.ContextWithTLSFingerprint(ctx, fp)
+
+	name := getServerName(clientHello)
+	if name == "" {
+		name = xctx.ResolvedHostFromContext(ctx)
+	}
+	if h.denied(ctx, name, host) {
+		log.ConnInfo("handler", logSrc, logDst, fmt.Sprintf("connection denied by policy (ja3=%s ja4=%s)", fp.JA3, fp.JA4))
+		h.recordDenied(denyReasonPolicy)
+		return h.denyTLS(rw, h.md.denyTLSAlert)
+	}
+
+	if serverName := getServerName(clientHello); serverName != "" {
+		intercept, reason := h.shouldIntercept(raddr, serverName, clientHello)
+		if intercept {
+			return h.handleMITM(ctx, conn, io.MultiReader(buf, rw), serverName, logSrc)
+		}
+		if reason != "" {
+			log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("TLS interception skipped: %s", reason))
+		}
+	}
+
 	cc, err := h.router.Dial(ctx, "tcp", host)
 	if err != nil {
 		log.ConnError("handler", logSrc, logDst, err)
+		if code, ok := upstreamDenial(err); ok {
+			h.recordDenied(denyReasonUpstream)
+			h.denyTLS(rw, upstreamTLSAlert(code))
+		}
 		return err
 	}
 	defer cc.Close()
@@ -219,17 +542,53 @@ func (h *redirectHandler) handleHTTPS(ctx context.Context, rw io.ReadWriter, rad
 	return nil
 }
 
-func (h *redirectHandler) getServerName(ctx context.Context, r io.Reader) (host string, err error) {
+// snoopedName returns the name the client resolved the destination address for.
+func (h *redirectHandler) snoopedName(raddr, dstAddr net.Addr) string {
+	if h.snoop == nil {
+		return ""
+	}
+	dst, ok := dstAddr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	var client net.IP
+	if addr, ok := raddr.(*net.TCPAddr); ok {
+		client = addr.IP
+	}
+	name, _ := h.snoop.Lookup(client, dst.IP)
+	return name
+}
+
+// dialAddr returns the address to connect to, the name the client resolved if enabled.
+func (h *redirectHandler) dialAddr(ctx context.Context, dstAddr net.Addr) string {
+	if !h.md.snoopConnect {
+		return dstAddr.String()
+	}
+	host := xctx.ResolvedHostFromContext(ctx)
+	if host == "" {
+		return dstAddr.String()
+	}
+	_, port, _ := net.SplitHostPort(dstAddr.String())
+	return net.JoinHostPort(host, port)
+}
+
+func (h *redirectHandler) readClientHello(r io.Reader) (*dissector.ClientHelloMsg, error) {
 	record, err := dissector.ReadRecord(r)
 	if err != nil {
-		return
+		return nil, err
 	}
 
-	clientHello := dissector.ClientHelloMsg{}
+	clientHello := &dissector.ClientHelloMsg{}
 	if err = clientHello.Decode(record.Opaque); err != nil {
-		return
+		return nil, err
 	}
+	return clientHello, nil
+}
 
+func getServerName(clientHello *dissector.ClientHelloMsg) (host string) {
+	if clientHello == nil {
+		return
+	}
 	for _, ext := range clientHello.Extensions {
 		if ext.Type() == dissector.ExtServerName {
 			snExtension := ext.(*dissector.ServerNameExtension)
@@ -237,20 +596,22 @@ func (h *redirectHandler) getServerName(ctx context.Context, r io.Reader) (host
 			break
 		}
 	}
-
 	return
 }
 
-func isHTTP(s string) bool {
-	return strings.HasPrefix(http.MethodGet, s[:3]) ||
-		strings.HasPrefix(http.MethodPost, s[:4]) ||
-		strings.HasPrefix(http.MethodPut, s[:3]) ||
-		strings.HasPrefix(http.MethodDelete, s) ||
-		strings.HasPrefix(http.MethodOptions, s) ||
-		strings.HasPrefix(http.MethodPatch, s) ||
-		strings.HasPrefix(http.MethodHead, s[:4]) ||
-		strings.HasPrefix(http.MethodConnect, s) ||
-		strings.HasPrefix(http.MethodTrace, s)
+func (h *redirectHandler) recordSniffing(protocol string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceSniffingCounter,
+		metrics.Labels{"service": h.options.Service, "protocol": protocol}); v != nil {
+		v.Inc()
+	}
+}
+
+func isTimeout(err error) bool {
+	if err == nil {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
 }
 
 func buildHostPort(host string, defaultPort string) string {
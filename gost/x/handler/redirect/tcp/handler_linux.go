@@ -3,7 +3,9 @@ package redirect
 import (
 	"errors"
 	"net"
+	"strconv"
 	"syscall"
+	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
@@ -45,9 +47,14 @@ func (h *redirectHandler) getOriginalDstAddr(conn net.Conn) (addr net.Addr, err
 				cerr = err
 				return
 			}
+			// the port is in network byte order
+			p := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
 			addr = &net.TCPAddr{
 				IP:   net.IP(info.Addr.Addr[:]),
-				Port: int(info.Addr.Port),
+				Port: int(p[0])<<8 + int(p[1]),
+			}
+			if info.Addr.Scope_id != 0 {
+				addr.(*net.TCPAddr).Zone = strconv.Itoa(int(info.Addr.Scope_id))
 			}
 		}
 	})
@@ -60,3 +67,43 @@ func (h *redirectHandler) getOriginalDstAddr(conn net.Conn) (addr net.Addr, err
 
 	return
 }
+
+// resetConn makes the following close of the connection send a RST instead of a FIN.
+func resetConn(conn net.Conn) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("wrong connection type, must be syscall.Conn")
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var cerr error
+	err = rc.Control(func(fd uintptr) {
+		cerr = unix.SetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER, &unix.Linger{Onoff: 1, Linger: 0})
+	})
+	if err != nil {
+		return err
+	}
+	return cerr
+}
+
+// socketMark returns the mark of the socket, 0 if it can't be read.
+func socketMark(conn net.Conn) int {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+
+	var mark int
+	rc.Control(func(fd uintptr) {
+		mark, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK)
+	})
+	return mark
+}
@@ -11,3 +11,14 @@ func (h *redirectHandler) getOriginalDstAddr(conn net.Conn) (addr net.Addr, err
 	err = errors.New("TCP redirect is not available on non-linux platform")
 	return
 }
+
+func resetConn(conn net.Conn) error {
+	if c, ok := conn.(*net.TCPConn); ok {
+		return c.SetLinger(0)
+	}
+	return errors.New("wrong connection type, must be TCP Conn")
+}
+
+func socketMark(conn net.Conn) int {
+	return 0
+}
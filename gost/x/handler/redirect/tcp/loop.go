@@ -0,0 +1,13 @@
+package redirect
+
+import (
+	"proxy_forwarder/gost/core/metrics"
+	xmetrics "proxy_forwarder/gost/x/metrics"
+)
+
+func (h *redirectHandler) recordLoop(reason string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceLoopsCounter,
+		metrics.Labels{"service": h.options.Service, "reason": reason}); v != nil {
+		v.Inc()
+	}
+}
@@ -1,25 +1,171 @@
 package redirect
 
 import (
+	"fmt"
+	"html/template"
+	"net"
+	"os"
+	"strings"
 	"time"
 
+	"proxy_forwarder/gost/core/logger"
 	mdata "proxy_forwarder/gost/core/metadata"
 	mdutil "proxy_forwarder/gost/core/metadata/util"
+	dissector "proxy_forwarder/gost/tls-dissector"
+	"proxy_forwarder/gost/x/internal/identity"
+	tls_util "proxy_forwarder/gost/x/internal/util/tls"
+)
+
+const (
+	// defaultSniffingTimeout is the time to wait for the first client bytes
+	// before the connection is treated as a server-first protocol.
+	defaultSniffingTimeout = 2 * time.Second
+	// the identity mapping is re-read this often
+	defaultIdentityReload = 30 * time.Second
 )
 
 type metadata struct {
 	tproxy          bool
 	sniffing        bool
 	sniffingTimeout time.Duration
+	denyTemplate    *template.Template
+	denyTLSAlert    uint8
+	mitmCerts       *tls_util.CertCache
+	mitmDomains     *hostMatcher
+	mitmExclude     *hostMatcher
+	mitmPinTTL      time.Duration
+	// maximum number of distinct fingerprints exported as metric labels
+	fingerprintsMetricsLimit int
+	snoop                    bool
+	snoopGrace               time.Duration
+	snoopConnect             bool
+	// destination ports of FTP control connections
+	ftpPorts       []string
+	ftpAddr        net.IP
+	ftpDataTimeout time.Duration
+	// upstream identities of the clients
+	identities *identity.Mapper
 }
 
 func (h *redirectHandler) parseMetadata(md mdata.Metadata) (err error) {
 	const (
-		tproxy   = "tproxy"
-		sniffing = "sniffing"
+		tproxy           = "tproxy"
+		sniffing         = "sniffing"
+		sniffingTimeout  = "sniffing.timeout"
+		denyTemplateFile = "deny.template.file"
+		denyTLSAlert     = "deny.tlsAlert"
+		mitmDomains      = "mitm.domains"
+		mitmExclude      = "mitm.exclude"
+		mitmCACert       = "mitm.caCert"
+		mitmCAKey        = "mitm.caKey"
+		mitmValidity     = "mitm.validity"
+		mitmPinTTL       = "mitm.pinTTL"
+
+		fingerprintsMetricsLimit = "fingerprints.metricsLimit"
+
+		snoop        = "snoop"
+		snoopGrace   = "snoop.grace"
+		snoopConnect = "snoop.connect"
+
+		ftp        = "ftp"
+		ftpPorts   = "ftp.ports"
+		ftpAddr    = "ftp.addr"
+		ftpTimeout = "ftp.timeout"
+
+		identitySource = "identity"
+		identityReload = "identity.reload"
 	)
 	h.md.tproxy = mdutil.GetBool(md, tproxy)
 	h.md.sniffing = mdutil.GetBool(md, sniffing)
-	h.md.sniffingTimeout = mdutil.GetDuration(md, "sniffing.timeout")
+	h.md.sniffingTimeout = mdutil.GetDuration(md, sniffingTimeout)
+	if h.md.sniffingTimeout <= 0 {
+		h.md.sniffingTimeout = defaultSniffingTimeout
+	}
+
+	tmpl := defaultDenyTemplate
+	if filename := mdutil.GetString(md, denyTemplateFile); filename != "" {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		tmpl = string(b)
+	}
+	if h.md.denyTemplate, err = template.New("deny").Parse(tmpl); err != nil {
+		return
+	}
+
+	h.md.denyTLSAlert = dissector.AlertAccessDenied
+	if v := mdutil.GetString(md, denyTLSAlert); v != "" {
+		alert, ok := tlsAlerts[v]
+		if !ok {
+			return fmt.Errorf("unsupported TLS alert %s, must be one of access_denied, unrecognized_name", v)
+		}
+		h.md.denyTLSAlert = alert
+	}
+
+	h.md.fingerprintsMetricsLimit = mdutil.GetInt(md, fingerprintsMetricsLimit)
+	if h.md.fingerprintsMetricsLimit <= 0 {
+		h.md.fingerprintsMetricsLimit = defaultFingerprintsMetricsLimit
+	}
+
+	h.md.snoop = mdutil.GetBool(md, snoop)
+	h.md.snoopGrace = mdutil.GetDuration(md, snoopGrace)
+	h.md.snoopConnect = mdutil.GetBool(md, snoopConnect)
+
+	if mdutil.GetBool(md, ftp) {
+		h.md.ftpPorts = getStrings(md, ftpPorts)
+		if len(h.md.ftpPorts) == 0 {
+			h.md.ftpPorts = []string{"21"}
+		}
+		if v := mdutil.GetString(md, ftpAddr); v != "" {
+			if h.md.ftpAddr = net.ParseIP(v); h.md.ftpAddr == nil {
+				return fmt.Errorf("invalid FTP data address %s", v)
+			}
+		}
+		h.md.ftpDataTimeout = mdutil.GetDuration(md, ftpTimeout)
+		if h.md.ftpDataTimeout <= 0 {
+			h.md.ftpDataTimeout = defaultFTPDataTimeout
+		}
+	}
+
+	if v := mdutil.GetString(md, identitySource); v != "" {
+		reload := mdutil.GetDuration(md, identityReload)
+		if reload <= 0 {
+			reload = defaultIdentityReload
+		}
+		h.md.identities = identity.FromSource(v, reload, logger.Default().WithFields(map[string]any{
+			"kind": "identity",
+		}))
+	}
+
+	if domains := getStrings(md, mitmDomains); len(domains) > 0 {
+		h.md.mitmCerts, err = tls_util.NewCertCache(
+			mdutil.GetString(md, mitmCACert),
+			mdutil.GetString(md, mitmCAKey),
+			mdutil.GetDuration(md, mitmValidity),
+		)
+		if err != nil {
+			return fmt.Errorf("TLS interception: %w", err)
+		}
+		h.md.mitmDomains = newHostMatcher(domains)
+		h.md.mitmExclude = newHostMatcher(getStrings(md, mitmExclude))
+		h.md.mitmPinTTL = mdutil.GetDuration(md, mitmPinTTL)
+		if h.md.mitmPinTTL <= 0 {
+			h.md.mitmPinTTL = defaultMITMPinTTL
+		}
+	}
+	return
+}
+
+// getStrings accepts both lists and comma-separated strings.
+func getStrings(md mdata.Metadata, key string) (ss []string) {
+	if ss = mdutil.GetStrings(md, key); len(ss) > 0 {
+		return
+	}
+	for _, s := range strings.Split(mdutil.GetString(md, key), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ss = append(ss, s)
+		}
+	}
 	return
 }
@@ -0,0 +1,239 @@
+package redirect
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	dissector "proxy_forwarder/gost/tls-dissector"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/matcher"
+	netpkg "proxy_forwarder/gost/x/internal/net"
+	"proxy_forwarder/log"
+)
+
+const (
+	alpnHTTP1 = "http/1.1"
+
+	mitmHandshakeTimeout = 10 * time.Second
+	defaultMITMPinTTL    = time.Hour
+	mitmPinPruneInterval = time.Minute
+)
+
+// hostMatcher matches a host against domains ('example.com', '.example.com') and wildcards ('*.example.com').
+type hostMatcher struct {
+	domains   matcher.Matcher
+	wildcards matcher.Matcher
+}
+
+func newHostMatcher(patterns []string) *hostMatcher {
+	var domains, wildcards []string
+	for _, pattern := range patterns {
+		if strings.ContainsAny(pattern, "*?") {
+			wildcards = append(wildcards, pattern)
+			continue
+		}
+		domains = append(domains, pattern)
+	}
+	return &hostMatcher{
+		domains:   matcher.DomainMatcher(domains),
+		wildcards: matcher.WildcardMatcher(wildcards),
+	}
+}
+
+func (m *hostMatcher) Match(host string) bool {
+	if m == nil || host == "" {
+		return false
+	}
+	return m.domains.Match(host) || m.wildcards.Match(host)
+}
+
+// pinnedHosts remembers the hosts for which a client rejected the minted certificate,
+// most likely because it pins the certificate of the server. The hosts are kept per
+// client, other clients may trust the CA.
+type pinnedHosts struct {
+	ttl    time.Duration
+	mu     sync.Mutex
+	hosts  map[string]time.Time
+	pruned time.Time
+}
+
+func (p *pinnedHosts) add(client, host string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.hosts == nil {
+		p.hosts = make(map[string]time.Time)
+	}
+	now := time.Now()
+	p.hosts[pinnedKey(client, host)] = now.Add(p.ttl)
+
+	// the entries of clients which never come back again are removed as well
+	if now.Sub(p.pruned) < mitmPinPruneInterval {
+		return
+	}
+	p.pruned = now
+	for k, expires := range p.hosts {
+		if now.After(expires) {
+			delete(p.hosts, k)
+		}
+	}
+}
+
+func (p *pinnedHosts) contains(client, host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := pinnedKey(client, host)
+	expires, ok := p.hosts[key]
+	if ok && time.Now().After(expires) {
+		delete(p.hosts, key)
+		return false
+	}
+	return ok
+}
+
+func pinnedKey(client, host string) string {
+	return client + "|" + strings.ToLower(host)
+}
+
+// clientIP returns the IP of the client without the port, which changes with every connection.
+func clientIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// rejectedCertificate reports whether the handshake failed because the client
+// sent an alert about the certificate, other failures do not disable the interception.
+func rejectedCertificate(err error) bool {
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "remote error" {
+		return false
+	}
+	// the alert type of crypto/tls is not exported
+	v := reflect.ValueOf(opErr.Err)
+	if v.Kind() != reflect.Uint8 {
+		return false
+	}
+	switch v.Uint() {
+	case dissector.AlertBadCertificate,
+		dissector.AlertUnsupportedCertificate,
+		dissector.AlertCertificateRevoked,
+		dissector.AlertCertificateExpired,
+		dissector.AlertCertificateUnknown,
+		dissector.AlertUnknownCA:
+		return true
+	}
+	return false
+}
+
+// sameHost reports whether the Host header of an intercepted request names the
+// server of the TLS connection, requests for other hosts would bypass the policy.
+func sameHost(reqHost, addr string) bool {
+	if reqHost == "" {
+		return true
+	}
+	host, port, err := net.SplitHostPort(reqHost)
+	if err != nil {
+		host, port = reqHost, "443"
+	}
+	return strings.EqualFold(net.JoinHostPort(host, port), addr)
+}
+
+// shouldIntercept reports whether the TLS connection to host is terminated by the forwarder.
+func (h *redirectHandler) shouldIntercept(client net.Addr, host string, clientHello *dissector.ClientHelloMsg) (ok bool, reason string) {
+	if h.md.mitmCerts == nil || !h.md.mitmDomains.Match(host) {
+		return
+	}
+	if h.md.mitmExclude.Match(host) {
+		return false, "excluded"
+	}
+	if h.pinned.contains(clientIP(client), host) {
+		return false, "client rejected the certificate before"
+	}
+
+	for _, ext := range clientHello.Extensions {
+		if ext.Type() != dissector.ExtALPN {
+			continue
+		}
+		for _, proto := range ext.(*dissector.ALPNExtension).Protocols {
+			if proto == alpnHTTP1 {
+				return true, ""
+			}
+		}
+		// the inner protocol could not be forwarded as plain HTTP/1.1 request
+		return false, "client does not offer " + alpnHTTP1
+	}
+
+	// no ALPN, HTTP/1.1 is implied
+	return true, ""
+}
+
+// handleMITM terminates the TLS connection of the client with a minted certificate and
+// forwards the inner HTTP requests to the upstream proxy as plain requests in absolute-form.
+func (h *redirectHandler) handleMITM(ctx context.Context, conn net.Conn, r io.Reader, host string, logSrc string) error {
+	addr := buildHostPort(host, "443")
+	logDst := addr + "/tcp"
+
+	tlsConn := tls.Server(netpkg.NewBufferReaderConn(conn, bufio.NewReader(r)), &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return h.md.mitmCerts.Get(host)
+		},
+		NextProtos: []string{alpnHTTP1},
+	})
+	defer tlsConn.Close()
+
+	tlsConn.SetDeadline(time.Now().Add(mitmHandshakeTimeout))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		if rejectedCertificate(err) {
+			// the client does not trust the CA or pins the certificate of the server,
+			// its following connections are tunneled.
+			h.pinned.add(clientIP(conn.RemoteAddr()), host)
+			log.ConnErrorS("handler", logSrc, logDst, fmt.Sprintf("TLS interception failed, disabled for %s: %s", h.md.mitmPinTTL, err))
+			return err
+		}
+		log.ConnError("handler", logSrc, logDst, err)
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	log.ConnInfo("handler", logSrc, logDst, "TLS intercepted")
+
+	ctx = xctx.ContextWithPlainHTTP(ctx)
+	br := bufio.NewReader(tlsConn)
+
+	// the requests are sent like plain HTTP requests, each one on its own pooled connection
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if !sameHost(req.Host, addr) {
+			log.ConnInfo("handler", logSrc, logDst, fmt.Sprintf("request for %s denied: it does not match the TLS server name", req.Host))
+			h.recordDenied(denyReasonPolicy)
+			return h.denyHTTP(tlsConn, http.StatusMisdirectedRequest, req.Host, conn.RemoteAddr().String(), "the host does not match the TLS server name")
+		}
+		if req.Host == "" {
+			req.Host = host
+		}
+
+		done, err := h.roundTripHTTP(ctx, tlsConn, br, req, conn.RemoteAddr(), "https")
+		if err != nil || done {
+			return err
+		}
+	}
+}
@@ -9,7 +9,15 @@ import (
 	"proxy_forwarder/gost/core/chain"
 	"proxy_forwarder/gost/core/handler"
 	md "proxy_forwarder/gost/core/metadata"
+	mdutil "proxy_forwarder/gost/core/metadata/util"
+	"proxy_forwarder/gost/core/metrics"
+	"proxy_forwarder/gost/x/dnssnoop"
+	"proxy_forwarder/gost/x/fakeip"
+	xctx "proxy_forwarder/gost/x/internal/ctx"
+	"proxy_forwarder/gost/x/internal/identity"
+	"proxy_forwarder/gost/x/internal/loop"
 	netpkg "proxy_forwarder/gost/x/internal/net"
+	xmetrics "proxy_forwarder/gost/x/metrics"
 	"proxy_forwarder/gost/x/registry"
 	"proxy_forwarder/log"
 )
@@ -19,9 +27,11 @@ func init() {
 }
 
 type redirectHandler struct {
-	router  *chain.Router
-	md      metadata
-	options handler.Options
+	router     *chain.Router
+	dnsHandler handler.Handler
+	md         metadata
+	options    handler.Options
+	loops      *loop.Detector
 }
 
 func NewHandler(opts ...handler.Option) handler.Handler {
@@ -30,9 +40,15 @@ func NewHandler(opts ...handler.Option) handler.Handler {
 		opt(&options)
 	}
 
-	return &redirectHandler{
+	h := &redirectHandler{
 		options: options,
 	}
+
+	if f := registry.HandlerRegistry().Get("redns"); f != nil {
+		h.dnsHandler = f(opts...)
+	}
+
+	return h
 }
 
 func (h *redirectHandler) Init(md md.Metadata) (err error) {
@@ -44,11 +60,29 @@ func (h *redirectHandler) Init(md md.Metadata) (err error) {
 	if h.router == nil {
 		h.router = chain.NewRouter()
 	}
+	h.loops = loop.NewDetector(h.router)
+
+	if h.md.snoop {
+		dnssnoop.Setup(dnssnoop.GraceOption(h.md.snoopGrace))
+	}
+
+	if !h.md.dns {
+		h.dnsHandler = nil
+	}
+	if h.dnsHandler != nil {
+		if err = h.dnsHandler.Init(md); err != nil {
+			return
+		}
+	}
 
 	return
 }
 
 func (h *redirectHandler) Handle(ctx context.Context, conn net.Conn, opts ...handler.HandleOption) error {
+	if h.dnsHandler != nil && isDNS(conn.LocalAddr()) {
+		return h.dnsHandler.Handle(ctx, conn, opts...)
+	}
+
 	defer conn.Close()
 	logSrc := conn.LocalAddr().String() + "/" + conn.LocalAddr().Network()
 	logDst := conn.RemoteAddr().String()
@@ -61,10 +95,61 @@ func (h *redirectHandler) Handle(ctx context.Context, conn net.Conn, opts ...han
 	}()
 
 	dstAddr := conn.LocalAddr()
+	// the mark of the first packet, reported by the listener on kernels with SO_RCVMARK
+	var mark int
+	if v, ok := conn.(md.Metadatable); ok {
+		mark = mdutil.GetInt(v.Metadata(), "mark")
+	}
+	if reason := h.loops.Detect(dstAddr, mark); reason != "" {
+		err := loop.Error(reason)
+		log.ConnError("handler", logSrc, logDst, err)
+		h.recordLoop(reason)
+		return err
+	}
+	if h.md.identities != nil {
+		if id := h.md.identities.Identify(&identity.Client{Addr: conn.RemoteAddr(), Dst: dstAddr, Mark: mark}); id != nil {
+			log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("upstream identity %s", id.Name))
+			ctx = identity.ContextWithIdentity(ctx, id)
+		}
+	}
+	if addr, ok := fakeip.ResolveAddr(dstAddr); ok {
+		log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("fake-ip %s belongs to %s", dstAddr, addr))
+		dstAddr = addr
+	}
+	ctx = xctx.ContextWithSrcAddr(ctx, conn.RemoteAddr())
+	ctx = xctx.ContextWithDstAddr(ctx, dstAddr)
+
+	flow, packets, err := h.sniffQUIC(conn)
+	if err != nil {
+		log.ConnError("handler", logSrc, logDst, err)
+		return err
+	}
+	rw := &replayConn{Conn: conn, packets: packets}
+
+	dial := h.router.Dial
+	if flow != nil {
+		h.recordSniffing(sniffingProtocolQUIC)
+
+		sni := flow.sni
+		if sni == "" {
+			sni = "unknown"
+		}
+		log.ConnInfo("handler", logSrc, logDst, fmt.Sprintf("QUIC connection to %s, policy: %s", sni, h.md.quicPolicy))
+
+		switch h.md.quicPolicy {
+		case quicPolicyReject:
+			if err := rejectQUIC(conn, flow); err != nil {
+				log.ConnError("handler", logSrc, logDst, err)
+			}
+			return nil
+		case quicPolicyDirect:
+			dial = h.dialDirect
+		}
+	}
 
 	log.ConnDebug("handler", logSrc, logDst, "connecting")
 
-	cc, err := h.router.Dial(ctx, dstAddr.Network(), dstAddr.String())
+	cc, err := dial(ctx, dstAddr.Network(), dstAddr.String())
 	if err != nil {
 		log.ConnError("handler", logSrc, logDst, err)
 		return err
@@ -73,8 +158,49 @@ func (h *redirectHandler) Handle(ctx context.Context, conn net.Conn, opts ...han
 
 	t := time.Now()
 	log.ConnInfo("handler", logSrc, logDst, "connection established")
-	netpkg.Transport(conn, cc)
+	if isDNS(conn.LocalAddr()) {
+		cc = &snoopConn{Conn: cc, client: conn.RemoteAddr()}
+	}
+	netpkg.Transport(rw, cc)
 	log.ConnDebug("handler", logSrc, logDst, fmt.Sprintf("connection closed after %s", time.Since(t)))
 
 	return nil
 }
+
+// dialDirect connects to the original destination without the upstream proxy.
+func (h *redirectHandler) dialDirect(ctx context.Context, network, address string) (net.Conn, error) {
+	opts := h.router.Options()
+	return chain.DefaultRoute.Dial(ctx, network, address,
+		chain.InterfaceDialOption(opts.IfceName),
+		chain.SockOptsDialOption(opts.SockOpts),
+		chain.TimeoutDialOption(opts.Timeout),
+	)
+}
+
+func isDNS(addr net.Addr) bool {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port == "53"
+}
+
+// snoopConn passes the DNS answers relayed to the client to the snooping cache.
+type snoopConn struct {
+	net.Conn
+	client net.Addr
+}
+
+func (c *snoopConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		if addr, ok := c.client.(*net.UDPAddr); ok {
+			dnssnoop.ObserveRaw(addr.IP, b[:n])
+		}
+	}
+	return
+}
+
+func (h *redirectHandler) recordLoop(reason string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceLoopsCounter,
+		metrics.Labels{"service": h.options.Service, "reason": reason}); v != nil {
+		v.Inc()
+	}
+}
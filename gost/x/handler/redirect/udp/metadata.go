@@ -1,11 +1,63 @@
 package redirect
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"proxy_forwarder/gost/core/logger"
 	mdata "proxy_forwarder/gost/core/metadata"
+	mdutil "proxy_forwarder/gost/core/metadata/util"
+	"proxy_forwarder/gost/x/internal/identity"
 )
 
-type metadata struct{}
+const (
+	// the identity mapping is re-read this often
+	defaultIdentityReload = 30 * time.Second
+)
+
+type metadata struct {
+	quicPolicy string
+	dns        bool
+	snoop      bool
+	snoopGrace time.Duration
+	// upstream identities of the clients
+	identities *identity.Mapper
+}
 
 func (h *redirectHandler) parseMetadata(md mdata.Metadata) (err error) {
+	const (
+		quicPolicy = "quic"
+		dns        = "dns"
+		snoop      = "snoop"
+		snoopGrace = "snoop.grace"
+
+		identitySource = "identity"
+		identityReload = "identity.reload"
+	)
+
+	h.md.quicPolicy = strings.ToLower(mdutil.GetString(md, quicPolicy))
+	switch h.md.quicPolicy {
+	case "":
+		h.md.quicPolicy = quicPolicyProxy
+	case quicPolicyProxy, quicPolicyReject, quicPolicyDirect:
+	default:
+		return fmt.Errorf("invalid quic policy %q", h.md.quicPolicy)
+	}
+
+	h.md.dns = mdutil.GetBool(md, dns)
+	h.md.snoop = mdutil.GetBool(md, snoop)
+	h.md.snoopGrace = mdutil.GetDuration(md, snoopGrace)
+
+	if v := mdutil.GetString(md, identitySource); v != "" {
+		reload := mdutil.GetDuration(md, identityReload)
+		if reload <= 0 {
+			reload = defaultIdentityReload
+		}
+		h.md.identities = identity.FromSource(v, reload, logger.Default().WithFields(map[string]any{
+			"kind": "identity",
+		}))
+	}
+
 	return
 }
@@ -0,0 +1,139 @@
+package redirect
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/common/bufpool"
+	"proxy_forwarder/gost/core/metrics"
+	dissector "proxy_forwarder/gost/tls-dissector"
+	"proxy_forwarder/gost/x/internal/util/quic"
+	xmetrics "proxy_forwarder/gost/x/metrics"
+)
+
+const (
+	quicPolicyProxy  = "proxy"
+	quicPolicyReject = "reject"
+	quicPolicyDirect = "direct"
+
+	sniffingProtocolQUIC = "quic"
+
+	// a ClientHello with post-quantum key shares spans multiple Initial packets
+	maxQUICInitialPackets = 4
+	quicSniffingTimeout   = 500 * time.Millisecond
+	maxDatagramSize       = 65535
+)
+
+// quicFlow is the start of a QUIC connection read from a session.
+type quicFlow struct {
+	initial *quic.InitialPacket
+	sni     string
+	// datagrams already read from the session, they have to be replayed upstream
+	packets [][]byte
+}
+
+// sniffQUIC reads the first datagrams of the session and returns the flow if they are QUIC Initial packets.
+// The datagrams read are returned in any case.
+func (h *redirectHandler) sniffQUIC(conn net.Conn) (flow *quicFlow, packets [][]byte, err error) {
+	b := bufpool.Get(maxDatagramSize)
+	defer bufpool.Put(b)
+
+	n, err := conn.Read(*b)
+	if err != nil {
+		return
+	}
+	packets = append(packets, append([]byte(nil), (*b)[:n]...))
+	if !quic.IsInitial(packets[0]) {
+		return
+	}
+
+	flow = &quicFlow{}
+	initials := make([]*quic.InitialPacket, 0, maxQUICInitialPackets)
+
+	conn.SetReadDeadline(time.Now().Add(quicSniffingTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	for i := 0; ; i++ {
+		// the SNI is best-effort, the flow stays QUIC if it can't be extracted
+		p, perr := quic.ParseInitial(packets[i])
+		if perr == nil {
+			initials = append(initials, p)
+			if flow.initial == nil {
+				flow.initial = p
+			}
+		}
+
+		raw, herr := quic.ClientHello(initials...)
+		if herr == nil {
+			clientHello := dissector.ClientHelloMsg{}
+			if err := clientHello.Decode(raw); err == nil {
+				flow.sni = getServerName(&clientHello)
+			}
+			break
+		}
+		if herr != quic.ErrIncomplete || len(packets) >= maxQUICInitialPackets {
+			break
+		}
+
+		n, rerr := conn.Read(*b)
+		if rerr != nil {
+			break
+		}
+		packets = append(packets, append([]byte(nil), (*b)[:n]...))
+	}
+
+	flow.packets = packets
+	return
+}
+
+func getServerName(clientHello *dissector.ClientHelloMsg) (host string) {
+	for _, ext := range clientHello.Extensions {
+		if ext.Type() == dissector.ExtServerName {
+			host = ext.(*dissector.ServerNameExtension).Name
+			break
+		}
+	}
+	return
+}
+
+// rejectQUIC refuses the connection using a CONNECTION_CLOSE in a server Initial,
+// clients fall back to TCP right away instead of waiting for their handshake to time out.
+func rejectQUIC(conn net.Conn, flow *quicFlow) error {
+	if flow.initial == nil {
+		return nil
+	}
+	b, err := quic.NewConnectionClose(flow.initial, quic.ConnectionRefused)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
+}
+
+// replayConn returns the datagrams consumed while sniffing before reading from the session.
+type replayConn struct {
+	net.Conn
+	mu      sync.Mutex
+	packets [][]byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	if len(c.packets) > 0 {
+		p := c.packets[0]
+		c.packets = c.packets[1:]
+		c.mu.Unlock()
+		return copy(b, p), nil
+	}
+	c.mu.Unlock()
+
+	return c.Conn.Read(b)
+}
+
+func (h *redirectHandler) recordSniffing(protocol string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceSniffingCounter,
+		metrics.Labels{"service": h.options.Service, "protocol": protocol}); v != nil {
+		v.Inc()
+	}
+}
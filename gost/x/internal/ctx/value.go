@@ -0,0 +1,113 @@
+package ctx
+
+import (
+	"context"
+	"net"
+)
+
+type plainHTTPKey struct{}
+
+var (
+	ctxKeyPlainHTTP = &plainHTTPKey{}
+)
+
+// ContextWithPlainHTTP marks the flow as plain HTTP requests in absolute-form,
+// which are sent to an HTTP proxy without a CONNECT tunnel.
+func ContextWithPlainHTTP(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyPlainHTTP, true)
+}
+
+// IsPlainHTTP reports whether the flow was marked as plain HTTP.
+func IsPlainHTTP(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyPlainHTTP).(bool)
+	return v
+}
+
+type freshConnKey struct{}
+
+var (
+	ctxKeyFreshConn = &freshConnKey{}
+)
+
+// ContextWithFreshConn requests a new connection to the proxy instead of an idle one of the pool,
+// e.g. after an idle connection turned out to be closed by the proxy.
+func ContextWithFreshConn(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKeyFreshConn, true)
+}
+
+// IsFreshConn reports whether a new connection was requested.
+func IsFreshConn(ctx context.Context) bool {
+	v, _ := ctx.Value(ctxKeyFreshConn).(bool)
+	return v
+}
+
+type tlsFingerprintKey struct{}
+
+var (
+	ctxKeyTLSFingerprint = &tlsFingerprintKey{}
+)
+
+// TLSFingerprint holds the fingerprints of the ClientHello of a flow.
+type TLSFingerprint struct {
+	// MD5 hash of the JA3 fingerprint
+	JA3 string
+	JA4 string
+}
+
+func ContextWithTLSFingerprint(ctx context.Context, fp *TLSFingerprint) context.Context {
+	return context.WithValue(ctx, ctxKeyTLSFingerprint, fp)
+}
+
+func TLSFingerprintFromContext(ctx context.Context) *TLSFingerprint {
+	v, _ := ctx.Value(ctxKeyTLSFingerprint).(*TLSFingerprint)
+	return v
+}
+
+type resolvedHostKey struct{}
+
+var (
+	ctxKeyResolvedHost = &resolvedHostKey{}
+)
+
+// ContextWithResolvedHost stores the name the client resolved the destination address for.
+func ContextWithResolvedHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, ctxKeyResolvedHost, host)
+}
+
+func ResolvedHostFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(ctxKeyResolvedHost).(string)
+	return v
+}
+
+type srcAddrKey struct{}
+
+var (
+	ctxKeySrcAddr = &srcAddrKey{}
+)
+
+// ContextWithSrcAddr stores the address of the client of the flow.
+func ContextWithSrcAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, ctxKeySrcAddr, addr)
+}
+
+func SrcAddrFromContext(ctx context.Context) net.Addr {
+	v, _ := ctx.Value(ctxKeySrcAddr).(net.Addr)
+	return v
+}
+
+type dstAddrKey struct{}
+
+var (
+	ctxKeyDstAddr = &dstAddrKey{}
+)
+
+// ContextWithDstAddr stores the original destination address of the flow,
+// before it was mapped to a name.
+func ContextWithDstAddr(ctx context.Context, addr net.Addr) context.Context {
+	return context.WithValue(ctx, ctxKeyDstAddr, addr)
+}
+
+func DstAddrFromContext(ctx context.Context) net.Addr {
+	v, _ := ctx.Value(ctxKeyDstAddr).(net.Addr)
+	return v
+}
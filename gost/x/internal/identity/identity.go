@@ -0,0 +1,72 @@
+// Package identity maps clients to the identity the forwarder uses toward the upstream proxy.
+package identity
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Identity is sent to the upstream proxy for the flows of a client.
+type Identity struct {
+	// Name is the rule that matched, for logs.
+	Name   string
+	User   *url.Userinfo
+	Header http.Header
+}
+
+// Apply sets the headers of the identity on a plain HTTP request,
+// the credentials are sent by the connector.
+func (id *Identity) Apply(header http.Header) {
+	if id == nil {
+		return
+	}
+	for k, vs := range id.Header {
+		header.Del(k)
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+}
+
+// Client describes the source of a flow.
+type Client struct {
+	// Addr is the address of the client.
+	Addr net.Addr
+	// Dst is the original destination, needed to find the socket of local clients.
+	Dst net.Addr
+	// Mark is the socket mark of the accepted connection.
+	Mark int
+
+	uid    int
+	uidSet bool
+}
+
+// UID returns the owner of the socket of a local client, it is looked up once.
+func (c *Client) UID() (int, bool) {
+	if !c.uidSet {
+		c.uidSet = true
+		c.uid = -1
+		if uid, ok := lookupUID(c.Addr, c.Dst); ok {
+			c.uid = uid
+		}
+	}
+	return c.uid, c.uid >= 0
+}
+
+type identityKey struct{}
+
+var (
+	ctxKeyIdentity = &identityKey{}
+)
+
+func ContextWithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, ctxKeyIdentity, id)
+}
+
+// FromContext returns the identity of the flow, nil if the default one is used.
+func FromContext(ctx context.Context) *Identity {
+	v, _ := ctx.Value(ctxKeyIdentity).(*Identity)
+	return v
+}
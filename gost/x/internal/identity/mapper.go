@@ -0,0 +1,411 @@
+package identity
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/logger"
+	"proxy_forwarder/gost/x/internal/loader"
+	xlogger "proxy_forwarder/gost/x/logger"
+)
+
+type options struct {
+	fileLoader loader.Loader
+	httpLoader loader.Loader
+	period     time.Duration
+	logger     logger.Logger
+}
+
+type Option func(opts *options)
+
+func FileLoaderOption(fileLoader loader.Loader) Option {
+	return func(opts *options) {
+		opts.fileLoader = fileLoader
+	}
+}
+
+func HTTPLoaderOption(httpLoader loader.Loader) Option {
+	return func(opts *options) {
+		opts.httpLoader = httpLoader
+	}
+}
+
+func ReloadPeriodOption(period time.Duration) Option {
+	return func(opts *options) {
+		opts.period = period
+	}
+}
+
+func LoggerOption(logger logger.Logger) Option {
+	return func(opts *options) {
+		opts.logger = logger
+	}
+}
+
+// rule matches clients by one of network, mark or uid.
+type rule struct {
+	ipNet *net.IPNet
+	mark  int
+	uid   int
+
+	identity *Identity
+}
+
+func (r *rule) match(c *Client) bool {
+	switch {
+	case r.ipNet != nil:
+		host, _, _ := net.SplitHostPort(c.Addr.String())
+		ip := net.ParseIP(host)
+		return ip != nil && r.ipNet.Contains(ip)
+	case r.mark > 0:
+		return c.Mark == r.mark
+	case r.uid >= 0:
+		uid, ok := c.UID()
+		return ok && uid == r.uid
+	}
+	return false
+}
+
+// Mapper maps clients to identities by the rules loaded from a file or URL.
+//
+// Each line holds a match and the identity:
+//
+//	# match        identity
+//	10.0.1.0/24    auth=build:secret header=X-Client:build%20servers
+//	mark=0x10      header=X-Authenticated-User:dmz
+//	uid=backup     auth=backup auth.file=/run/secrets/backup
+//	*              auth.env=GATEWAY_AUTH
+//
+// The credentials are given inline, or read from an environment variable or a file
+// with auth.env and auth.file as 'user:password' or as the password of the user in auth.
+// The first matching rule wins, '*' is used for unmatched clients.
+type Mapper struct {
+	mu       sync.RWMutex
+	rules    []*rule
+	fallback *Identity
+
+	cancelFunc context.CancelFunc
+	options    options
+}
+
+func NewMapper(opts ...Option) *Mapper {
+	var options options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if options.logger == nil {
+		options.logger = xlogger.Nop()
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	m := &Mapper{
+		cancelFunc: cancel,
+		options:    options,
+	}
+
+	if err := m.reload(ctx); err != nil {
+		options.logger.Warnf("reload: %v", err)
+	}
+	if m.options.period > 0 {
+		go m.periodReload(ctx)
+	}
+
+	return m
+}
+
+// Identify returns the identity of the client, nil if the connector defaults are used.
+func (m *Mapper) Identify(c *Client) *Identity {
+	if m == nil || c == nil || c.Addr == nil {
+		return nil
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, r := range m.rules {
+		if r.match(c) {
+			return r.identity
+		}
+	}
+	return m.fallback
+}
+
+func (m *Mapper) periodReload(ctx context.Context) error {
+	period := m.options.period
+	if period < time.Second {
+		period = time.Second
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := m.reload(ctx); err != nil {
+				m.options.logger.Warnf("reload: %v", err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (m *Mapper) reload(ctx context.Context) error {
+	var rules []*rule
+	var fallback *Identity
+
+	for _, l := range []loader.Loader{m.options.fileLoader, m.options.httpLoader} {
+		if l == nil {
+			continue
+		}
+		r, err := l.Load(ctx)
+		if err != nil {
+			// keep the last rules if the source is not available
+			return err
+		}
+		rs, fb, err := m.parseRules(r)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rs...)
+		if fb != nil {
+			fallback = fb
+		}
+	}
+
+	m.options.logger.Debugf("load items %d", len(rules))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rules = rules
+	m.fallback = fallback
+	return nil
+}
+
+func (m *Mapper) parseRules(r io.Reader) (rules []*rule, fallback *Identity, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+
+		id, err := parseIdentity(fields[0], fields[1:])
+		if errors.Is(err, errSecret) {
+			// keep the last rules until the credentials are readable again
+			return nil, nil, fmt.Errorf("%s: %w", fields[0], err)
+		}
+		if err != nil {
+			m.options.logger.Warnf("%s: %v", line, err)
+			continue
+		}
+		if fields[0] == "*" {
+			fallback = id
+			continue
+		}
+
+		r, err := parseMatch(fields[0])
+		if err != nil {
+			m.options.logger.Warnf("%s: %v", line, err)
+			continue
+		}
+		r.identity = id
+		rules = append(rules, r)
+	}
+	err = scanner.Err()
+	return
+}
+
+func parseMatch(s string) (*rule, error) {
+	r := &rule{uid: -1}
+
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		if ip := net.ParseIP(s); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			r.ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+			return r, nil
+		}
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		r.ipNet = ipNet
+		return r, nil
+	}
+
+	switch key {
+	case "mark":
+		mark, err := strconv.ParseInt(value, 0, 32)
+		if err != nil || mark <= 0 {
+			return nil, fmt.Errorf("invalid mark %q", value)
+		}
+		r.mark = int(mark)
+	case "uid":
+		uid, err := strconv.Atoi(value)
+		if err != nil {
+			u, lerr := user.Lookup(value)
+			if lerr != nil {
+				return nil, lerr
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		r.uid = uid
+	default:
+		return nil, fmt.Errorf("unknown match %q", key)
+	}
+	return r, nil
+}
+
+var (
+	errSecret     = errors.New("credentials of the identity are not available")
+	errAuthFormat = errors.New("credentials are not in the form 'user:password'")
+)
+
+func parseIdentity(name string, fields []string) (*Identity, error) {
+	id := &Identity{
+		Name: name,
+	}
+	var username, env, file string
+	for _, f := range fields {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "auth":
+			u, p, ok := strings.Cut(value, ":")
+			if ok {
+				id.User = url.UserPassword(u, p)
+			} else {
+				username = u
+			}
+		case "auth.env":
+			env = value
+		case "auth.file":
+			file = value
+		case "header":
+			// values are URL-escaped to contain spaces
+			k, v, ok := strings.Cut(value, ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid header %q", value)
+			}
+			if uv, err := url.PathUnescape(v); err == nil {
+				v = uv
+			}
+			if id.Header == nil {
+				id.Header = http.Header{}
+			}
+			id.Header.Add(k, v)
+		default:
+			return nil, fmt.Errorf("unknown identity attribute %q", key)
+		}
+	}
+
+	if env == "" && file == "" {
+		if username != "" {
+			id.User = url.User(username)
+		}
+		return id, nil
+	}
+
+	v, err := readSecret(env, file)
+	if err != nil {
+		return nil, err
+	}
+	// the secret is the password of the user in auth, or 'user:password'
+	if username != "" {
+		id.User = url.UserPassword(username, v)
+		return id, nil
+	}
+	u, p, ok := strings.Cut(v, ":")
+	if !ok || u == "" || p == "" {
+		return nil, fmt.Errorf("%w: %v", errSecret, errAuthFormat)
+	}
+	id.User = url.UserPassword(u, p)
+	return id, nil
+}
+
+// readSecret returns the value of the environment variable or the first line of the file.
+func readSecret(env, file string) (string, error) {
+	var v string
+	if env != "" {
+		v = os.Getenv(env)
+	}
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", errSecret, err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line != "" && !strings.HasPrefix(line, "#") {
+				v = line
+				break
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", fmt.Errorf("%w: %v", errSecret, err)
+		}
+	}
+	if v == "" {
+		// e.g. a file truncated while the credentials are rotated
+		return "", fmt.Errorf("%w: the value is empty", errSecret)
+	}
+	return v, nil
+}
+
+func (m *Mapper) Close() error {
+	m.cancelFunc()
+	if m.options.fileLoader != nil {
+		m.options.fileLoader.Close()
+	}
+	if m.options.httpLoader != nil {
+		m.options.httpLoader.Close()
+	}
+	return nil
+}
+
+var (
+	mappersMu sync.Mutex
+	mappers   = map[string]*Mapper{}
+)
+
+// FromSource returns the mapper for a file or http(s) URL, the services share one mapper per source.
+func FromSource(source string, period time.Duration, logger logger.Logger) *Mapper {
+	mappersMu.Lock()
+	defer mappersMu.Unlock()
+
+	if m, ok := mappers[source]; ok {
+		return m
+	}
+
+	opts := []Option{
+		ReloadPeriodOption(period),
+		LoggerOption(logger),
+	}
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		opts = append(opts, HTTPLoaderOption(loader.HTTPLoader(source)))
+	} else {
+		opts = append(opts, FileLoaderOption(loader.FileLoader(source)))
+	}
+	m := NewMapper(opts...)
+	mappers[source] = m
+	return m
+}
@@ -0,0 +1,100 @@
+package identity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/cpu"
+)
+
+// lookupUID finds the owner of the socket of a local client in /proc/net.
+// The socket of the client still has the original destination as peer.
+func lookupUID(addr, dst net.Addr) (int, bool) {
+	if addr == nil {
+		return 0, false
+	}
+	proto := "tcp"
+	if strings.HasPrefix(addr.Network(), "udp") {
+		proto = "udp"
+	}
+	local := tcpUDPAddr(addr)
+	if local == nil {
+		return 0, false
+	}
+	remote := tcpUDPAddr(dst)
+
+	for _, file := range []string{"/proc/net/" + proto, "/proc/net/" + proto + "6"} {
+		if uid, ok := lookupUIDFile(file, local, remote); ok {
+			return uid, true
+		}
+	}
+	return 0, false
+}
+
+func lookupUIDFile(file string, local, remote *net.TCPAddr) (int, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid ...
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+		if !procAddrEqual(fields[1], local) {
+			continue
+		}
+		// unconnected UDP sockets have no peer
+		if remote != nil && !procAddrEqual(fields[2], remote) && !strings.HasPrefix(fields[2], "00000000") {
+			continue
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			continue
+		}
+		return uid, true
+	}
+	return 0, false
+}
+
+// procAddrEqual compares an address of /proc/net, the IP is printed as 32-bit words in host byte order.
+func procAddrEqual(s string, addr *net.TCPAddr) bool {
+	host, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return false
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil || int(p) != addr.Port {
+		return false
+	}
+	b, err := hex.DecodeString(host)
+	if err != nil || len(b)%4 != 0 {
+		return false
+	}
+	if !cpu.IsBigEndian {
+		for i := 0; i < len(b); i += 4 {
+			binary.BigEndian.PutUint32(b[i:], binary.LittleEndian.Uint32(b[i:]))
+		}
+	}
+	return net.IP(b).Equal(addr.IP)
+}
+
+func tcpUDPAddr(addr net.Addr) *net.TCPAddr {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package loop
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"proxy_forwarder/gost/core/chain"
+)
+
+// Reasons of rejected loops, they are used as metric labels.
+const (
+	ReasonListener = "listener"
+	ReasonUpstream = "upstream"
+	ReasonMark     = "mark"
+	ReasonMarker   = "marker"
+
+	// upstream proxy names are resolved again after this time
+	upstreamsTTL = time.Minute
+)
+
+var (
+	ErrListener = errors.New("redirect loop: the original destination is a listener of the forwarder")
+	ErrUpstream = errors.New("redirect loop: the original destination is the upstream proxy")
+	ErrMark     = errors.New("redirect loop: the flow carries the socket mark of the forwarder")
+	ErrMarker   = errors.New("redirect loop: the request was sent by the forwarder itself")
+)
+
+var reasonErrors = map[string]error{
+	ReasonListener: ErrListener,
+	ReasonUpstream: ErrUpstream,
+	ReasonMark:     ErrMark,
+	ReasonMarker:   ErrMarker,
+}
+
+// Error returns the error logged for a reason.
+func Error(reason string) error {
+	return reasonErrors[reason]
+}
+
+// Detector detects flows that were redirected back to the forwarder
+// by their original destination and the mark of their packets.
+type Detector struct {
+	upstreams *Upstreams
+	mark      int
+}
+
+// NewDetector creates the detector of a handler. The upstream proxies and
+// the mark set on the connections to them are taken from the router.
+func NewDetector(router *chain.Router) *Detector {
+	d := &Detector{}
+
+	var upstreams []Upstream
+	if opts := router.Options(); opts != nil {
+		if v, ok := opts.Chain.(interface{ Nodes() []*chain.Node }); ok {
+			for _, node := range v.Nodes() {
+				upstreams = append(upstreams, Upstream{
+					Addr:       node.Addr,
+					Resolver:   node.Options().Resolver,
+					HostMapper: node.Options().HostMapper,
+				})
+			}
+		}
+		if opts.SockOpts != nil {
+			d.mark = opts.SockOpts.Mark
+		}
+	}
+	d.upstreams = NewUpstreams(upstreams, upstreamsTTL)
+	return d
+}
+
+// Detect returns the reason if the flow to dstAddr was redirected back to the forwarder.
+// The mark is the one of the client connection or packets, 0 if it is not known.
+func (d *Detector) Detect(dstAddr net.Addr, mark int) string {
+	if IsListener(dstAddr) {
+		return ReasonListener
+	}
+	if d.upstreams.Contains(dstAddr) {
+		return ReasonUpstream
+	}
+	if d.mark > 0 && mark == d.mark {
+		return ReasonMark
+	}
+	return ""
+}
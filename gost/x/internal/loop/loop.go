@@ -0,0 +1,272 @@
+// Package loop detects flows that would be sent back to the forwarder itself.
+package loop
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/hosts"
+	"proxy_forwarder/gost/core/resolver"
+	"proxy_forwarder/log"
+)
+
+const (
+	// local addresses are refreshed at most this often
+	localAddrsTTL = 30 * time.Second
+	// a lookup of an upstream proxy name takes at most this long
+	upstreamsLookupTimeout = 5 * time.Second
+)
+
+var (
+	// token marks the requests of this process, it is sent in the Via header.
+	token = newToken()
+
+	mu        sync.RWMutex
+	listeners = map[string]int{}
+
+	localMu      sync.Mutex
+	localAddrs   map[string]struct{}
+	localUpdated time.Time
+)
+
+func newToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "proxy-forwarder-" + hex.EncodeToString(b)
+}
+
+// Via returns the Via header value for requests sent by the forwarder.
+func Via() string {
+	return "1.1 " + token
+}
+
+// IsMarked reports whether the Via header values contain the token of this process.
+func IsMarked(via []string) bool {
+	for _, v := range via {
+		if strings.Contains(v, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddListener registers the address of a listener of the forwarder.
+func AddListener(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	listeners[addr.String()]++
+}
+
+func RemoveListener(addr net.Addr) {
+	if addr == nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if listeners[addr.String()]--; listeners[addr.String()] <= 0 {
+		delete(listeners, addr.String())
+	}
+}
+
+// IsListener reports whether addr is the port of a listener of the forwarder
+// on one of the local addresses.
+func IsListener(addr net.Addr) bool {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for s := range listeners {
+		lhost, lport, _ := net.SplitHostPort(s)
+		if lport != port {
+			continue
+		}
+		if lip := net.ParseIP(lhost); lip.Equal(ip) || IsLocal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLocal reports whether ip is an address of this host.
+func IsLocal(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+
+	localMu.Lock()
+	defer localMu.Unlock()
+
+	if localAddrs == nil || time.Since(localUpdated) > localAddrsTTL {
+		localAddrs = map[string]struct{}{}
+		localUpdated = time.Now()
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok {
+				localAddrs[ipn.IP.String()] = struct{}{}
+			}
+		}
+	}
+
+	_, ok := localAddrs[ip.String()]
+	return ok
+}
+
+// Upstream is a proxy the forwarder connects to. Its name is resolved by
+// the host mapper and resolver of the node, like it is for the connections.
+type Upstream struct {
+	Addr       string
+	Resolver   resolver.Resolver
+	HostMapper hosts.HostMapper
+}
+
+// Upstreams resolves the addresses of the proxies the forwarder connects to.
+// The names are resolved in the background, flows are checked against the
+// addresses known so far and never wait for a lookup.
+type Upstreams struct {
+	upstreams []Upstream
+	ttl       time.Duration
+	// addresses of the proxies given as IP
+	literal map[string]struct{}
+
+	mu        sync.RWMutex
+	resolved  map[string]struct{}
+	names     map[string][]string
+	updated   time.Time
+	resolving bool
+}
+
+func NewUpstreams(upstreams []Upstream, ttl time.Duration) *Upstreams {
+	u := &Upstreams{
+		upstreams: upstreams,
+		ttl:       ttl,
+		literal:   map[string]struct{}{},
+		resolved:  map[string]struct{}{},
+		names:     map[string][]string{},
+	}
+	for _, up := range upstreams {
+		host, port, err := splitHostPort(up.Addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			u.literal[net.JoinHostPort(ip.String(), port)] = struct{}{}
+			u.resolved[net.JoinHostPort(ip.String(), port)] = struct{}{}
+		}
+	}
+	return u
+}
+
+// Contains reports whether addr is the address of one of the upstream proxies.
+func (u *Upstreams) Contains(addr net.Addr) bool {
+	if u == nil || len(u.upstreams) == 0 {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	u.mu.RLock()
+	_, ok := u.resolved[net.JoinHostPort(ip.String(), port)]
+	stale := !u.resolving && time.Since(u.updated) > u.ttl
+	u.mu.RUnlock()
+
+	if stale {
+		u.mu.Lock()
+		if !u.resolving && time.Since(u.updated) > u.ttl {
+			u.resolving = true
+			go u.resolve()
+		}
+		u.mu.Unlock()
+	}
+	return ok
+}
+
+// resolve looks up the names of the upstream proxies and swaps in the new addresses.
+// The previous addresses of a name are kept if its lookup fails.
+func (u *Upstreams) resolve() {
+	names := map[string][]string{}
+	for _, up := range u.upstreams {
+		host, port, err := splitHostPort(up.Addr)
+		if err != nil || net.ParseIP(host) != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), upstreamsLookupTimeout)
+		ips, err := lookup(ctx, host, up.Resolver, up.HostMapper)
+		cancel()
+		if err != nil || len(ips) == 0 {
+			log.Debug("loop", fmt.Sprintf("resolving upstream %s: %v", host, err))
+			u.mu.RLock()
+			names[up.Addr] = u.names[up.Addr]
+			u.mu.RUnlock()
+			continue
+		}
+		for _, ip := range ips {
+			names[up.Addr] = append(names[up.Addr], net.JoinHostPort(ip.String(), port))
+		}
+	}
+
+	resolved := map[string]struct{}{}
+	for addr := range u.literal {
+		resolved[addr] = struct{}{}
+	}
+	for _, addrs := range names {
+		for _, addr := range addrs {
+			resolved[addr] = struct{}{}
+		}
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.resolved = resolved
+	u.names = names
+	u.updated = time.Now()
+	u.resolving = false
+}
+
+// lookup resolves host by the host mapper and the resolver of the node, the system resolver is used without them.
+func lookup(ctx context.Context, host string, r resolver.Resolver, hostMapper hosts.HostMapper) ([]net.IP, error) {
+	if hostMapper != nil {
+		if ips, _ := hostMapper.Lookup(ctx, "ip", host); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	if r != nil {
+		ips, err := r.Resolve(ctx, "ip", host)
+		if !errors.Is(err, resolver.ErrInvalid) {
+			return ips, err
+		}
+	}
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func splitHostPort(addr string) (host, port string, err error) {
+	if host, port, err = net.SplitHostPort(addr); err != nil {
+		return
+	}
+	_, err = strconv.Atoi(port)
+	return
+}
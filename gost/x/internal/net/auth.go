@@ -0,0 +1,45 @@
+package net
+
+import (
+	"io"
+	"net/http"
+)
+
+const (
+	// MaxAuthRounds is the number of times a request is sent again to answer
+	// the challenges of the proxy, NTLM needs two after the initial one.
+	MaxAuthRounds = 4
+	// bodies of 407 responses up to this size are skipped to keep the connection
+	maxDrainSize = 64 << 10
+)
+
+// AuthRoundTrip sends a request to the proxy and sends it again with the answers to the
+// authentication challenges of the proxy. send sends the request with the Proxy-Authorization
+// value, empty for none, answer returns the value answering a 407 response, empty if the
+// challenge can't be answered. The returned response is the last one, its body is not read.
+func AuthRoundTrip(authorization string,
+	send func(round int, authorization string) (*http.Response, error),
+	answer func(resp *http.Response, sent string) string) (*http.Response, error) {
+	for round := 0; ; round++ {
+		resp, err := send(round, authorization)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusProxyAuthRequired || round >= MaxAuthRounds {
+			return resp, nil
+		}
+		next := answer(resp, authorization)
+		// the challenge is answered on the same connection
+		if next == "" || resp.Close || !DrainBody(resp) {
+			return resp, nil
+		}
+		authorization = next
+	}
+}
+
+// DrainBody reads a small body to completion, so the connection can be reused.
+func DrainBody(resp *http.Response) bool {
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, io.LimitReader(resp.Body, maxDrainSize+1))
+	return err == nil && n <= maxDrainSize
+}
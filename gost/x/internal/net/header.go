@@ -0,0 +1,80 @@
+package net
+
+import (
+	"net"
+	"net/http"
+)
+
+// appendHeaders are lists, the values of the proxy are added to the ones of the client.
+var appendHeaders = []string{"X-Forwarded-For", "Forwarded"}
+
+// ProxyAuthenticator answers the authentication challenges of the proxy for plain HTTP requests.
+type ProxyAuthenticator interface {
+	// Authorization returns the Proxy-Authorization of a request before the proxy asked for it.
+	Authorization(method, uri string) string
+	// Answer returns the Proxy-Authorization answering a 407 response,
+	// empty if the challenge can't be answered or the last answer was rejected.
+	Answer(resp *http.Response, method, uri, sent string) string
+}
+
+type proxyHeaderConn struct {
+	net.Conn
+	header http.Header
+	auth   ProxyAuthenticator
+}
+
+// NewProxyHeaderConn returns a connection to an HTTP proxy that plain HTTP requests are written to,
+// the handler adds the header to each request with SetProxyHeader and answers the
+// challenges of the proxy with the authenticator, which may be nil.
+func NewProxyHeaderConn(conn net.Conn, header http.Header, auth ProxyAuthenticator) net.Conn {
+	if len(header) == 0 && auth == nil {
+		return conn
+	}
+	return &proxyHeaderConn{
+		Conn:   conn,
+		header: header,
+		auth:   auth,
+	}
+}
+
+// ProxyAuthenticatorFromConn returns the authenticator of a connection created by NewProxyHeaderConn.
+func ProxyAuthenticatorFromConn(conn net.Conn) ProxyAuthenticator {
+	if c, ok := conn.(*proxyHeaderConn); ok {
+		return c.auth
+	}
+	return nil
+}
+
+// SetProxyHeader adds the header of a connection created by NewProxyHeaderConn to a request.
+// X-Forwarded-For and Forwarded are appended to the values of the client, other headers are
+// replaced, so they can't be set by the client.
+func SetProxyHeader(conn net.Conn, header http.Header) {
+	c, ok := conn.(*proxyHeaderConn)
+	if !ok {
+		return
+	}
+	for k, vs := range c.header {
+		appendValues := false
+		for _, h := range appendHeaders {
+			if k == h {
+				appendValues = true
+			}
+		}
+		if !appendValues {
+			header.Del(k)
+		}
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+}
+
+// Release returns the connection to the pool of the node.
+func (c *proxyHeaderConn) Release() error {
+	return Release(c.Conn)
+}
+
+// Reused reports whether the pooled connection was idle before.
+func (c *proxyHeaderConn) Reused() bool {
+	return Reused(c.Conn)
+}
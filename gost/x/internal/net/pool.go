@@ -0,0 +1,29 @@
+package net
+
+import (
+	"net"
+)
+
+// Releaser is implemented by connections from a pool.
+type Releaser interface {
+	// Release returns the connection to the pool instead of closing it.
+	// It may only be called if nothing is left to read on the connection.
+	Release() error
+}
+
+// Release returns a pooled connection for reuse, other connections are closed.
+func Release(conn net.Conn) error {
+	if r, ok := conn.(Releaser); ok {
+		return r.Release()
+	}
+	return conn.Close()
+}
+
+// Reused reports whether a pooled connection was idle before, a request failing on it
+// may be sent again on a new connection.
+func Reused(conn net.Conn) bool {
+	if r, ok := conn.(interface{ Reused() bool }); ok {
+		return r.Reused()
+	}
+	return false
+}
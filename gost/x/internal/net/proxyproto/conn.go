@@ -6,12 +6,38 @@ import (
 	proxyproto "github.com/pires/go-proxyproto"
 )
 
-func WrapClientConn(ppv int, src, dst net.Addr, c net.Conn) net.Conn {
+// WrapClientConn writes the PROXY protocol header of version ppv to c, announcing src and dst.
+// The upstream connection is a stream, so UDP addresses are announced as TCP. If the addresses
+// can't be announced (unknown or mixed address families), the ones of c are used.
+func WrapClientConn(ppv int, src, dst net.Addr, c net.Conn) (net.Conn, error) {
 	if ppv <= 0 {
-		return c
+		return c, nil
 	}
 
-	header := proxyproto.HeaderProxyFromAddrs(byte(ppv), src, dst)
-	header.WriteTo(c)
-	return c
+	srcAddr, dstAddr := tcpAddr(src), tcpAddr(dst)
+	if srcAddr == nil || dstAddr == nil || (srcAddr.IP.To4() == nil) != (dstAddr.IP.To4() == nil) {
+		srcAddr, dstAddr = tcpAddr(c.LocalAddr()), tcpAddr(c.RemoteAddr())
+	}
+
+	var header *proxyproto.Header
+	if srcAddr != nil && dstAddr != nil {
+		header = proxyproto.HeaderProxyFromAddrs(byte(ppv), srcAddr, dstAddr)
+	} else {
+		// LOCAL command, the proxy uses the addresses of the connection
+		header = proxyproto.HeaderProxyFromAddrs(byte(ppv), nil, nil)
+	}
+	if _, err := header.WriteTo(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v
+	case *net.UDPAddr:
+		return &net.TCPAddr{IP: v.IP, Port: v.Port, Zone: v.Zone}
+	}
+	return nil
 }
@@ -0,0 +1,339 @@
+package quic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sort"
+)
+
+const (
+	Version1 uint32 = 0x00000001
+	Version2 uint32 = 0x6b3343cf
+
+	// transport error code of RFC 9000 section 20.1
+	ConnectionRefused uint64 = 0x02
+
+	frameTypePadding          = 0x00
+	frameTypePing             = 0x01
+	frameTypeAck              = 0x02
+	frameTypeAckECN           = 0x03
+	frameTypeCrypto           = 0x06
+	frameTypeConnectionClose  = 0x1c
+	frameTypeApplicationClose = 0x1d
+
+	maxConnectionIDLen = 20
+	sampleLen          = 16
+)
+
+var (
+	ErrNotInitial        = errors.New("not a QUIC initial packet")
+	ErrMalformed         = errors.New("malformed QUIC initial packet")
+	ErrIncomplete        = errors.New("incomplete ClientHello")
+	ErrNotClientHello    = errors.New("CRYPTO stream does not start with a ClientHello")
+	errUnsupportedFrame  = errors.New("unsupported frame in QUIC initial packet")
+	errVarintOutOfBounds = errors.New("varint exceeds the packet")
+)
+
+// CryptoFrame is a chunk of the TLS handshake carried in a CRYPTO frame.
+type CryptoFrame struct {
+	Offset uint64
+	Data   []byte
+}
+
+// InitialPacket is a decrypted client Initial packet.
+type InitialPacket struct {
+	Version uint32
+	DCID    []byte
+	SCID    []byte
+	Crypto  []CryptoFrame
+}
+
+// IsInitial reports whether b starts with a long header Initial packet of a supported version.
+func IsInitial(b []byte) bool {
+	if len(b) < 5 || b[0]&0xc0 != 0xc0 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(b[1:5]) {
+	case Version1:
+		return (b[0]>>4)&0x03 == 0x00
+	case Version2:
+		return (b[0]>>4)&0x03 == 0x01
+	}
+	return false
+}
+
+// ParseInitial removes the protection of the first Initial packet in the datagram b,
+// coalesced packets following it are ignored.
+func ParseInitial(b []byte) (*InitialPacket, error) {
+	if !IsInitial(b) {
+		return nil, ErrNotInitial
+	}
+
+	p := &InitialPacket{
+		Version: binary.BigEndian.Uint32(b[1:5]),
+	}
+	off := 5
+
+	var err error
+	if p.DCID, off, err = readConnectionID(b, off); err != nil {
+		return nil, err
+	}
+	if p.SCID, off, err = readConnectionID(b, off); err != nil {
+		return nil, err
+	}
+
+	tokenLen, n, err := readVarint(b[off:])
+	if err != nil {
+		return nil, err
+	}
+	off += n
+	if tokenLen > uint64(len(b)-off) {
+		return nil, ErrMalformed
+	}
+	off += int(tokenLen)
+
+	length, n, err := readVarint(b[off:])
+	if err != nil {
+		return nil, err
+	}
+	off += n
+	pnOffset := off
+	if length > uint64(len(b)-pnOffset) || length < 4+sampleLen {
+		return nil, ErrMalformed
+	}
+
+	// header protection is removed in place, work on a copy of the packet
+	packet := make([]byte, pnOffset+int(length))
+	copy(packet, b)
+
+	keys, err := newInitialKeys(p.Version, p.DCID, false)
+	if err != nil {
+		return nil, err
+	}
+	mask := keys.headerMask(packet[pnOffset+4 : pnOffset+4+sampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	pnLen := int(packet[0]&0x03) + 1
+
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(packet[pnOffset+i])
+	}
+
+	header := packet[:pnOffset+pnLen]
+	payload, err := keys.aead.Open(nil, keys.nonce(pn), packet[pnOffset+pnLen:], header)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Crypto, err = parseFrames(payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func readConnectionID(b []byte, off int) ([]byte, int, error) {
+	if off >= len(b) {
+		return nil, off, ErrMalformed
+	}
+	l := int(b[off])
+	off++
+	if l > maxConnectionIDLen || off+l > len(b) {
+		return nil, off, ErrMalformed
+	}
+	return b[off : off+l], off + l, nil
+}
+
+// parseFrames returns the CRYPTO frames of a decrypted Initial payload.
+func parseFrames(b []byte) (frames []CryptoFrame, err error) {
+	for len(b) > 0 {
+		typ, n, err := readVarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+
+		switch typ {
+		case frameTypePadding, frameTypePing:
+
+		case frameTypeAck, frameTypeAckECN:
+			// largest acknowledged, delay, range count and first range
+			var fields [4]uint64
+			for i := range fields {
+				if fields[i], n, err = readVarint(b); err != nil {
+					return nil, err
+				}
+				b = b[n:]
+			}
+			skip := 2 * fields[2]
+			if typ == frameTypeAckECN {
+				skip += 3
+			}
+			for i := uint64(0); i < skip; i++ {
+				if _, n, err = readVarint(b); err != nil {
+					return nil, err
+				}
+				b = b[n:]
+			}
+
+		case frameTypeCrypto:
+			offset, n, err := readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			length, n, err := readVarint(b)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			if length > uint64(len(b)) {
+				return nil, ErrMalformed
+			}
+			frames = append(frames, CryptoFrame{
+				Offset: offset,
+				Data:   b[:length],
+			})
+			b = b[length:]
+
+		case frameTypeConnectionClose, frameTypeApplicationClose:
+			// error code, the frame type of transport errors and the reason phrase
+			fields := 2
+			if typ == frameTypeConnectionClose {
+				fields = 3
+			}
+			var v uint64
+			for i := 0; i < fields; i++ {
+				if v, n, err = readVarint(b); err != nil {
+					return nil, err
+				}
+				b = b[n:]
+			}
+			if v > uint64(len(b)) {
+				return nil, ErrMalformed
+			}
+			b = b[v:]
+
+		default:
+			return nil, errUnsupportedFrame
+		}
+	}
+	return
+}
+
+// ClientHello reassembles the ClientHello handshake message from the CRYPTO frames of the packets.
+// It returns ErrIncomplete if the client has not sent all of it yet.
+func ClientHello(packets ...*InitialPacket) ([]byte, error) {
+	var frames []CryptoFrame
+	for _, p := range packets {
+		frames = append(frames, p.Crypto...)
+	}
+	sort.Slice(frames, func(i, j int) bool {
+		return frames[i].Offset < frames[j].Offset
+	})
+
+	var b []byte
+	for _, f := range frames {
+		if f.Offset > uint64(len(b)) {
+			break
+		}
+		if end := f.Offset + uint64(len(f.Data)); end > uint64(len(b)) {
+			b = append(b, f.Data[uint64(len(b))-f.Offset:]...)
+		}
+	}
+
+	if len(b) < 4 {
+		return nil, ErrIncomplete
+	}
+	// handshake type client_hello(1) followed by the uint24 length
+	if b[0] != 0x01 {
+		return nil, ErrNotClientHello
+	}
+	l := 4 + (int(b[1])<<16 | int(b[2])<<8 | int(b[3]))
+	if len(b) < l {
+		return nil, ErrIncomplete
+	}
+	return b[:l], nil
+}
+
+// NewConnectionClose builds the server Initial packet that refuses the connection
+// of the client Initial p with a CONNECTION_CLOSE frame.
+func NewConnectionClose(p *InitialPacket, code uint64) ([]byte, error) {
+	keys, err := newInitialKeys(p.Version, p.DCID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	scid := make([]byte, 8)
+	if _, err := rand.Read(scid); err != nil {
+		return nil, err
+	}
+
+	// CONNECTION_CLOSE with the frame type 0 and an empty reason,
+	// padded so the header protection sample is available
+	payload := []byte{frameTypeConnectionClose}
+	payload = appendVarint(payload, code)
+	payload = append(payload, 0x00, 0x00)
+	for len(payload) < 4 {
+		payload = append(payload, frameTypePadding)
+	}
+
+	typ := byte(0x00)
+	if p.Version == Version2 {
+		typ = 0x01
+	}
+	// the packet number is always encoded using 1 byte
+	header := []byte{0xc0 | typ<<4}
+	header = binary.BigEndian.AppendUint32(header, p.Version)
+	header = append(header, byte(len(p.SCID)))
+	header = append(header, p.SCID...)
+	header = append(header, byte(len(scid)))
+	header = append(header, scid...)
+	header = append(header, 0x00)
+	header = appendVarint2(header, uint64(1+len(payload)+keys.aead.Overhead()))
+	pnOffset := len(header)
+	header = append(header, 0x00)
+
+	packet := keys.aead.Seal(header, keys.nonce(0), payload, header)
+
+	mask := keys.headerMask(packet[pnOffset+4 : pnOffset+4+sampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	packet[pnOffset] ^= mask[1]
+
+	return packet, nil
+}
+
+func readVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errVarintOutOfBounds
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, errVarintOutOfBounds
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, nil
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return appendVarint2(b, v)
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// appendVarint2 encodes v < 2^14 using 2 bytes.
+func appendVarint2(b []byte, v uint64) []byte {
+	return append(b, byte(v>>8)|0x40, byte(v))
+}
@@ -0,0 +1,362 @@
+package quic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	dissector "proxy_forwarder/gost/tls-dissector"
+)
+
+// dcid is the Destination Connection ID of the client Initial in RFC 9001 Appendix A and RFC 9369 Appendix A.
+var dcid = unhex("8394c8f03e515708")
+
+// clientHelloFrame follows the CRYPTO frame of the client Initial in RFC 9001 Appendix A.2,
+// the ClientHello carries the server name example.com.
+var clientHelloFrame = unhex("" +
+	"060040f1010000ed0303ebf8fa56f12939b9584a3896472ec40bb863cfd3e868" +
+	"04fe3a47f06a2b69484c00000413011302010000c000000010000e00000b6578" +
+	"616d706c652e636f6dff01000100000a00080006001d00170018001000070005" +
+	"04616c706e000500050100000000003300260024001d00209370b2c9caa47fba" +
+	"baf4559fedba753de171fa71f50f1ce15d43e994ec74d748002b000302030400" +
+	"0d0010000e0403050306030203080408050806002d00020101001c0002400100" +
+	"3900320408ffffffffffffffff05048000ffff07048000ffff08011001048000" +
+	"75300901100f088394c8f03e51570806048000ffff")
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestInitialKeys(t *testing.T) {
+	tests := []struct {
+		version uint32
+		server  bool
+		key     string
+		iv      string
+		hp      string
+	}{
+		// RFC 9001 Appendix A.1
+		{Version1, false, "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+		{Version1, true, "cf3a5331653c364c88f0f379b6067e37", "0ac1493ca1905853b0bba03e", "c206b8d9b9f0f37644430b490eeaa314"},
+		// RFC 9369 Appendix A.1
+		{Version2, false, "8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+		{Version2, true, "82db637861d55e1d011f19ea71d5d2a7", "dd13c276499c0249d3310652", "edf6d05c83121201b436e16877593c3a"},
+	}
+	for _, tt := range tests {
+		keys, err := newInitialKeys(tt.version, dcid, tt.server)
+		if err != nil {
+			t.Fatalf("version 0x%08x: %v", tt.version, err)
+		}
+		if iv := hex.EncodeToString(keys.iv); iv != tt.iv {
+			t.Errorf("version 0x%08x server %v: iv %s, want %s", tt.version, tt.server, iv, tt.iv)
+		}
+
+		// the keys are not exposed by the ciphers, compare what they produce
+		want := newTestKeys(t, tt.key, tt.iv, tt.hp)
+		sample := make([]byte, sampleLen)
+		if got, want := keys.headerMask(sample), want.headerMask(sample); !bytes.Equal(got, want) {
+			t.Errorf("version 0x%08x server %v: header protection key differs", tt.version, tt.server)
+		}
+		nonce := keys.nonce(2)
+		if got, want := keys.aead.Seal(nil, nonce, sample, nil), want.aead.Seal(nil, nonce, sample, nil); !bytes.Equal(got, want) {
+			t.Errorf("version 0x%08x server %v: packet protection key differs", tt.version, tt.server)
+		}
+	}
+
+	if _, err := newInitialKeys(0xff00001d, dcid, false); err == nil {
+		t.Errorf("draft version: no error")
+	}
+}
+
+func TestHeaderMask(t *testing.T) {
+	tests := []struct {
+		version uint32
+		server  bool
+		sample  string
+		mask    string
+	}{
+		// RFC 9001 Appendix A.2 and A.3
+		{Version1, false, "d1b1c98dd7689fb8ec11d242b123dc9b", "437b9aec36"},
+		{Version1, true, "2cd0991cd25b0aac406a5816b6394100", "2ec0d8356a"},
+		// RFC 9369 Appendix A.2
+		{Version2, false, "ffe67b6abcdb4298b485dd04de806071", "94a0c95e80"},
+	}
+	for _, tt := range tests {
+		keys, err := newInitialKeys(tt.version, dcid, tt.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mask := hex.EncodeToString(keys.headerMask(unhex(tt.sample))[:5]); mask != tt.mask {
+			t.Errorf("version 0x%08x server %v: mask %s, want %s", tt.version, tt.server, mask, tt.mask)
+		}
+	}
+}
+
+// TestParseInitial protects the client Initial of RFC 9001 Appendix A.2 and RFC 9369 Appendix A.2
+// with the keys of the RFCs and checks it is read back.
+func TestParseInitial(t *testing.T) {
+	tests := []struct {
+		version uint32
+		keys    [3]string
+		// the protected header up to the packet number and the start of the ciphertext
+		prefix string
+	}{
+		{
+			Version1,
+			[3]string{"1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2"},
+			"c000000001088394c8f03e5157080000449e7b9aec34d1b1c98dd7689fb8ec11d242b123dc9b",
+		},
+		{
+			Version2,
+			[3]string{"8b1a0bc121284290a29e0971b5cd045d", "91f73e2351d8fa91660e909f", "45b95e15235d6f45a6b19cbcb0294ba9"},
+			"d76b3343cf088394c8f03e5157080000449ea0c95e82ffe67b6abcdb4298b485dd04de806071",
+		},
+	}
+	for _, tt := range tests {
+		keys := newTestKeys(t, tt.keys[0], tt.keys[1], tt.keys[2])
+		packet := protectClientInitial(keys, tt.version, clientHelloFrame)
+		if prefix := hex.EncodeToString(packet[:len(tt.prefix)/2]); prefix != tt.prefix {
+			t.Fatalf("version 0x%08x: packet starts with %s, want %s", tt.version, prefix, tt.prefix)
+		}
+
+		if !IsInitial(packet) {
+			t.Fatalf("version 0x%08x: not an Initial packet", tt.version)
+		}
+		p, err := ParseInitial(packet)
+		if err != nil {
+			t.Fatalf("version 0x%08x: %v", tt.version, err)
+		}
+		if p.Version != tt.version || !bytes.Equal(p.DCID, dcid) || len(p.SCID) != 0 {
+			t.Errorf("version 0x%08x: header %08x %x %x", tt.version, p.Version, p.DCID, p.SCID)
+		}
+
+		raw, err := ClientHello(p)
+		if err != nil {
+			t.Fatalf("version 0x%08x: %v", tt.version, err)
+		}
+		if !bytes.Equal(raw, clientHelloFrame[4:]) {
+			t.Errorf("version 0x%08x: ClientHello differs", tt.version)
+		}
+		clientHello := dissector.ClientHelloMsg{}
+		if err := clientHello.Decode(raw); err != nil {
+			t.Fatalf("version 0x%08x: %v", tt.version, err)
+		}
+		var sni string
+		for _, ext := range clientHello.Extensions {
+			if ext.Type() == dissector.ExtServerName {
+				sni = ext.(*dissector.ServerNameExtension).Name
+			}
+		}
+		if sni != "example.com" {
+			t.Errorf("version 0x%08x: server name %q, want example.com", tt.version, sni)
+		}
+	}
+}
+
+func TestParseInitialMalformed(t *testing.T) {
+	keys := newTestKeys(t, "1f369613dd76d5467730efcbe3b1a22d", "fa044b2f42a3fd3b46fb255c", "9f50449e04a0e810283a1e9933adedd2")
+	packet := protectClientInitial(keys, Version1, clientHelloFrame)
+
+	corrupt := func(off int) []byte {
+		b := append([]byte(nil), packet...)
+		b[off] ^= 0xff
+		return b
+	}
+
+	tests := []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"empty", nil, ErrNotInitial},
+		{"short header", append([]byte{0x40}, packet[1:]...), ErrNotInitial},
+		{"handshake packet", append([]byte{0xe0}, packet[1:]...), ErrNotInitial},
+		{"unknown version", append([]byte{0xc0, 0, 0, 0, 2}, packet[5:]...), ErrNotInitial},
+		{"truncated connection id", packet[:9], ErrMalformed},
+		{"connection id too long", append(packet[:5:5], 0x15), ErrMalformed},
+		{"truncated length", packet[:17], errVarintOutOfBounds},
+		{"truncated payload", packet[:100], ErrMalformed},
+	}
+	for _, tt := range tests {
+		if _, err := ParseInitial(tt.packet); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// a changed connection ID derives other keys and a changed ciphertext fails authentication
+	for _, off := range []int{8, 100} {
+		if _, err := ParseInitial(corrupt(off)); err == nil {
+			t.Errorf("byte %d changed: no error", off)
+		}
+	}
+}
+
+func TestClientHello(t *testing.T) {
+	msg := clientHelloFrame[4:]
+	split := func(offs ...int) *InitialPacket {
+		p := &InitialPacket{}
+		for i, off := range offs {
+			end := len(msg)
+			if i+1 < len(offs) {
+				end = offs[i+1]
+			}
+			p.Crypto = append(p.Crypto, CryptoFrame{Offset: uint64(off), Data: msg[off:end]})
+		}
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		packets []*InitialPacket
+		err     error
+	}{
+		{"one frame", []*InitialPacket{split(0)}, nil},
+		{"split frames", []*InitialPacket{split(0, 60, 200)}, nil},
+		{"reordered packets", []*InitialPacket{
+			{Crypto: []CryptoFrame{{Offset: 100, Data: msg[100:]}}},
+			{Crypto: []CryptoFrame{{Offset: 0, Data: msg[:120]}}},
+		}, nil},
+		{"missing tail", []*InitialPacket{{Crypto: []CryptoFrame{{Data: msg[:100]}}}}, ErrIncomplete},
+		{"missing head", []*InitialPacket{{Crypto: []CryptoFrame{{Offset: 100, Data: msg[100:]}}}}, ErrIncomplete},
+		{"server hello", []*InitialPacket{{Crypto: []CryptoFrame{{Data: []byte{0x02, 0, 0, 0}}}}}, ErrNotClientHello},
+	}
+	for _, tt := range tests {
+		raw, err := ClientHello(tt.packets...)
+		if err != tt.err {
+			t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && !bytes.Equal(raw, msg) {
+			t.Errorf("%s: ClientHello differs", tt.name)
+		}
+	}
+}
+
+// TestConnectionClose reads the CONNECTION_CLOSE refusing the connection with the server keys.
+func TestConnectionClose(t *testing.T) {
+	for _, version := range []uint32{Version1, Version2} {
+		p := &InitialPacket{Version: version, DCID: dcid, SCID: unhex("f067a5502a4262b5")}
+		b, err := NewConnectionClose(p, ConnectionRefused)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsInitial(b) {
+			t.Fatalf("version 0x%08x: not an Initial packet", version)
+		}
+
+		keys, err := newInitialKeys(version, dcid, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := unprotect(keys, b)
+		if err != nil {
+			t.Fatalf("version 0x%08x: %v", version, err)
+		}
+		if want := []byte{frameTypeConnectionClose, byte(ConnectionRefused), 0, 0}; !bytes.Equal(payload, want) {
+			t.Errorf("version 0x%08x: payload %x, want %x", version, payload, want)
+		}
+	}
+}
+
+func TestVarint(t *testing.T) {
+	// RFC 9000 Appendix A.1
+	tests := []struct {
+		b string
+		v uint64
+	}{
+		{"c2197c5eff14e88c", 151288809941952652},
+		{"9d7f3e7d", 494878333},
+		{"7bbd", 15293},
+		{"25", 37},
+	}
+	for _, tt := range tests {
+		v, n, err := readVarint(unhex(tt.b))
+		if err != nil || v != tt.v || n != len(tt.b)/2 {
+			t.Errorf("readVarint(%s) = %d, %d, %v, want %d", tt.b, v, n, err, tt.v)
+		}
+		if b := hex.EncodeToString(appendVarint(nil, tt.v)); b != tt.b {
+			t.Errorf("appendVarint(%d) = %s, want %s", tt.v, b, tt.b)
+		}
+	}
+	if _, _, err := readVarint(unhex("9d7f3e")); err != errVarintOutOfBounds {
+		t.Errorf("truncated varint: error %v", err)
+	}
+}
+
+func newTestKeys(t *testing.T, key, iv, hp string) *initialKeys {
+	block, err := aes.NewCipher(unhex(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hpBlock, err := aes.NewCipher(unhex(hp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &initialKeys{aead: aead, iv: unhex(iv), hp: hpBlock}
+}
+
+// protectClientInitial builds the client Initial of the RFC examples,
+// packet number 2 encoded using 4 bytes and the payload padded to 1162 bytes.
+func protectClientInitial(keys *initialKeys, version uint32, frames []byte) []byte {
+	const payloadLen = 1162
+
+	typ := byte(0x00)
+	if version == Version2 {
+		typ = 0x01
+	}
+	header := []byte{0xc3 | typ<<4}
+	header = binary.BigEndian.AppendUint32(header, version)
+	header = append(header, byte(len(dcid)))
+	header = append(header, dcid...)
+	header = append(header, 0x00, 0x00)
+	header = appendVarint2(header, payloadLen+4+uint64(keys.aead.Overhead()))
+	pnOffset := len(header)
+	header = append(header, 0x00, 0x00, 0x00, 0x02)
+
+	payload := make([]byte, payloadLen)
+	copy(payload, frames)
+	packet := keys.aead.Seal(header, keys.nonce(2), payload, header)
+
+	mask := keys.headerMask(packet[pnOffset+4 : pnOffset+4+sampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	for i := 0; i < 4; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+	}
+	return packet
+}
+
+// unprotect returns the payload of a long header packet without a token.
+func unprotect(keys *initialKeys, b []byte) ([]byte, error) {
+	packet := append([]byte(nil), b...)
+	off := 5
+	off += 1 + int(packet[off])
+	off += 1 + int(packet[off])
+	off++ // token length
+	length, n, err := readVarint(packet[off:])
+	if err != nil {
+		return nil, err
+	}
+	pnOffset := off + n
+
+	mask := keys.headerMask(packet[pnOffset+4 : pnOffset+4+sampleLen])
+	packet[0] ^= mask[0] & 0x0f
+	pnLen := int(packet[0]&0x03) + 1
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		packet[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(packet[pnOffset+i])
+	}
+	return keys.aead.Open(nil, keys.nonce(pn), packet[pnOffset+pnLen:pnOffset+int(length)], packet[:pnOffset+pnLen])
+}
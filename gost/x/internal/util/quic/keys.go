@@ -0,0 +1,103 @@
+package quic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+var (
+	// initial salts of RFC 9001 section 5.2 and RFC 9369 section 3.3.1
+	saltV1 = []byte{0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17, 0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a}
+	saltV2 = []byte{0x0d, 0xed, 0xe3, 0xde, 0xf7, 0x00, 0xa6, 0xdb, 0x81, 0x93, 0x81, 0xbe, 0x6e, 0x26, 0x9d, 0xcb, 0xf9, 0xbd, 0x2e, 0xd9}
+)
+
+type initialKeys struct {
+	aead cipher.AEAD
+	iv   []byte
+	hp   cipher.Block
+}
+
+// newInitialKeys derives the packet protection keys of the Initial packets of one side.
+func newInitialKeys(version uint32, dcid []byte, server bool) (*initialKeys, error) {
+	salt, prefix := saltV1, "quic "
+	switch version {
+	case Version1:
+	case Version2:
+		salt, prefix = saltV2, "quicv2 "
+	default:
+		return nil, fmt.Errorf("unsupported QUIC version 0x%08x", version)
+	}
+
+	label := "client in"
+	if server {
+		label = "server in"
+	}
+	secret := hkdfExpandLabel(hkdfExtract(salt, dcid), label, sha256.Size)
+
+	block, err := aes.NewCipher(hkdfExpandLabel(secret, prefix+"key", 16))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	hp, err := aes.NewCipher(hkdfExpandLabel(secret, prefix+"hp", 16))
+	if err != nil {
+		return nil, err
+	}
+
+	return &initialKeys{
+		aead: aead,
+		iv:   hkdfExpandLabel(secret, prefix+"iv", aead.NonceSize()),
+		hp:   hp,
+	}, nil
+}
+
+func (k *initialKeys) nonce(pn uint64) []byte {
+	nonce := make([]byte, len(k.iv))
+	copy(nonce, k.iv)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	return nonce
+}
+
+// headerMask returns the header protection mask for the sample taken 4 bytes after the packet number offset.
+func (k *initialKeys) headerMask(sample []byte) []byte {
+	mask := make([]byte, aes.BlockSize)
+	k.hp.Encrypt(mask, sample)
+	return mask
+}
+
+func hkdfExtract(salt, secret []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(secret)
+	return mac.Sum(nil)
+}
+
+// hkdfExpandLabel implements HKDF-Expand-Label of RFC 8446 section 7.1 with an empty context.
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = binary.BigEndian.AppendUint16(info, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	var out, t []byte
+	mac := hmac.New(sha256.New, secret)
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
@@ -1,6 +1,7 @@
 package resolver
 
 import (
+	"container/list"
 	"fmt"
 	"sync"
 	"time"
@@ -11,7 +12,9 @@ import (
 )
 
 const (
-	defaultTTL = 60 * time.Second
+	defaultTTL     = 60 * time.Second
+	defaultMaxSize = 10000
+	pruneInterval  = time.Minute
 )
 
 type CacheKey string
@@ -26,18 +29,34 @@ func NewCacheKey(q *dns.Question) CacheKey {
 }
 
 type cacheItem struct {
-	msg *dns.Msg
-	ts  time.Time
-	ttl time.Duration
+	key  CacheKey
+	msg  *dns.Msg
+	ts   time.Time
+	ttl  time.Duration
+	elem *list.Element
 }
 
+func (item *cacheItem) expired(now time.Time) bool {
+	return now.Sub(item.ts) >= item.ttl
+}
+
+// Cache holds the answers until their TTL expires. If it is full,
+// the least recently used answers are evicted.
 type Cache struct {
-	m      sync.Map
-	logger logger.Logger
+	mu      sync.Mutex
+	items   map[CacheKey]*cacheItem
+	lru     *list.List
+	maxSize int
+	pruned  time.Time
+	logger  logger.Logger
 }
 
 func NewCache() *Cache {
-	return &Cache{}
+	return &Cache{
+		items:   make(map[CacheKey]*cacheItem),
+		lru:     list.New(),
+		maxSize: defaultMaxSize,
+	}
 }
 
 func (c *Cache) WithLogger(logger logger.Logger) *Cache {
@@ -45,27 +64,39 @@ func (c *Cache) WithLogger(logger logger.Logger) *Cache {
 	return c
 }
 
+// WithMaxSize sets the maximum number of cached answers.
+func (c *Cache) WithMaxSize(n int) *Cache {
+	if n > 0 {
+		c.maxSize = n
+	}
+	return c
+}
+
 func (c *Cache) Load(key CacheKey) (msg *dns.Msg, ttl time.Duration) {
-	v, ok := c.m.Load(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	item, ok := c.items[key]
 	if !ok {
 		return
 	}
-
-	item, ok := v.(*cacheItem)
-	if !ok {
+	now := time.Now()
+	if item.expired(now) {
+		c.remove(item)
 		return
 	}
+	c.lru.MoveToFront(item.elem)
 
 	msg = item.msg.Copy()
 	for i := range msg.Answer {
-		d := uint32(time.Since(item.ts).Seconds())
+		d := uint32(now.Sub(item.ts).Seconds())
 		if msg.Answer[i].Header().Ttl > d {
 			msg.Answer[i].Header().Ttl -= d
 		} else {
 			msg.Answer[i].Header().Ttl = 1
 		}
 	}
-	ttl = item.ttl - time.Since(item.ts)
+	ttl = item.ttl - now.Sub(item.ts)
 
 	c.logger.Debugf("hit resolver cache: %s, ttl: %v", key, ttl)
 
@@ -93,24 +124,52 @@ func (c *Cache) Store(key CacheKey, mr *dns.Msg, ttl time.Duration) {
 		}
 	}
 
-	c.m.Store(key, &cacheItem{
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if item, ok := c.items[key]; ok {
+		c.remove(item)
+	}
+	if len(c.items) >= c.maxSize || now.Sub(c.pruned) >= pruneInterval {
+		c.prune(now)
+	}
+	for len(c.items) >= c.maxSize {
+		c.remove(c.lru.Back().Value.(*cacheItem))
+	}
+
+	item := &cacheItem{
+		key: key,
 		msg: mr.Copy(),
-		ts:  time.Now(),
+		ts:  now,
 		ttl: ttl,
-	})
+	}
+	item.elem = c.lru.PushFront(item)
+	c.items[key] = item
 
 	c.logger.Debugf("resolver cache store: %s, ttl: %v", key, ttl)
 }
 
 func (c *Cache) RefreshTTL(key CacheKey) {
-	v, ok := c.m.Load(key)
-	if !ok {
-		return
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if item, ok := c.items[key]; ok {
+		item.ts = time.Now()
 	}
+}
 
-	item, ok := v.(*cacheItem)
-	if !ok {
-		return
+// prune removes the expired answers, the ones which are not queried anymore stay otherwise.
+func (c *Cache) prune(now time.Time) {
+	c.pruned = now
+	for _, item := range c.items {
+		if item.expired(now) {
+			c.remove(item)
+		}
 	}
-	item.ts = time.Now()
+}
+
+func (c *Cache) remove(item *cacheItem) {
+	c.lru.Remove(item.elem)
+	delete(c.items, item.key)
 }
@@ -0,0 +1,158 @@
+package tls
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeafValidity = 7 * 24 * time.Hour
+	maxCachedLeafs      = 1024
+)
+
+// CertCache mints leaf certificates signed by a CA on demand and caches them per host.
+type CertCache struct {
+	ca       *x509.Certificate
+	caDER    []byte
+	caKey    crypto.Signer
+	key      *ecdsa.PrivateKey
+	validity time.Duration
+	mu       sync.Mutex
+	certs    map[string]*tls.Certificate
+}
+
+// NewCertCache loads the CA from the cert & key files.
+// All leaf certificates share one key to keep minting cheap.
+func NewCertCache(caCertFile, caKeyFile string, validity time.Duration) (*CertCache, error) {
+	pair, err := tls.LoadX509KeyPair(caCertFile, caKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.IsCA {
+		return nil, errors.New("the certificate is not a CA")
+	}
+	caKey, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key type")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if validity <= 0 {
+		validity = defaultLeafValidity
+	}
+
+	return &CertCache{
+		ca:       ca,
+		caDER:    pair.Certificate[0],
+		caKey:    caKey,
+		key:      key,
+		validity: validity,
+		certs:    make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Get returns a certificate for host, minting a new one if there is no valid cached certificate.
+func (c *CertCache) Get(host string) (*tls.Certificate, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// renew the certificate before it expires
+	if cert := c.certs[host]; cert != nil && now.Add(c.validity/4).Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	cert, err := c.mint(host, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(c.certs) >= maxCachedLeafs {
+		for k, v := range c.certs {
+			if now.After(v.Leaf.NotAfter) {
+				delete(c.certs, k)
+			}
+		}
+		if len(c.certs) >= maxCachedLeafs {
+			c.certs = make(map[string]*tls.Certificate)
+		}
+	}
+	c.certs[host] = cert
+
+	return cert, nil
+}
+
+func (c *CertCache) mint(host string, now time.Time) (*tls.Certificate, error) {
+	notAfter := now.Add(c.validity)
+	if notAfter.After(c.ca.NotAfter) {
+		notAfter = c.ca.NotAfter
+	}
+
+	// tolerate clients with a slightly wrong clock
+	template, err := CertTemplate(host, now.Add(-time.Hour), notAfter)
+	if err != nil {
+		return nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.ca, &c.key.PublicKey, c.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, c.caDER},
+		PrivateKey:  c.key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// CertTemplate returns the template of a certificate for the host name or IP address,
+// with a random serial number. The key usages are set by the caller.
+func CertTemplate(host string, notBefore, notAfter time.Time) (*x509.Certificate, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName: host,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	return template, nil
+}
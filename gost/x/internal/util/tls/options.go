@@ -0,0 +1,106 @@
+package tls
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"proxy_forwarder/gost/x/config"
+)
+
+var (
+	ErrPinMismatch = errors.New("tls: no certificate of the peer matches a pinned public key")
+)
+
+// SetTLSOptions applies the options to a client config.
+func SetTLSOptions(cfg *tls.Config, opts *config.TLSOptions) error {
+	if cfg == nil || opts == nil {
+		return nil
+	}
+
+	if opts.MinVersion != "" {
+		v, err := parseVersion(opts.MinVersion)
+		if err != nil {
+			return err
+		}
+		cfg.MinVersion = v
+	}
+
+	if opts.SessionCache {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+
+	if len(opts.Pins) > 0 {
+		pins := map[string]struct{}{}
+		for _, pin := range opts.Pins {
+			b, err := parsePin(pin)
+			if err != nil {
+				return err
+			}
+			pins[string(b)] = struct{}{}
+		}
+
+		verify := cfg.VerifyConnection
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(state); err != nil {
+					return err
+				}
+			}
+			return verifyPins(state, pins)
+		}
+	}
+
+	return nil
+}
+
+func parseVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(s), "tls") {
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("tls: unknown version %q", s)
+}
+
+// parsePin decodes a pin in the format 'sha256/<base64>', the prefix is optional.
+func parsePin(s string) ([]byte, error) {
+	s = strings.TrimPrefix(s, "sha256/")
+	s = strings.TrimPrefix(s, "/")
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("tls: invalid pin %q", s)
+	}
+	return b, nil
+}
+
+// verifyPins checks the leaf certificate and, if the chain was verified, its issuers.
+func verifyPins(state tls.ConnectionState, pins map[string]struct{}) error {
+	if len(state.PeerCertificates) == 0 {
+		return ErrPinMismatch
+	}
+	certs := []*x509.Certificate{state.PeerCertificates[0]}
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	for _, cert := range certs {
+		if _, ok := pins[string(spkiHash(cert))]; ok {
+			return nil
+		}
+	}
+	return ErrPinMismatch
+}
+
+func spkiHash(cert *x509.Certificate) []byte {
+	h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return h[:]
+}
@@ -9,6 +9,7 @@ import (
 	"proxy_forwarder/gost/core/logger"
 	md "proxy_forwarder/gost/core/metadata"
 	admission "proxy_forwarder/gost/x/admission/wrapper"
+	"proxy_forwarder/gost/x/internal/loop"
 	xnet "proxy_forwarder/gost/x/internal/net"
 	"proxy_forwarder/gost/x/internal/net/proxyproto"
 	climiter "proxy_forwarder/gost/x/limiter/conn/wrapper"
@@ -65,6 +66,7 @@ func (l *redirectListener) Init(md md.Metadata) (err error) {
 	ln = limiter.WrapListener(l.options.TrafficLimiter, ln)
 	ln = climiter.WrapListener(l.options.ConnLimiter, ln)
 	l.ln = ln
+	loop.AddListener(ln.Addr())
 	return
 }
 
@@ -77,5 +79,6 @@ func (l *redirectListener) Addr() net.Addr {
 }
 
 func (l *redirectListener) Close() error {
+	loop.RemoveListener(l.ln.Addr())
 	return l.ln.Close()
 }
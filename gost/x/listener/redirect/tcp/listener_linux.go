@@ -10,6 +10,13 @@ import (
 
 func (l *redirectListener) control(network, address string, c syscall.RawConn) error {
 	return c.Control(func(fd uintptr) {
+		if network == "tcp6" {
+			// also covers IPv4 clients of a dual-stack socket
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+				log.ErrorS("listener", fmt.Sprintf("SetsockoptInt(SOL_IPV6, IPV6_TRANSPARENT, 1): %v", err))
+			}
+			return
+		}
 		if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
 			log.ErrorS("listener", fmt.Sprintf("SetsockoptInt(SOL_IP, IP_TRANSPARENT, 1): %v", err))
 		}
@@ -1,42 +1,189 @@
 package udp
 
 import (
+	"container/list"
+	"fmt"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"proxy_forwarder/gost/core/common/bufpool"
+	mdata "proxy_forwarder/gost/core/metadata"
+	xmetadata "proxy_forwarder/gost/x/metadata"
+	"proxy_forwarder/log"
 )
 
+const (
+	// packets of a session queued until the handler reads them
+	sessionQueueSize = 32
+	// new DNAT sessions queued until the service accepts them
+	acceptBacklog = 128
+)
+
+// redirConn is a UDP session between a client and its original destination.
+// Packets received on the reply socket and packets that reached the listening
+// socket before the reply socket was bound are both delivered through the queue.
 type redirConn struct {
 	net.Conn
-	buf  []byte
-	ttl  time.Duration
-	once sync.Once
+	key     string
+	table   *sessionTable
+	bufSize int
+	// mark of the first packet, 0 if the kernel does not report it
+	mark int
+
+	queue  chan *[]byte
+	rerr   error
+	rdone  chan struct{}
+	closed chan struct{}
+	once   sync.Once
+
+	// the reply socket is read by readLoop, read deadlines apply to the queue
+	mu           sync.Mutex
+	readDeadline time.Time
+
+	elem       *list.Element
+	start      time.Time
+	lastActive int64
+
+	rxPackets uint64
+	rxBytes   uint64
+	txPackets uint64
+	txBytes   uint64
 }
 
-func (c *redirConn) Read(b []byte) (n int, err error) {
-	if c.ttl > 0 {
-		c.SetReadDeadline(time.Now().Add(c.ttl))
-		defer c.SetReadDeadline(time.Time{})
+func newRedirConn(conn net.Conn, key string, table *sessionTable, bufSize int) *redirConn {
+	now := time.Now()
+	return &redirConn{
+		Conn:       conn,
+		key:        key,
+		table:      table,
+		bufSize:    bufSize,
+		queue:      make(chan *[]byte, sessionQueueSize),
+		rdone:      make(chan struct{}),
+		closed:     make(chan struct{}),
+		start:      now,
+		lastActive: now.UnixNano(),
 	}
+}
 
-	c.once.Do(func() {
-		n = copy(b, c.buf)
-		bufpool.Put(&c.buf)
-	})
+// enqueue hands a packet over to the session, it is dropped if the handler does not keep up.
+func (c *redirConn) enqueue(b *[]byte) {
+	select {
+	case <-c.closed:
+		bufpool.Put(b)
+		return
+	default:
+	}
+
+	select {
+	case c.queue <- b:
+	default:
+		bufpool.Put(b)
+		c.table.recordDropped("queue")
+	}
+}
+
+func (c *redirConn) readLoop() {
+	for {
+		b := bufpool.Get(c.bufSize)
+		n, err := c.Conn.Read(*b)
+		if err != nil {
+			bufpool.Put(b)
+			c.rerr = err
+			close(c.rdone)
+			return
+		}
+		*b = (*b)[:n]
+		c.enqueue(b)
+	}
+}
+
+func (c *redirConn) Read(b []byte) (n int, err error) {
+	var p *[]byte
+	select {
+	case p = <-c.queue:
+	default:
+		var timeout <-chan time.Time
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
 
-	if n == 0 {
-		n, err = c.Conn.Read(b)
+		select {
+		case p = <-c.queue:
+		case <-c.rdone:
+			return 0, c.rerr
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		}
 	}
 
+	n = copy(b, *p)
+	bufpool.Put(p)
+
+	atomic.AddUint64(&c.rxPackets, 1)
+	atomic.AddUint64(&c.rxBytes, uint64(n))
+	c.table.recordPacket("in", n)
+	c.table.touch(c)
 	return
 }
 
 func (c *redirConn) Write(b []byte) (n int, err error) {
-	if c.ttl > 0 {
-		c.SetWriteDeadline(time.Now().Add(c.ttl))
-		defer c.SetWriteDeadline(time.Time{})
+	n, err = c.Conn.Write(b)
+	if err != nil {
+		return
 	}
-	return c.Conn.Write(b)
+
+	atomic.AddUint64(&c.txPackets, 1)
+	atomic.AddUint64(&c.txBytes, uint64(n))
+	c.table.recordPacket("out", n)
+	c.table.touch(c)
+	return
+}
+
+func (c *redirConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *redirConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// Metadata implements metadata.Metadatable interface.
+func (c *redirConn) Metadata() mdata.Metadata {
+	return xmetadata.NewMetadata(map[string]any{
+		"mark": c.mark,
+	})
+}
+
+func (c *redirConn) Close() (err error) {
+	c.once.Do(func() {
+		close(c.closed)
+		err = c.Conn.Close()
+		c.table.remove(c)
+
+		log.ConnDebug("listener", c.RemoteAddr().String(), c.LocalAddr().String(), fmt.Sprintf(
+			"session closed after %s: received %d packets (%d bytes), sent %d packets (%d bytes)",
+			time.Since(c.start),
+			atomic.LoadUint64(&c.rxPackets), atomic.LoadUint64(&c.rxBytes),
+			atomic.LoadUint64(&c.txPackets), atomic.LoadUint64(&c.txBytes),
+		))
+	})
+	return
+}
+
+func (c *redirConn) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActive)))
 }
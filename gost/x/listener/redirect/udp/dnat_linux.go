@@ -0,0 +1,322 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ctnetlink attributes, see linux/netfilter/nfnetlink_conntrack.h
+const (
+	ipctnlMsgCtNew = 0
+	ipctnlMsgCtGet = 1
+
+	ctaTupleOrig  = 1
+	ctaTupleReply = 2
+
+	ctaTupleIP    = 1
+	ctaTupleProto = 2
+
+	ctaIPv4Src = 1
+	ctaIPv4Dst = 2
+	ctaIPv6Src = 3
+	ctaIPv6Dst = 4
+
+	ctaProtoNum     = 1
+	ctaProtoSrcPort = 2
+	ctaProtoDstPort = 3
+
+	conntrackTimeout = time.Second
+)
+
+var (
+	errNoConntrackEntry = errors.New("no conntrack entry found")
+	errDNATRead         = errors.New("packets of DNAT sessions are read by the listener")
+)
+
+// conntrack looks up the original destination of NATed flows over a netlink socket.
+// Querying the conntrack table requires CAP_NET_ADMIN.
+type conntrack struct {
+	mu  sync.Mutex
+	fd  int
+	seq uint32
+}
+
+func newConntrack() *conntrack {
+	return &conntrack{fd: -1}
+}
+
+func (ct *conntrack) open() error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_NETFILTER)
+	if err != nil {
+		return fmt.Errorf("netlink socket: %w", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("netlink bind: %w", err)
+	}
+	tv := unix.NsecToTimeval(conntrackTimeout.Nanoseconds())
+	if err = unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("set socket option: SO_RCVTIMEO: %w", err)
+	}
+	ct.fd = fd
+	return nil
+}
+
+// originalDst returns the destination the client sent the packet to before it was
+// redirected to laddr. The flow is matched by its reply tuple: laddr -> raddr.
+func (ct *conntrack) originalDst(laddr, raddr *net.UDPAddr) (*net.UDPAddr, error) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.fd < 0 {
+		if err := ct.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	ct.seq++
+	req, err := conntrackRequest(ct.seq, laddr, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err = unix.Sendto(ct.fd, req, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, fmt.Errorf("netlink send: %w", err)
+	}
+
+	b := make([]byte, 8192)
+	for {
+		n, _, err := unix.Recvfrom(ct.fd, b, 0)
+		if err != nil {
+			return nil, fmt.Errorf("netlink receive: %w", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b[:n])
+		if err != nil {
+			return nil, fmt.Errorf("parsing netlink message: %w", err)
+		}
+
+		for _, msg := range msgs {
+			if msg.Header.Seq != ct.seq {
+				// answer to a request that timed out earlier
+				continue
+			}
+
+			switch msg.Header.Type {
+			case unix.NLMSG_ERROR:
+				if len(msg.Data) < 4 {
+					return nil, errors.New("netlink: short error message")
+				}
+				errno := -int32(binary.LittleEndian.Uint32(msg.Data[:4]))
+				if errno == 0 {
+					continue
+				}
+				if syscall.Errno(errno) == unix.ENOENT {
+					return nil, errNoConntrackEntry
+				}
+				return nil, fmt.Errorf("conntrack: %w", syscall.Errno(errno))
+
+			case unix.NFNL_SUBSYS_CTNETLINK<<8 | ipctnlMsgCtNew:
+				return parseConntrackOrigDst(msg.Data)
+			}
+		}
+	}
+}
+
+func (ct *conntrack) Close() error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if ct.fd < 0 {
+		return nil
+	}
+	err := unix.Close(ct.fd)
+	ct.fd = -1
+	return err
+}
+
+func conntrackRequest(seq uint32, laddr, raddr *net.UDPAddr) ([]byte, error) {
+	family := uint8(unix.AF_INET)
+	srcType, dstType := ctaIPv4Src, ctaIPv4Dst
+	src, dst := laddr.IP.To4(), raddr.IP.To4()
+	if src == nil || dst == nil {
+		family = unix.AF_INET6
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+		src, dst = laddr.IP.To16(), raddr.IP.To16()
+	}
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid flow %v -> %v", laddr, raddr)
+	}
+
+	ip := append(nlAttr(srcType, src), nlAttr(dstType, dst)...)
+	proto := nlAttr(ctaProtoNum, []byte{unix.IPPROTO_UDP})
+	proto = append(proto, nlAttr(ctaProtoSrcPort, nlPort(laddr.Port))...)
+	proto = append(proto, nlAttr(ctaProtoDstPort, nlPort(raddr.Port))...)
+	tuple := append(nlAttr(ctaTupleIP|unix.NLA_F_NESTED, ip), nlAttr(ctaTupleProto|unix.NLA_F_NESTED, proto)...)
+
+	// nfgenmsg: family, version, resource id
+	payload := append([]byte{family, unix.NFNETLINK_V0, 0, 0}, nlAttr(ctaTupleReply|unix.NLA_F_NESTED, tuple)...)
+
+	b := make([]byte, unix.NLMSG_HDRLEN, unix.NLMSG_HDRLEN+len(payload))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(unix.NLMSG_HDRLEN+len(payload)))
+	binary.LittleEndian.PutUint16(b[4:6], unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtGet)
+	binary.LittleEndian.PutUint16(b[6:8], unix.NLM_F_REQUEST)
+	binary.LittleEndian.PutUint32(b[8:12], seq)
+	return append(b, payload...), nil
+}
+
+// parseConntrackOrigDst reads the destination of the original tuple from a conntrack entry.
+func parseConntrackOrigDst(b []byte) (*net.UDPAddr, error) {
+	// skip nfgenmsg
+	if len(b) < 4 {
+		return nil, errors.New("conntrack: short message")
+	}
+	orig := nlFind(b[4:], ctaTupleOrig)
+	if orig == nil {
+		return nil, errors.New("conntrack: entry has no original tuple")
+	}
+
+	addr := &net.UDPAddr{}
+	if ip := nlFind(orig, ctaTupleIP); ip != nil {
+		if v := nlFind(ip, ctaIPv4Dst); len(v) == net.IPv4len {
+			addr.IP = net.IP(v).To16()
+		} else if v := nlFind(ip, ctaIPv6Dst); len(v) == net.IPv6len {
+			addr.IP = net.IP(v)
+		}
+	}
+	if proto := nlFind(orig, ctaTupleProto); proto != nil {
+		if v := nlFind(proto, ctaProtoDstPort); len(v) == 2 {
+			addr.Port = int(binary.BigEndian.Uint16(v))
+		}
+	}
+
+	if addr.IP == nil || addr.Port == 0 {
+		return nil, errors.New("conntrack: incomplete original tuple")
+	}
+	// copy, the buffer is reused
+	addr.IP = append(net.IP(nil), addr.IP...)
+	return addr, nil
+}
+
+func nlAttr(typ int, data []byte) []byte {
+	l := unix.SizeofNlAttr + len(data)
+	b := make([]byte, nlAlign(l))
+	binary.LittleEndian.PutUint16(b[0:2], uint16(l))
+	binary.LittleEndian.PutUint16(b[2:4], uint16(typ))
+	copy(b[unix.SizeofNlAttr:], data)
+	return b
+}
+
+// nlFind returns the payload of the first attribute of the given type.
+func nlFind(b []byte, typ int) []byte {
+	for len(b) >= unix.SizeofNlAttr {
+		l := int(binary.LittleEndian.Uint16(b[0:2]))
+		t := int(binary.LittleEndian.Uint16(b[2:4])) &^ (unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+		if l < unix.SizeofNlAttr || l > len(b) {
+			return nil
+		}
+		if t == typ {
+			return b[unix.SizeofNlAttr:l]
+		}
+		if nlAlign(l) >= len(b) {
+			return nil
+		}
+		b = b[nlAlign(l):]
+	}
+	return nil
+}
+
+func nlAlign(l int) int {
+	return (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+}
+
+func nlPort(port int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(port))
+	return b
+}
+
+// dnatConn sends the replies of a DNAT session from the listening socket.
+// The source is set to the address the packets were redirected to,
+// so the kernel can translate it back to the original destination.
+type dnatConn struct {
+	ln      *net.UDPConn
+	dstAddr *net.UDPAddr
+	raddr   *net.UDPAddr
+	oob     []byte
+}
+
+func newDNATConn(ln *net.UDPConn, ipv4 bool, laddr, dstAddr, raddr *net.UDPAddr) *dnatConn {
+	return &dnatConn{
+		ln:      ln,
+		dstAddr: dstAddr,
+		raddr:   raddr,
+		oob:     pktinfo(ipv4, laddr.IP),
+	}
+}
+
+func (c *dnatConn) Read(b []byte) (int, error) {
+	return 0, errDNATRead
+}
+
+func (c *dnatConn) Write(b []byte) (n int, err error) {
+	n, _, err = c.ln.WriteMsgUDP(b, c.oob, c.raddr)
+	return
+}
+
+// Close is a no-op, the listening socket is shared by all sessions.
+func (c *dnatConn) Close() error {
+	return nil
+}
+
+func (c *dnatConn) LocalAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *dnatConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *dnatConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dnatConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *dnatConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// pktinfo builds the control message selecting the source address of a reply.
+// The family is the one of the listening socket, IPv4 clients of a dual-stack
+// socket use mapped addresses.
+func pktinfo(ipv4 bool, src net.IP) []byte {
+	if ipv4 {
+		info := unix.Inet4Pktinfo{}
+		copy(info.Spec_dst[:], src.To4())
+		return cmsg(unix.SOL_IP, unix.IP_PKTINFO, (*[unix.SizeofInet4Pktinfo]byte)(unsafe.Pointer(&info))[:])
+	}
+
+	info := unix.Inet6Pktinfo{}
+	copy(info.Addr[:], src.To16())
+	return cmsg(unix.SOL_IPV6, unix.IPV6_PKTINFO, (*[unix.SizeofInet6Pktinfo]byte)(unsafe.Pointer(&info))[:])
+}
+
+func cmsg(level, typ int, data []byte) []byte {
+	b := make([]byte, unix.CmsgSpace(len(data)))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = int32(level)
+	h.Type = int32(typ)
+	h.SetLen(unix.CmsgLen(len(data)))
+	copy(b[unix.CmsgLen(0):], data)
+	return b
+}
@@ -0,0 +1,156 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// conntrackTuple encodes a tuple the way the kernel dumps it, the ports in network byte order.
+func conntrackTuple(typ int, ipv4 bool, src, dst *net.UDPAddr) []byte {
+	srcType, dstType := ctaIPv4Src, ctaIPv4Dst
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if !ipv4 {
+		srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	ip := append(nlAttr(srcType, srcIP), nlAttr(dstType, dstIP)...)
+	proto := nlAttr(ctaProtoNum, []byte{unix.IPPROTO_UDP})
+	proto = append(proto, nlAttr(ctaProtoSrcPort|unix.NLA_F_NET_BYTEORDER, nlPort(src.Port))...)
+	proto = append(proto, nlAttr(ctaProtoDstPort|unix.NLA_F_NET_BYTEORDER, nlPort(dst.Port))...)
+	return nlAttr(typ|unix.NLA_F_NESTED,
+		append(nlAttr(ctaTupleIP|unix.NLA_F_NESTED, ip), nlAttr(ctaTupleProto|unix.NLA_F_NESTED, proto)...))
+}
+
+func TestConntrackRequest(t *testing.T) {
+	tests := []struct {
+		laddr, raddr string
+		family       uint8
+	}{
+		{"127.0.0.1:5353", "192.0.2.7:40000", unix.AF_INET},
+		{"[::ffff:127.0.0.1]:5353", "[::ffff:192.0.2.7]:40000", unix.AF_INET},
+		{"[::1]:5353", "[2001:db8::7]:40000", unix.AF_INET6},
+	}
+	for _, tt := range tests {
+		laddr, _ := net.ResolveUDPAddr("udp", tt.laddr)
+		raddr, _ := net.ResolveUDPAddr("udp", tt.raddr)
+
+		b, err := conntrackRequest(42, laddr, raddr)
+		if err != nil {
+			t.Fatalf("%s -> %s: %v", tt.laddr, tt.raddr, err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(b)
+		if err != nil || len(msgs) != 1 {
+			t.Fatalf("%s -> %s: %d messages, %v", tt.laddr, tt.raddr, len(msgs), err)
+		}
+		h := msgs[0].Header
+		if int(h.Len) != len(b) || h.Type != unix.NFNL_SUBSYS_CTNETLINK<<8|ipctnlMsgCtGet ||
+			h.Flags != unix.NLM_F_REQUEST || h.Seq != 42 {
+			t.Errorf("%s -> %s: header %+v", tt.laddr, tt.raddr, h)
+		}
+
+		data := msgs[0].Data
+		if data[0] != tt.family {
+			t.Errorf("%s -> %s: family %d, want %d", tt.laddr, tt.raddr, data[0], tt.family)
+		}
+		reply := nlFind(data[4:], ctaTupleReply)
+		if nlFind(data[4:], ctaTupleOrig) != nil || reply == nil {
+			t.Fatalf("%s -> %s: the flow is not matched by its reply tuple", tt.laddr, tt.raddr)
+		}
+
+		// the reply tuple goes from the redirected address to the client
+		srcType, dstType := ctaIPv4Src, ctaIPv4Dst
+		if tt.family == unix.AF_INET6 {
+			srcType, dstType = ctaIPv6Src, ctaIPv6Dst
+		}
+		ip := nlFind(reply, ctaTupleIP)
+		if src := net.IP(nlFind(ip, srcType)); !src.Equal(laddr.IP) {
+			t.Errorf("%s -> %s: source %v", tt.laddr, tt.raddr, src)
+		}
+		if dst := net.IP(nlFind(ip, dstType)); !dst.Equal(raddr.IP) {
+			t.Errorf("%s -> %s: destination %v", tt.laddr, tt.raddr, dst)
+		}
+		proto := nlFind(reply, ctaTupleProto)
+		if v := nlFind(proto, ctaProtoNum); len(v) != 1 || v[0] != unix.IPPROTO_UDP {
+			t.Errorf("%s -> %s: protocol %v", tt.laddr, tt.raddr, v)
+		}
+		if v := nlFind(proto, ctaProtoSrcPort); binary.BigEndian.Uint16(v) != uint16(laddr.Port) {
+			t.Errorf("%s -> %s: source port %v", tt.laddr, tt.raddr, v)
+		}
+		if v := nlFind(proto, ctaProtoDstPort); binary.BigEndian.Uint16(v) != uint16(raddr.Port) {
+			t.Errorf("%s -> %s: destination port %v", tt.laddr, tt.raddr, v)
+		}
+	}
+
+	if _, err := conntrackRequest(1, &net.UDPAddr{}, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 7)}); err == nil {
+		t.Errorf("flow without a local address: no error")
+	}
+}
+
+func TestParseConntrackOrigDst(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 40000}
+	orig := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 53}
+	redirected := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	client6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}
+	orig6 := &net.UDPAddr{IP: net.ParseIP("2001:db8:1::1"), Port: 443}
+	redirected6 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 5353}
+
+	nfgenmsg := func(family uint8) []byte {
+		return []byte{family, unix.NFNETLINK_V0, 0, 0}
+	}
+	entry := func(family uint8, attrs ...[]byte) []byte {
+		b := nfgenmsg(family)
+		for _, attr := range attrs {
+			b = append(b, attr...)
+		}
+		return b
+	}
+	// the original tuple without its destination port
+	noPort := nlAttr(ctaTupleOrig|unix.NLA_F_NESTED, append(
+		nlAttr(ctaTupleIP|unix.NLA_F_NESTED, append(nlAttr(ctaIPv4Src, client.IP.To4()), nlAttr(ctaIPv4Dst, orig.IP.To4())...)),
+		nlAttr(ctaTupleProto|unix.NLA_F_NESTED, nlAttr(ctaProtoNum, []byte{unix.IPPROTO_UDP}))...))
+	// the length of the original tuple exceeds the message
+	truncated := conntrackTuple(ctaTupleOrig, true, client, orig)
+	truncated = truncated[:len(truncated)-8]
+
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"ipv4", entry(unix.AF_INET,
+			conntrackTuple(ctaTupleOrig, true, client, orig),
+			conntrackTuple(ctaTupleReply, true, redirected, client)), orig.String()},
+		{"reply tuple first", entry(unix.AF_INET,
+			conntrackTuple(ctaTupleReply, true, redirected, client),
+			conntrackTuple(ctaTupleOrig, true, client, orig)), orig.String()},
+		{"ipv6", entry(unix.AF_INET6,
+			conntrackTuple(ctaTupleOrig, false, client6, orig6),
+			conntrackTuple(ctaTupleReply, false, redirected6, client6)), orig6.String()},
+		{"short message", []byte{unix.AF_INET, 0}, ""},
+		{"no attributes", nfgenmsg(unix.AF_INET), ""},
+		{"no original tuple", entry(unix.AF_INET, conntrackTuple(ctaTupleReply, true, redirected, client)), ""},
+		{"no destination port", entry(unix.AF_INET, noPort), ""},
+		{"truncated attribute", entry(unix.AF_INET, truncated), ""},
+		{"attribute length below the header", entry(unix.AF_INET, []byte{2, 0, ctaTupleOrig, 0x80}), ""},
+	}
+	for _, tt := range tests {
+		addr, err := parseConntrackOrigDst(tt.b)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: address %v, want an error", tt.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if addr.String() != tt.want {
+			t.Errorf("%s: address %v, want %s", tt.name, addr, tt.want)
+		}
+	}
+}
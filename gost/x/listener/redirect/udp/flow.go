@@ -0,0 +1,133 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"proxy_forwarder/gost/core/common/bufpool"
+)
+
+const (
+	// a flow idle for longer is looked up again, its conntrack entry may have expired
+	// and the client may use the port for another destination (the kernel keeps
+	// unreplied UDP entries for 30s)
+	flowRecheckIdle   = 10 * time.Second
+	flowPruneInterval = time.Minute
+)
+
+// dnatFlow is a flow of a DNAT client, identified by the client address and the
+// address the packets were redirected to.
+type dnatFlow struct {
+	dstAddr   *net.UDPAddr
+	mark      int
+	lastSeen  time.Time
+	resolving bool
+	// packets received while the original destination is looked up
+	pending []*[]byte
+}
+
+// flowTable maps the flows of DNAT clients to their original destinations. The lookup
+// runs off the read loop, the packets of the flow arriving meanwhile are queued.
+type flowTable struct {
+	lookup  func(laddr, raddr *net.UDPAddr) (*net.UDPAddr, error)
+	deliver func(b *[]byte, laddr, raddr, dstAddr *net.UDPAddr, mark int)
+	failed  func(laddr, raddr *net.UDPAddr, err error, dropped int)
+
+	mu     sync.Mutex
+	flows  map[string]*dnatFlow
+	pruned time.Time
+}
+
+func newFlowTable(
+	lookup func(laddr, raddr *net.UDPAddr) (*net.UDPAddr, error),
+	deliver func(b *[]byte, laddr, raddr, dstAddr *net.UDPAddr, mark int),
+	failed func(laddr, raddr *net.UDPAddr, err error, dropped int),
+) *flowTable {
+	return &flowTable{
+		lookup:  lookup,
+		deliver: deliver,
+		failed:  failed,
+		flows:   make(map[string]*dnatFlow),
+		pruned:  time.Now(),
+	}
+}
+
+// dispatch hands a packet over to the session of its original destination.
+// It returns false if the packet was dropped because the queue of the flow is full.
+// The mark of the first packet is the one of the flow.
+func (t *flowTable) dispatch(b *[]byte, laddr, raddr *net.UDPAddr, mark int) bool {
+	key := raddr.String() + "-" + laddr.String()
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.prune(now)
+
+	f := t.flows[key]
+	if f != nil && f.resolving {
+		if len(f.pending) >= sessionQueueSize {
+			bufpool.Put(b)
+			return false
+		}
+		f.pending = append(f.pending, b)
+		return true
+	}
+	if f != nil && now.Sub(f.lastSeen) < flowRecheckIdle {
+		f.lastSeen = now
+		t.deliver(b, laddr, raddr, f.dstAddr, f.mark)
+		return true
+	}
+
+	f = &dnatFlow{
+		mark:      mark,
+		resolving: true,
+		pending:   []*[]byte{b},
+	}
+	t.flows[key] = f
+	go t.resolve(key, f, laddr, raddr)
+	return true
+}
+
+func (t *flowTable) resolve(key string, f *dnatFlow, laddr, raddr *net.UDPAddr) {
+	dstAddr, err := t.lookup(laddr, raddr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pending := f.pending
+	f.pending = nil
+	f.resolving = false
+
+	if err != nil {
+		if t.flows[key] == f {
+			delete(t.flows, key)
+		}
+		for _, b := range pending {
+			bufpool.Put(b)
+		}
+		t.failed(laddr, raddr, err, len(pending))
+		return
+	}
+
+	f.dstAddr = dstAddr
+	f.lastSeen = time.Now()
+	// delivered with the lock held, so the following packets keep their order
+	for _, b := range pending {
+		t.deliver(b, laddr, raddr, dstAddr, f.mark)
+	}
+}
+
+// prune removes the flows which would be looked up again anyway, the caller has to hold the lock.
+func (t *flowTable) prune(now time.Time) {
+	if now.Sub(t.pruned) < flowPruneInterval {
+		return
+	}
+	t.pruned = now
+	for key, f := range t.flows {
+		if !f.resolving && now.Sub(f.lastSeen) >= flowRecheckIdle {
+			delete(t.flows, key)
+		}
+	}
+}
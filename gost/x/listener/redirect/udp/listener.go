@@ -2,11 +2,13 @@ package udp
 
 import (
 	"net"
+	"sync"
 
 	"proxy_forwarder/gost/core/listener"
 	"proxy_forwarder/gost/core/logger"
 	md "proxy_forwarder/gost/core/metadata"
 	admission "proxy_forwarder/gost/x/admission/wrapper"
+	"proxy_forwarder/gost/x/internal/loop"
 	limiter "proxy_forwarder/gost/x/limiter/traffic/wrapper"
 	metrics "proxy_forwarder/gost/x/metrics/wrapper"
 	"proxy_forwarder/gost/x/registry"
@@ -17,10 +19,18 @@ func init() {
 }
 
 type redirectListener struct {
-	ln      *net.UDPConn
-	logger  logger.Logger
-	md      metadata
-	options listener.Options
+	ln        *net.UDPConn
+	sessions  *sessionTable
+	conntrack *conntrack
+	// DNAT: the packets are read by readDNAT, new sessions are passed to accept
+	flows    *flowTable
+	accepted chan net.Conn
+	rdone    chan struct{}
+	rerr     error
+	readOnce sync.Once
+	logger   logger.Logger
+	md       metadata
+	options  listener.Options
 }
 
 func NewListener(opts ...listener.Option) listener.Listener {
@@ -45,6 +55,13 @@ func (l *redirectListener) Init(md md.Metadata) (err error) {
 	}
 
 	l.ln = ln
+	loop.AddListener(ln.LocalAddr())
+	l.sessions = newSessionTable(l.options.Service, l.md.maxSessions, l.md.ttl)
+	if !l.md.tproxy {
+		l.conntrack = newConntrack()
+		l.accepted = make(chan net.Conn, acceptBacklog)
+		l.rdone = make(chan struct{})
+	}
 	return
 }
 
@@ -64,5 +81,12 @@ func (l *redirectListener) Addr() net.Addr {
 }
 
 func (l *redirectListener) Close() error {
+	if l.sessions != nil {
+		l.sessions.Close()
+	}
+	if l.conntrack != nil {
+		l.conntrack.Close()
+	}
+	loop.RemoveListener(l.ln.LocalAddr())
 	return l.ln.Close()
 }
@@ -18,16 +18,35 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// SO_RCVMARK (Linux 6.2) adds the mark of received packets as control message,
+// it is not defined by x/sys/unix yet
+const soRcvMark = 0x4b
+
 func (l *redirectListener) listenUDP(addr string) (*net.UDPConn, error) {
 	lc := net.ListenConfig{
 		Control: func(network, address string, c syscall.RawConn) error {
 			return c.Control(func(fd uintptr) {
-				if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
-					log.ErrorS("listener", fmt.Sprintf("SetsockoptInt(SOL_IP, IP_TRANSPARENT, 1): %v", err))
+				// the mark of the packets is used to detect redirect loops,
+				// older kernels do not support it
+				unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, soRcvMark, 1)
+
+				if !l.md.tproxy {
+					// DNAT: the address the packets were redirected to is needed for the conntrack lookup
+					if network == "udp4" {
+						setsockopt(fd, unix.SOL_IP, unix.IP_PKTINFO, "SOL_IP, IP_PKTINFO")
+					} else {
+						setsockopt(fd, unix.SOL_IPV6, unix.IPV6_RECVPKTINFO, "SOL_IPV6, IPV6_RECVPKTINFO")
+					}
+					return
 				}
-				if err := unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1); err != nil {
-					log.ErrorS("listener", fmt.Sprintf("SetsockoptInt(SOL_IP, IP_RECVORIGDSTADDR, 1): %v", err))
+
+				if network == "udp6" {
+					setsockopt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, "SOL_IPV6, IPV6_TRANSPARENT")
+					setsockopt(fd, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, "SOL_IPV6, IPV6_RECVORIGDSTADDR")
 				}
+				// IPv4 packets of a dual-stack socket carry the IPv4 control messages
+				setsockopt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, "SOL_IP, IP_TRANSPARENT")
+				setsockopt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, "SOL_IP, IP_RECVORIGDSTADDR")
 			})
 		},
 	}
@@ -44,35 +63,146 @@ func (l *redirectListener) listenUDP(addr string) (*net.UDPConn, error) {
 	return pc.(*net.UDPConn), nil
 }
 
-func (l *redirectListener) accept() (conn net.Conn, err error) {
-	b := bufpool.Get(l.md.readBufferSize)
+func setsockopt(fd uintptr, level, opt int, name string) {
+	if err := unix.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+		log.ErrorS("listener", fmt.Sprintf("SetsockoptInt(%s, 1): %v", name, err))
+	}
+}
 
-	n, raddr, dstAddr, err := readFromUDP(l.ln, *b)
-	logSrc := raddr.String()
-	logDst := dstAddr.String()
-	if err != nil {
-		log.ConnError("listener", logSrc, logDst, err)
-		return
+// accept reads packets until one opens a new session. Packets of known sessions are
+// handed over to them, packets that cannot be assigned are dropped without
+// stopping the listener.
+func (l *redirectListener) accept() (conn net.Conn, err error) {
+	if !l.md.tproxy {
+		return l.acceptDNAT()
 	}
 
-	log.ConnDebug("listener", logSrc, logDst, "establishing")
+	network := l.network()
+	for {
+		b := bufpool.Get(l.md.readBufferSize)
 
-	network := "udp"
+		var n, mark int
+		var raddr, dstAddr *net.UDPAddr
+		n, raddr, dstAddr, mark, err = readFromUDP(l.ln, *b)
+		if err != nil {
+			bufpool.Put(b)
+			if _, ok := err.(net.Error); ok {
+				return nil, err
+			}
+			log.ErrorS("listener", fmt.Sprintf("dropping packet: %v", err))
+			l.sessions.recordDropped("parse")
+			continue
+		}
+		*b = (*b)[:n]
+
+		logSrc := raddr.String()
+		logDst := dstAddr.String()
+		key := logSrc + "-" + logDst
+
+		if c := l.sessions.get(key); c != nil {
+			c.enqueue(b)
+			continue
+		}
+
+		log.ConnDebug("listener", logSrc, logDst, "establishing")
+
+		c, err := dialUDP(network, dstAddr, raddr)
+		if err != nil {
+			bufpool.Put(b)
+			log.ConnError("listener", logSrc, logDst, err)
+			l.sessions.recordDropped("bind")
+			continue
+		}
+
+		rc := newRedirConn(c, key, l.sessions, l.md.readBufferSize)
+		rc.mark = mark
+		rc.enqueue(b)
+		l.sessions.add(rc)
+		go rc.readLoop()
+
+		return rc, nil
+	}
+}
+
+func (l *redirectListener) network() string {
 	if xnet.IsIPv4(l.options.Addr) {
-		network = "udp4"
+		return "udp4"
 	}
-	c, err := dialUDP(network, dstAddr, raddr)
-	if err != nil {
-		log.ConnError("listener", logSrc, logDst, err)
+	return "udp"
+}
+
+// acceptDNAT returns the sessions opened by readDNAT.
+func (l *redirectListener) acceptDNAT() (net.Conn, error) {
+	l.readOnce.Do(func() {
+		l.flows = newFlowTable(l.conntrack.originalDst, l.deliverDNAT, l.lookupFailed)
+		go l.readDNAT()
+	})
+
+	select {
+	case c := <-l.accepted:
+		return c, nil
+	case <-l.rdone:
+		return nil, l.rerr
+	}
+}
+
+// readDNAT reads the packets of DNAT clients. The sessions are keyed by the client and the
+// original destination, which is looked up in the conntrack table off this loop.
+func (l *redirectListener) readDNAT() {
+	for {
+		b := bufpool.Get(l.md.readBufferSize)
+
+		// the address the packets were redirected to identifies the conntrack entry
+		n, raddr, laddr, mark, err := readFromUDPPktinfo(l.ln, *b)
+		if err != nil {
+			bufpool.Put(b)
+			if _, ok := err.(net.Error); ok {
+				l.rerr = err
+				close(l.rdone)
+				return
+			}
+			log.ErrorS("listener", fmt.Sprintf("dropping packet: %v", err))
+			l.sessions.recordDropped("parse")
+			continue
+		}
+		*b = (*b)[:n]
+
+		if !l.flows.dispatch(b, laddr, raddr, mark) {
+			l.sessions.recordDropped("queue")
+		}
+	}
+}
+
+// deliverDNAT hands a packet over to the session of the client and original destination,
+// it opens the session if there is none yet.
+func (l *redirectListener) deliverDNAT(b *[]byte, laddr, raddr, dstAddr *net.UDPAddr, mark int) {
+	key := raddr.String() + "-" + dstAddr.String()
+	if c := l.sessions.get(key); c != nil {
+		c.enqueue(b)
 		return
 	}
 
-	conn = &redirConn{
-		Conn: c,
-		buf:  (*b)[:n],
-		ttl:  l.md.ttl,
+	log.ConnDebug("listener", raddr.String(), dstAddr.String(), "establishing")
+
+	rc := newRedirConn(newDNATConn(l.ln, l.network() == "udp4", laddr, dstAddr, raddr), key, l.sessions, l.md.readBufferSize)
+	rc.mark = mark
+	rc.enqueue(b)
+	l.sessions.add(rc)
+
+	select {
+	case l.accepted <- rc:
+	default:
+		// the handler does not keep up with new sessions
+		rc.Close()
+		l.sessions.recordDropped("backlog")
+	}
+}
+
+func (l *redirectListener) lookupFailed(laddr, raddr *net.UDPAddr, err error, dropped int) {
+	log.ConnError("listener", raddr.String(), laddr.String(), err)
+	for i := 0; i < dropped; i++ {
+		l.sessions.recordDropped("conntrack")
 	}
-	return
 }
 
 // ReadFromUDP reads a UDP packet from c, copying the payload into b.
@@ -80,80 +210,147 @@ func (l *redirectListener) accept() (conn net.Conn, err error) {
 // that was on the packet.
 //
 // Out-of-band data is also read in so that the original destination
-// address can be identified and parsed.
-func readFromUDP(conn *net.UDPConn, b []byte) (n int, remoteAddr *net.UDPAddr, dstAddr *net.UDPAddr, err error) {
+// address and the mark of the packet can be identified and parsed.
+func readFromUDP(conn *net.UDPConn, b []byte) (n int, remoteAddr *net.UDPAddr, dstAddr *net.UDPAddr, mark int, err error) {
 	oob := bufpool.Get(1024)
 	defer bufpool.Put(oob)
 
 	n, oobn, _, remoteAddr, err := conn.ReadMsgUDP(b, *oob)
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, nil, nil, 0, err
 	}
 
 	msgs, err := unix.ParseSocketControlMessage((*oob)[:oobn])
 	if err != nil {
-		return 0, nil, nil, fmt.Errorf("parsing socket control message: %s", err)
+		return 0, nil, nil, 0, fmt.Errorf("parsing socket control message: %s", err)
 	}
 
 	for _, msg := range msgs {
-		if msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_RECVORIGDSTADDR {
-			originalDstRaw := &unix.RawSockaddrInet4{}
-			if err = binary.Read(bytes.NewReader(msg.Data), binary.LittleEndian, originalDstRaw); err != nil {
-				return 0, nil, nil, fmt.Errorf("reading original destination address: %s", err)
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_ORIGDSTADDR:
+			pp := &unix.RawSockaddrInet4{}
+			if err = binary.Read(bytes.NewReader(msg.Data), binary.LittleEndian, pp); err != nil {
+				return 0, nil, nil, 0, fmt.Errorf("reading original destination address: %s", err)
+			}
+			if pp.Family != unix.AF_INET {
+				return 0, nil, nil, 0, fmt.Errorf("original destination is an unsupported network family")
+			}
+			p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+			dstAddr = &net.UDPAddr{
+				IP:   net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]),
+				Port: int(p[0])<<8 + int(p[1]),
 			}
 
-			switch originalDstRaw.Family {
-			case unix.AF_INET:
-				pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(originalDstRaw))
-				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
-				dstAddr = &net.UDPAddr{
-					IP:   net.IPv4(pp.Addr[0], pp.Addr[1], pp.Addr[2], pp.Addr[3]),
-					Port: int(p[0])<<8 + int(p[1]),
-				}
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_ORIGDSTADDR:
+			pp := &unix.RawSockaddrInet6{}
+			if err = binary.Read(bytes.NewReader(msg.Data), binary.LittleEndian, pp); err != nil {
+				return 0, nil, nil, 0, fmt.Errorf("reading original destination address: %s", err)
+			}
+			if pp.Family != unix.AF_INET6 {
+				return 0, nil, nil, 0, fmt.Errorf("original destination is an unsupported network family")
+			}
+			p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+			dstAddr = &net.UDPAddr{
+				IP:   net.IP(pp.Addr[:]),
+				Port: int(p[0])<<8 + int(p[1]),
+			}
+			if pp.Scope_id != 0 {
+				dstAddr.Zone = strconv.Itoa(int(pp.Scope_id))
+			}
 
-			case unix.AF_INET6:
-				pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(originalDstRaw))
-				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
-				dstAddr = &net.UDPAddr{
-					IP:   net.IP(pp.Addr[:]),
-					Port: int(p[0])<<8 + int(p[1]),
-					Zone: strconv.Itoa(int(pp.Scope_id)),
-				}
+		case msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_MARK:
+			mark = socketMark(msg.Data)
+		}
+	}
+
+	if dstAddr == nil {
+		return 0, nil, nil, 0, fmt.Errorf("unable to obtain original destination: %s", err)
+	}
+
+	return
+}
 
-			default:
-				return 0, nil, nil, fmt.Errorf("original destination is an unsupported network family")
+// readFromUDPPktinfo reads a UDP packet from c like readFromUDP,
+// the returned address is the local address the packet was sent to.
+func readFromUDPPktinfo(conn *net.UDPConn, b []byte) (n int, remoteAddr *net.UDPAddr, localAddr *net.UDPAddr, mark int, err error) {
+	oob := bufpool.Get(1024)
+	defer bufpool.Put(oob)
+
+	n, oobn, _, remoteAddr, err := conn.ReadMsgUDP(b, *oob)
+	if err != nil {
+		return 0, nil, nil, 0, err
+	}
+
+	msgs, err := unix.ParseSocketControlMessage((*oob)[:oobn])
+	if err != nil {
+		return 0, nil, nil, 0, fmt.Errorf("parsing socket control message: %s", err)
+	}
+
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	for _, msg := range msgs {
+		switch {
+		case msg.Header.Level == unix.SOL_IP && msg.Header.Type == unix.IP_PKTINFO &&
+			len(msg.Data) >= unix.SizeofInet4Pktinfo:
+			info := (*unix.Inet4Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			localAddr = &net.UDPAddr{
+				IP:   net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3]),
+				Port: port,
 			}
-			break
+
+		case msg.Header.Level == unix.SOL_IPV6 && msg.Header.Type == unix.IPV6_PKTINFO &&
+			len(msg.Data) >= unix.SizeofInet6Pktinfo:
+			info := (*unix.Inet6Pktinfo)(unsafe.Pointer(&msg.Data[0]))
+			localAddr = &net.UDPAddr{
+				IP:   append(net.IP(nil), info.Addr[:]...),
+				Port: port,
+			}
+
+		case msg.Header.Level == unix.SOL_SOCKET && msg.Header.Type == unix.SO_MARK:
+			mark = socketMark(msg.Data)
 		}
 	}
 
-	if dstAddr == nil {
-		return 0, nil, nil, fmt.Errorf("unable to obtain original destination: %s", err)
+	if localAddr == nil {
+		return 0, nil, nil, 0, fmt.Errorf("unable to obtain local address of the packet")
 	}
 
 	return
 }
 
+func socketMark(data []byte) int {
+	if len(data) < 4 {
+		return 0
+	}
+	return int(*(*uint32)(unsafe.Pointer(&data[0])))
+}
+
 // DialUDP connects to the remote address raddr on the network net,
 // which must be "udp", "udp4", or "udp6".  If laddr is not nil, it is
 // used as the local address for the connection.
 func dialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (net.Conn, error) {
-	remoteSocketAddress, err := udpAddrToSocketAddr(raddr)
+	family := udpAddrFamily(network, laddr, raddr)
+
+	remoteSocketAddress, err := udpAddrToSocketAddr(family, raddr)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("build destination socket address: %s", err)}
 	}
 
-	localSocketAddress, err := udpAddrToSocketAddr(laddr)
+	localSocketAddress, err := udpAddrToSocketAddr(family, laddr)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("build local socket address: %s", err)}
 	}
 
-	fileDescriptor, err := unix.Socket(udpAddrFamily(network, laddr, raddr), unix.SOCK_DGRAM, 0)
+	fileDescriptor, err := unix.Socket(family, unix.SOCK_DGRAM, 0)
 	if err != nil {
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("socket open: %s", err)}
 	}
 
-	if err = unix.SetsockoptInt(fileDescriptor, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+	if family == unix.AF_INET6 {
+		err = unix.SetsockoptInt(fileDescriptor, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+	} else {
+		err = unix.SetsockoptInt(fileDescriptor, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+	}
+	if err != nil {
 		unix.Close(fileDescriptor)
 		return nil, &net.OpError{Op: "dial", Err: fmt.Errorf("set socket option: IP_TRANSPARENT: %s", err)}
 	}
@@ -190,32 +387,51 @@ func dialUDP(network string, laddr *net.UDPAddr, raddr *net.UDPAddr) (net.Conn,
 }
 
 // udpAddToSockerAddr will convert a UDPAddr
-// into a Sockaddr that may be used when
-// connecting and binding sockets
-func udpAddrToSocketAddr(addr *net.UDPAddr) (unix.Sockaddr, error) {
-	switch {
-	case addr.IP.To4() != nil:
+// into a Sockaddr of the given family that may
+// be used when connecting and binding sockets
+func udpAddrToSocketAddr(family int, addr *net.UDPAddr) (unix.Sockaddr, error) {
+	if family == unix.AF_INET {
 		ip := [4]byte{}
-		copy(ip[:], addr.IP.To4())
+		if copy(ip[:], addr.IP.To4()) == 0 {
+			return nil, fmt.Errorf("%v is not an IPv4 address", addr)
+		}
 
 		return &unix.SockaddrInet4{Addr: ip, Port: addr.Port}, nil
+	}
 
-	default:
-		ip := [16]byte{}
-		copy(ip[:], addr.IP.To16())
+	ip := [16]byte{}
+	copy(ip[:], addr.IP.To16())
 
-		zoneID, err := strconv.ParseUint(addr.Zone, 10, 32)
-		if err != nil {
-			return nil, err
-		}
+	zoneID, err := udpAddrZone(addr.Zone)
+	if err != nil {
+		return nil, err
+	}
 
-		return &unix.SockaddrInet6{Addr: ip, Port: addr.Port, ZoneId: uint32(zoneID)}, nil
+	return &unix.SockaddrInet6{Addr: ip, Port: addr.Port, ZoneId: zoneID}, nil
+}
+
+// udpAddrZone resolves the zone of an IPv6
+// address, which is either the index or
+// the name of the interface
+func udpAddrZone(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	if id, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	ifce, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, err
 	}
+	return uint32(ifce.Index), nil
 }
 
 // udpAddrFamily will attempt to work
 // out the address family based on the
-// network and UDP addresses
+// network and UDP addresses, IPv4 clients
+// of a dual-stack listener get an IPv4 socket
 func udpAddrFamily(net string, laddr, raddr *net.UDPAddr) int {
 	switch net[len(net)-1] {
 	case '4':
@@ -225,7 +441,7 @@ func udpAddrFamily(net string, laddr, raddr *net.UDPAddr) int {
 	}
 
 	if (laddr == nil || laddr.IP.To4() != nil) &&
-		(raddr == nil || laddr.IP.To4() != nil) {
+		(raddr == nil || raddr.IP.To4() != nil) {
 		return unix.AF_INET
 	}
 	return unix.AF_INET6
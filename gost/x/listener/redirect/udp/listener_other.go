@@ -14,3 +14,13 @@ func (l *redirectListener) listenUDP(addr string) (*net.UDPConn, error) {
 func (l *redirectListener) accept() (conn net.Conn, err error) {
 	return nil, errors.New("UDP redirect is not available on non-linux platform")
 }
+
+type conntrack struct{}
+
+func newConntrack() *conntrack {
+	return &conntrack{}
+}
+
+func (ct *conntrack) Close() error {
+	return nil
+}
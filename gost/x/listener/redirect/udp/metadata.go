@@ -10,19 +10,26 @@ import (
 const (
 	defaultTTL            = 30 * time.Second
 	defaultReadBufferSize = 4096
+	defaultMaxSessions    = 4096
 )
 
 type metadata struct {
+	tproxy         bool
 	ttl            time.Duration
 	readBufferSize int
+	maxSessions    int
 }
 
 func (l *redirectListener) parseMetadata(md mdata.Metadata) (err error) {
 	const (
+		tproxy         = "tproxy"
 		ttl            = "ttl"
 		readBufferSize = "readBufferSize"
+		maxSessions    = "maxSessions"
 	)
 
+	l.md.tproxy = mdutil.GetBool(md, tproxy)
+
 	l.md.ttl = mdutil.GetDuration(md, ttl)
 	if l.md.ttl <= 0 {
 		l.md.ttl = defaultTTL
@@ -33,5 +40,10 @@ func (l *redirectListener) parseMetadata(md mdata.Metadata) (err error) {
 		l.md.readBufferSize = defaultReadBufferSize
 	}
 
+	l.md.maxSessions = mdutil.GetInt(md, maxSessions)
+	if l.md.maxSessions <= 0 {
+		l.md.maxSessions = defaultMaxSessions
+	}
+
 	return
 }
@@ -0,0 +1,188 @@
+package udp
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"proxy_forwarder/gost/core/metrics"
+	xmetrics "proxy_forwarder/gost/x/metrics"
+)
+
+// sessionTable keeps the UDP sessions of a listener keyed by client and original destination.
+// Sessions are ordered by activity, idle ones are closed by the janitor and the least
+// recently used one is closed if the table is full.
+type sessionTable struct {
+	mu       sync.Mutex
+	sessions map[string]*redirConn
+	lru      *list.List
+	max      int
+	ttl      time.Duration
+	service  string
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newSessionTable(service string, max int, ttl time.Duration) *sessionTable {
+	t := &sessionTable{
+		sessions: make(map[string]*redirConn),
+		lru:      list.New(),
+		max:      max,
+		ttl:      ttl,
+		service:  service,
+		done:     make(chan struct{}),
+	}
+	go t.janitor()
+	return t
+}
+
+func (t *sessionTable) get(key string) *redirConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.sessions[key]
+	if c != nil {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+		t.lru.MoveToFront(c.elem)
+	}
+	return c
+}
+
+func (t *sessionTable) add(c *redirConn) {
+	var evicted *redirConn
+
+	t.mu.Lock()
+	if t.max > 0 && len(t.sessions) >= t.max {
+		if e := t.lru.Back(); e != nil {
+			evicted = e.Value.(*redirConn)
+			t.unlink(evicted)
+		}
+	}
+	c.elem = t.lru.PushFront(c)
+	t.sessions[c.key] = c
+	t.mu.Unlock()
+
+	t.gauge().Inc()
+
+	if evicted != nil {
+		t.recordEvicted("limit")
+		evicted.Close()
+	}
+}
+
+func (t *sessionTable) touch(c *redirConn) {
+	atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+
+	t.mu.Lock()
+	if t.sessions[c.key] == c {
+		t.lru.MoveToFront(c.elem)
+	}
+	t.mu.Unlock()
+}
+
+func (t *sessionTable) remove(c *redirConn) {
+	t.mu.Lock()
+	t.unlink(c)
+	t.mu.Unlock()
+}
+
+// unlink drops the session from the table, the caller has to hold the lock.
+func (t *sessionTable) unlink(c *redirConn) {
+	if t.sessions[c.key] != c {
+		return
+	}
+	delete(t.sessions, c.key)
+	t.lru.Remove(c.elem)
+	t.gauge().Dec()
+}
+
+func (t *sessionTable) janitor() {
+	interval := t.ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.evictIdle()
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *sessionTable) evictIdle() {
+	var idle []*redirConn
+
+	t.mu.Lock()
+	for e := t.lru.Back(); e != nil; {
+		c := e.Value.(*redirConn)
+		if c.idle() < t.ttl {
+			break
+		}
+		e = e.Prev()
+		t.unlink(c)
+		idle = append(idle, c)
+	}
+	t.mu.Unlock()
+
+	for _, c := range idle {
+		t.recordEvicted("idle")
+		c.Close()
+	}
+}
+
+func (t *sessionTable) Close() error {
+	t.once.Do(func() {
+		close(t.done)
+
+		t.mu.Lock()
+		sessions := make([]*redirConn, 0, len(t.sessions))
+		for _, c := range t.sessions {
+			sessions = append(sessions, c)
+		}
+		t.mu.Unlock()
+
+		for _, c := range sessions {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+func (t *sessionTable) gauge() metrics.Gauge {
+	if v := xmetrics.GetGauge(xmetrics.MetricServiceUDPSessionsGauge,
+		metrics.Labels{"service": t.service}); v != nil {
+		return v
+	}
+	return xmetrics.Noop().Gauge(xmetrics.MetricServiceUDPSessionsGauge, nil)
+}
+
+func (t *sessionTable) recordEvicted(reason string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceUDPSessionsEvictedCounter,
+		metrics.Labels{"service": t.service, "reason": reason}); v != nil {
+		v.Inc()
+	}
+}
+
+// recordPacket counts a packet of a session, direction is 'in' from the client or 'out' to the client.
+func (t *sessionTable) recordPacket(direction string, n int) {
+	labels := metrics.Labels{"service": t.service, "direction": direction}
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceUDPPacketsCounter, labels); v != nil {
+		v.Inc()
+	}
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceUDPBytesCounter, labels); v != nil {
+		v.Add(float64(n))
+	}
+}
+
+func (t *sessionTable) recordDropped(reason string) {
+	if v := xmetrics.GetCounter(xmetrics.MetricServiceUDPDroppedCounter,
+		metrics.Labels{"service": t.service, "reason": reason}); v != nil {
+		v.Inc()
+	}
+}
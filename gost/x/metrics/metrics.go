@@ -21,6 +21,26 @@ const (
 	MetricServiceHandlerErrorsCounter metrics.MetricName = "gost_service_handler_errors_total"
 	// Total chain connect errors. Labels: host, chain, node.
 	MetricChainErrorsCounter metrics.MetricName = "gost_chain_errors_total"
+	// Health of the chain nodes by the active checks, 1 if up. Labels: host, hop, node.
+	MetricNodeHealthyGauge metrics.MetricName = "gost_chain_node_healthy"
+	// Total sniffed connections by detected protocol. Labels: host, service, protocol.
+	MetricServiceSniffingCounter metrics.MetricName = "gost_service_sniffing_total"
+	// Total denied connections. Labels: host, service, reason.
+	MetricServiceDeniedCounter metrics.MetricName = "gost_service_denied_total"
+	// Total TLS connections by JA4 fingerprint. Labels: host, service, ja4.
+	MetricServiceTLSFingerprintsCounter metrics.MetricName = "gost_service_tls_fingerprints_total"
+	// Number of UDP sessions. Labels: host, service.
+	MetricServiceUDPSessionsGauge metrics.MetricName = "gost_service_udp_sessions"
+	// Total evicted UDP sessions. Labels: host, service, reason.
+	MetricServiceUDPSessionsEvictedCounter metrics.MetricName = "gost_service_udp_sessions_evicted_total"
+	// Total UDP packets of the sessions. Labels: host, service, direction.
+	MetricServiceUDPPacketsCounter metrics.MetricName = "gost_service_udp_packets_total"
+	// Total UDP payload size of the sessions in bytes. Labels: host, service, direction.
+	MetricServiceUDPBytesCounter metrics.MetricName = "gost_service_udp_bytes_total"
+	// Total dropped UDP packets. Labels: host, service, reason.
+	MetricServiceUDPDroppedCounter metrics.MetricName = "gost_service_udp_dropped_total"
+	// Total rejected redirect loops. Labels: host, service, reason.
+	MetricServiceLoopsCounter metrics.MetricName = "gost_service_loops_total"
 )
 
 var (
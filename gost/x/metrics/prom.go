@@ -32,6 +32,18 @@ func NewMetrics() metrics.Metrics {
 					Help: "Current in-flight requests",
 				},
 				[]string{"host", "service", "client"}),
+			MetricServiceUDPSessionsGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: string(MetricServiceUDPSessionsGauge),
+					Help: "Current number of UDP sessions",
+				},
+				[]string{"host", "service"}),
+			MetricNodeHealthyGauge: prometheus.NewGaugeVec(
+				prometheus.GaugeOpts{
+					Name: string(MetricNodeHealthyGauge),
+					Help: "Health of the chain nodes by the active checks (1 up, 0 down)",
+				},
+				[]string{"host", "hop", "node"}),
 		},
 		counters: map[metrics.MetricName]*prometheus.CounterVec{
 			MetricServiceRequestsCounter: prometheus.NewCounterVec(
@@ -64,6 +76,54 @@ func NewMetrics() metrics.Metrics {
 					Help: "Total chain errors",
 				},
 				[]string{"host", "chain", "node"}),
+			MetricServiceSniffingCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceSniffingCounter),
+					Help: "Total number of sniffed connections by detected protocol",
+				},
+				[]string{"host", "service", "protocol"}),
+			MetricServiceDeniedCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceDeniedCounter),
+					Help: "Total number of denied connections",
+				},
+				[]string{"host", "service", "reason"}),
+			MetricServiceTLSFingerprintsCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceTLSFingerprintsCounter),
+					Help: "Total number of TLS connections by JA4 fingerprint",
+				},
+				[]string{"host", "service", "ja4"}),
+			MetricServiceUDPSessionsEvictedCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceUDPSessionsEvictedCounter),
+					Help: "Total number of evicted UDP sessions",
+				},
+				[]string{"host", "service", "reason"}),
+			MetricServiceUDPPacketsCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceUDPPacketsCounter),
+					Help: "Total number of UDP packets of the sessions (in from the clients, out to the clients)",
+				},
+				[]string{"host", "service", "direction"}),
+			MetricServiceUDPBytesCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceUDPBytesCounter),
+					Help: "Total UDP payload size of the sessions in bytes (in from the clients, out to the clients)",
+				},
+				[]string{"host", "service", "direction"}),
+			MetricServiceUDPDroppedCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceUDPDroppedCounter),
+					Help: "Total number of dropped UDP packets",
+				},
+				[]string{"host", "service", "reason"}),
+			MetricServiceLoopsCounter: prometheus.NewCounterVec(
+				prometheus.CounterOpts{
+					Name: string(MetricServiceLoopsCounter),
+					Help: "Total number of rejected redirect loops",
+				},
+				[]string{"host", "service", "reason"}),
 		},
 		histograms: map[metrics.MetricName]*prometheus.HistogramVec{
 			MetricServiceRequestsDurationObserver: prometheus.NewHistogramVec(
@@ -14,7 +14,8 @@ const (
 )
 
 type options struct {
-	path string
+	path     string
+	handlers map[string]http.Handler
 }
 
 type Option func(*options)
@@ -25,6 +26,16 @@ func PathOption(path string) Option {
 	}
 }
 
+// HandlerOption serves additional debugging information next to the metrics.
+func HandlerOption(path string, h http.Handler) Option {
+	return func(o *options) {
+		if o.handlers == nil {
+			o.handlers = make(map[string]http.Handler)
+		}
+		o.handlers[path] = h
+	}
+}
+
 type metricService struct {
 	s  *http.Server
 	ln net.Listener
@@ -46,6 +57,9 @@ func NewService(addr string, opts ...Option) (service.Service, error) {
 
 	mux := http.NewServeMux()
 	mux.Handle(options.path, promhttp.Handler())
+	for path, h := range options.handlers {
+		mux.Handle(path, h)
+	}
 	return &metricService{
 		s: &http.Server{
 			Handler: mux,
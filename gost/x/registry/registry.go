@@ -18,6 +18,7 @@ import (
 	reg "proxy_forwarder/gost/core/registry"
 	"proxy_forwarder/gost/core/resolver"
 	"proxy_forwarder/gost/core/service"
+	"proxy_forwarder/gost/core/sniffer"
 )
 
 var (
@@ -38,6 +39,7 @@ var (
 	resolverReg  reg.Registry[resolver.Resolver]   = new(resolverRegistry)
 	hostsReg     reg.Registry[hosts.HostMapper]    = new(hostsRegistry)
 	recorderReg  reg.Registry[recorder.Recorder]   = new(recorderRegistry)
+	snifferReg   reg.Registry[sniffer.Sniffer]     = new(snifferRegistry)
 
 	trafficLimiterReg reg.Registry[traffic.TrafficLimiter] = new(trafficLimiterRegistry)
 	connLimiterReg    reg.Registry[conn.ConnLimiter]       = new(connLimiterRegistry)
@@ -147,6 +149,10 @@ func RecorderRegistry() reg.Registry[recorder.Recorder] {
 	return recorderReg
 }
 
+func SnifferRegistry() reg.Registry[sniffer.Sniffer] {
+	return snifferReg
+}
+
 func TrafficLimiterRegistry() reg.Registry[traffic.TrafficLimiter] {
 	return trafficLimiterReg
 }
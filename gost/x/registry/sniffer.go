@@ -0,0 +1,13 @@
+package registry
+
+import (
+	"proxy_forwarder/gost/core/sniffer"
+)
+
+type snifferRegistry struct {
+	registry[sniffer.Sniffer]
+}
+
+func (r *snifferRegistry) Register(name string, v sniffer.Sniffer) error {
+	return r.registry.Register(name, v)
+}
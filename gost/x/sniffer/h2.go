@@ -0,0 +1,40 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+
+	"proxy_forwarder/gost/core/sniffer"
+	"proxy_forwarder/gost/x/registry"
+)
+
+func init() {
+	registry.SnifferRegistry().Register(sniffer.ProtocolHTTP2, &h2cSniffer{})
+}
+
+var (
+	// client connection preface of HTTP/2 with prior knowledge, RFC 9113 section 3.4
+	h2cPreface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+)
+
+type h2cSniffer struct{}
+
+func (s *h2cSniffer) Sniff(ctx context.Context, b []byte) *sniffer.Result {
+	if len(b) >= len(h2cPreface) {
+		if !bytes.HasPrefix(b, h2cPreface) {
+			return nil
+		}
+		return &sniffer.Result{
+			Protocol:   sniffer.ProtocolHTTP2,
+			Confidence: sniffer.ConfidenceHigh,
+		}
+	}
+
+	if len(b) < 4 || !bytes.HasPrefix(h2cPreface, b) {
+		return nil
+	}
+	return &sniffer.Result{
+		Protocol:   sniffer.ProtocolHTTP2,
+		Confidence: sniffer.ConfidenceMedium,
+	}
+}
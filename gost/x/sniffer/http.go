@@ -0,0 +1,70 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+
+	"proxy_forwarder/gost/core/sniffer"
+	"proxy_forwarder/gost/x/registry"
+)
+
+func init() {
+	registry.SnifferRegistry().Register(sniffer.ProtocolHTTP, &httpSniffer{})
+}
+
+var (
+	httpMethods = []string{
+		http.MethodGet,
+		http.MethodHead,
+		http.MethodPost,
+		http.MethodPut,
+		http.MethodPatch,
+		http.MethodDelete,
+		http.MethodConnect,
+		http.MethodOptions,
+		http.MethodTrace,
+	}
+)
+
+type httpSniffer struct{}
+
+func (s *httpSniffer) Sniff(ctx context.Context, b []byte) *sniffer.Result {
+	var method string
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, []byte(m+" ")) {
+			method = m
+			break
+		}
+	}
+	if method == "" {
+		return nil
+	}
+
+	res := &sniffer.Result{
+		Protocol:   sniffer.ProtocolHTTP,
+		Confidence: sniffer.ConfidenceMedium,
+	}
+
+	lines := strings.Split(string(b), "\r\n")
+	if len(lines) < 2 {
+		// request line is not complete yet
+		return res
+	}
+	if strings.HasSuffix(lines[0], " HTTP/1.1") || strings.HasSuffix(lines[0], " HTTP/1.0") {
+		res.Confidence = sniffer.ConfidenceHigh
+	}
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(k, "Host") {
+			res.Host = strings.TrimSpace(v)
+			break
+		}
+	}
+
+	return res
+}
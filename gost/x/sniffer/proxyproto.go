@@ -0,0 +1,45 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+
+	"proxy_forwarder/gost/core/sniffer"
+	"proxy_forwarder/gost/x/registry"
+)
+
+func init() {
+	registry.SnifferRegistry().Register(sniffer.ProtocolProxyProtocol, &proxyProtocolSniffer{})
+}
+
+var (
+	proxyProtocolV1Prefix    = []byte("PROXY ")
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+type proxyProtocolSniffer struct{}
+
+func (s *proxyProtocolSniffer) Sniff(ctx context.Context, b []byte) *sniffer.Result {
+	switch {
+	case bytes.HasPrefix(b, proxyProtocolV2Signature):
+		return &sniffer.Result{
+			Protocol:   sniffer.ProtocolProxyProtocol,
+			Confidence: sniffer.ConfidenceHigh,
+		}
+
+	case bytes.HasPrefix(b, proxyProtocolV1Prefix):
+		res := &sniffer.Result{
+			Protocol:   sniffer.ProtocolProxyProtocol,
+			Confidence: sniffer.ConfidenceMedium,
+		}
+		rest := b[len(proxyProtocolV1Prefix):]
+		if bytes.HasPrefix(rest, []byte("TCP4 ")) ||
+			bytes.HasPrefix(rest, []byte("TCP6 ")) ||
+			bytes.HasPrefix(rest, []byte("UNKNOWN")) {
+			res.Confidence = sniffer.ConfidenceHigh
+		}
+		return res
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+
+	"proxy_forwarder/gost/core/sniffer"
+	"proxy_forwarder/gost/x/registry"
+)
+
+func init() {
+	registry.SnifferRegistry().Register(sniffer.ProtocolSOCKS, &socksSniffer{})
+}
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+)
+
+type socksSniffer struct{}
+
+func (s *socksSniffer) Sniff(ctx context.Context, b []byte) *sniffer.Result {
+	if len(b) < 3 {
+		return nil
+	}
+
+	switch b[0] {
+	case socks5Version:
+		// method selection: VER | NMETHODS | METHODS
+		nmethods := int(b[1])
+		if nmethods == 0 || len(b) != 2+nmethods {
+			return nil
+		}
+		for _, method := range b[2:] {
+			// no auth, GSSAPI, user/pass, IANA assigned and private methods
+			if method > 0x09 && method < 0x80 || method == 0xff {
+				return nil
+			}
+		}
+		return &sniffer.Result{
+			Protocol:   sniffer.ProtocolSOCKS,
+			Confidence: sniffer.ConfidenceMedium,
+		}
+
+	case socks4Version:
+		// VER | CMD | DSTPORT | DSTIP | USERID | NULL
+		if len(b) < 9 || (b[1] != 0x01 && b[1] != 0x02) {
+			return nil
+		}
+		userEnd := bytes.IndexByte(b[8:], 0)
+		if userEnd < 0 {
+			return nil
+		}
+		res := &sniffer.Result{
+			Protocol:   sniffer.ProtocolSOCKS,
+			Confidence: sniffer.ConfidenceLow,
+		}
+		// SOCKS4a: DSTIP 0.0.0.x followed by the hostname
+		if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
+			rest := b[8+userEnd+1:]
+			if hostEnd := bytes.IndexByte(rest, 0); hostEnd > 0 {
+				res.Host = string(rest[:hostEnd])
+				res.Confidence = sniffer.ConfidenceMedium
+			}
+		}
+		return res
+	}
+
+	return nil
+}
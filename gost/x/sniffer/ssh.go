@@ -0,0 +1,31 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+
+	"proxy_forwarder/gost/core/sniffer"
+	"proxy_forwarder/gost/x/registry"
+)
+
+func init() {
+	registry.SnifferRegistry().Register(sniffer.ProtocolSSH, &sshSniffer{})
+}
+
+type sshSniffer struct{}
+
+func (s *sshSniffer) Sniff(ctx context.Context, b []byte) *sniffer.Result {
+	if !bytes.HasPrefix(b, []byte("SSH-")) {
+		return nil
+	}
+
+	res := &sniffer.Result{
+		Protocol:   sniffer.ProtocolSSH,
+		Confidence: sniffer.ConfidenceMedium,
+	}
+	// protocol version exchange, RFC 4253 section 4.2
+	if bytes.HasPrefix(b, []byte("SSH-2.0-")) || bytes.HasPrefix(b, []byte("SSH-1.99-")) {
+		res.Confidence = sniffer.ConfidenceHigh
+	}
+	return res
+}
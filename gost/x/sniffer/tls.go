@@ -0,0 +1,56 @@
+package sniffer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+
+	"proxy_forwarder/gost/core/sniffer"
+	dissector "proxy_forwarder/gost/tls-dissector"
+	"proxy_forwarder/gost/x/registry"
+)
+
+func init() {
+	registry.SnifferRegistry().Register(sniffer.ProtocolTLS, &tlsSniffer{})
+}
+
+type tlsSniffer struct{}
+
+func (s *tlsSniffer) Sniff(ctx context.Context, b []byte) *sniffer.Result {
+	if len(b) < dissector.RecordHeaderLen || b[0] != dissector.Handshake {
+		return nil
+	}
+
+	version := binary.BigEndian.Uint16(b[1:3])
+	if version < tls.VersionSSL30 || version > tls.VersionTLS13 {
+		return nil
+	}
+
+	res := &sniffer.Result{
+		Protocol:   sniffer.ProtocolTLS,
+		Confidence: sniffer.ConfidenceMedium,
+	}
+	if version == tls.VersionTLS10 {
+		// clients send the ClientHello in a TLSv1.0 record for compatibility
+		res.Confidence = sniffer.ConfidenceHigh
+	}
+
+	// the ClientHello might not be complete yet, the host is best-effort.
+	record, err := dissector.ReadRecord(bytes.NewReader(b))
+	if err != nil {
+		return res
+	}
+	clientHello := dissector.ClientHelloMsg{}
+	if err := clientHello.Decode(record.Opaque); err != nil {
+		return res
+	}
+	for _, ext := range clientHello.Extensions {
+		if ext.Type() == dissector.ExtServerName {
+			res.Host = ext.(*dissector.ServerNameExtension).Name
+			break
+		}
+	}
+
+	return res
+}